@@ -3,13 +3,18 @@ module github.com/iantal/rm
 go 1.14
 
 require (
+	github.com/go-git/go-git/v5 v5.2.0
 	github.com/google/uuid v1.1.2
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
 	github.com/jinzhu/gorm v1.9.16
+	github.com/klauspost/compress v1.11.3
+	github.com/mattn/go-sqlite3 v1.14.0
+	github.com/minio/minio-go/v7 v7.0.6
 	github.com/sirupsen/logrus v1.7.0
 	github.com/spf13/viper v1.7.1
 	github.com/stretchr/testify v1.6.1
+	github.com/ulikunitz/xz v0.5.8
 	golang.org/x/sys v0.0.0-20201113233024-12cec1faf1ba // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1
 	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776 // indirect
@@ -0,0 +1,12 @@
+package domain
+
+import (
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Pin protects the files of a project from being evicted by the garbage collector
+type Pin struct {
+	gorm.Model `json:"-"`
+	ProjectID  uuid.UUID `gorm:"type:uuid;unique_index" json:"projectId"`
+}
@@ -1,6 +1,8 @@
 package domain
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/jinzhu/gorm"
 )
@@ -12,7 +14,57 @@ type Project struct {
 	CommitHash   string    `gorm:"primary_key" json:"commit,omitempty"`
 	Name         string    `json:"name,omitempty"`
 	UnzippedPath string    `json:"unzip,omitempty"`
-	BundlePath   string    `json:"zip,omitempty"`
+	// BundlePath is the key of the bundle in the blob store
+	BundlePath string `json:"zip,omitempty"`
+	// BundleDigest is the SHA-256 digest of the bundle, which is stored by content
+	BundleDigest string `json:"bundleDigest,omitempty"`
+	// BundleSize is the size of the bundle in bytes
+	BundleSize   int64   `json:"bundleSize,omitempty"`
+	ZipArchive   Archive `gorm:"embedded;embedded_prefix:zip_archive_" json:"zipArchive"`
+	TarGzArchive Archive `gorm:"embedded;embedded_prefix:tar_gz_archive_" json:"tarGzArchive"`
+	// LastAccessedAt is when the bundle or an archive of the commit was last served
+	LastAccessedAt *time.Time `json:"lastAccessedAt,omitempty"`
+}
+
+// ProjectSummary describes a project across the commits cached for it
+type ProjectSummary struct {
+	ProjectID      uuid.UUID  `json:"projectId"`
+	Name           string     `json:"name"`
+	Commits        int        `json:"commits"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	LastAccessedAt *time.Time `json:"lastAccessedAt,omitempty"`
+	Pinned         bool       `gorm:"-" json:"pinned"`
+}
+
+// Archive is a snapshot of the files of the commit of a project, without history.
+// It is built on demand, Path is the key of its blob and empty until then.
+type Archive struct {
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// Archive returns the snapshot of the commit in the given format, zip or tar.gz,
+// or nil for other formats
+func (p *Project) Archive(format string) *Archive {
+	switch format {
+	case "zip":
+		return &p.ZipArchive
+	case "tar.gz":
+		return &p.TarGzArchive
+	}
+	return nil
+}
+
+// Digests returns the digests of the blobs of the commit which are stored by content
+func (p *Project) Digests() []string {
+	var digests []string
+	for _, d := range []string{p.BundleDigest, p.ZipArchive.Digest, p.TarGzArchive.Digest} {
+		if d != "" {
+			digests = append(digests, d)
+		}
+	}
+	return digests
 }
 
 // NewProject creates an instance of Project
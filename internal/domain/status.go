@@ -1,24 +1,88 @@
 package domain
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/jinzhu/gorm"
 )
 
-// DownloadStatus defines data related to the download status of a project
+// DownloadState is a step of the preparation pipeline of a bundle
+type DownloadState string
+
+// States a DownloadStatus goes through while a bundle is prepared
+const (
+	StateQueued      DownloadState = "queued"
+	StateDownloading DownloadState = "downloading"
+	StateExtracting  DownloadState = "extracting"
+	StateCheckingOut DownloadState = "checking-out" // resolving the commit in the repository
+	StateBundling    DownloadState = "bundling"
+	StateReady       DownloadState = "ready"
+	StateFailed      DownloadState = "failed"
+)
+
+// transitions lists the states that can follow a given state. A project that is
+// already downloaded skips the downloading and extracting states, and a commit
+// bundled by a concurrent job goes straight to ready. Jobs without a commit only
+// download and extract the project. A commit missing from the repository goes back
+// to downloading while the project is fetched again, and commits which are not bundled
+// ahead of their download are ready once checked out.
+var transitions = map[DownloadState][]DownloadState{
+	StateQueued:      {StateDownloading, StateExtracting, StateCheckingOut, StateReady, StateFailed},
+	StateDownloading: {StateExtracting, StateFailed},
+	StateExtracting:  {StateCheckingOut, StateReady, StateFailed},
+	StateCheckingOut: {StateDownloading, StateBundling, StateReady, StateFailed},
+	StateBundling:    {StateReady, StateFailed},
+}
+
+// DownloadStatus tracks the preparation of the bundle for a project and commit, or
+// the download and extraction of a project when the commit is empty
 type DownloadStatus struct {
-	gorm.Model   `json:"-"`
-	ProjectID    uuid.UUID `gorm:"type:uuid;primary_key;" json:"projectId"`
-	UnzippedPath string    `json:"unzip,omitempty"`
+	gorm.Model `json:"-"`
+	JobID      uuid.UUID     `gorm:"type:uuid;unique_index" json:"id"`
+	ProjectID  uuid.UUID     `gorm:"type:uuid;index" json:"projectId"`
+	CommitHash string        `json:"commit,omitempty"`
+	State      DownloadState `json:"state"`
+	Error      string        `json:"error,omitempty"`
+	ErrorCode  string        `json:"code,omitempty"`
+	// Progress is how far the download of the project went, it is set while downloading
+	Progress *DownloadProgress `gorm:"-" json:"progress,omitempty"`
+}
+
+// DownloadProgress is how far the download of the archive of a project from rk went.
+// A download whose UpdatedAt stays behind is hung rather than slow.
+type DownloadProgress struct {
+	Bytes     int64     `json:"bytes"`
+	Total     int64     `json:"total"` // -1 when rk did not announce the size
+	Resumes   int       `json:"resumes"`
+	StartedAt time.Time `json:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt"` // when bytes were last received
+}
+
+// NewDownloadStatus creates a queued DownloadStatus for the given project and commit
+func NewDownloadStatus(id uuid.UUID, commit string) *DownloadStatus {
+	return &DownloadStatus{
+		JobID:      uuid.New(),
+		ProjectID:  id,
+		CommitHash: commit,
+		State:      StateQueued,
+	}
+}
+
+// IsTerminal reports whether no further transitions are possible
+func (d *DownloadStatus) IsTerminal() bool {
+	return d.State == StateReady || d.State == StateFailed
 }
 
-// NewDownloadStatus creates an instance of DownloadStatus
-func NewDownloadStatus(id uuid.UUID, commit, name, unzipped, zipped string) *Project {
-	return &Project{
-		ProjectID:    id,
-		CommitHash:   commit,
-		Name:         name,
-		UnzippedPath: unzipped,
-		BundlePath:   zipped,
+// Transition moves the status to the given state or returns an error if the
+// state machine does not allow it
+func (d *DownloadStatus) Transition(to DownloadState) error {
+	for _, s := range transitions[d.State] {
+		if s == to {
+			d.State = to
+			return nil
+		}
 	}
+	return fmt.Errorf("Invalid transition from %s to %s", d.State, to)
 }
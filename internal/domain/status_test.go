@@ -0,0 +1,55 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadStatusTransitions(t *testing.T) {
+	tests := []struct {
+		from, to DownloadState
+		valid    bool
+	}{
+		{StateQueued, StateDownloading, true},
+		{StateQueued, StateCheckingOut, true},
+		{StateQueued, StateReady, true},
+		{StateDownloading, StateExtracting, true},
+		{StateExtracting, StateCheckingOut, true},
+		{StateCheckingOut, StateDownloading, true},
+		{StateCheckingOut, StateBundling, true},
+		{StateBundling, StateReady, true},
+		{StateBundling, StateFailed, true},
+		{StateQueued, StateBundling, false},
+		{StateDownloading, StateReady, false},
+		{StateDownloading, StateCheckingOut, false},
+		{StateExtracting, StateDownloading, false},
+		{StateBundling, StateCheckingOut, false},
+		{StateReady, StateQueued, false},
+		{StateReady, StateFailed, false},
+		{StateFailed, StateQueued, false},
+	}
+	for _, tt := range tests {
+		s := NewDownloadStatus(uuid.New(), "c1")
+		s.State = tt.from
+		err := s.Transition(tt.to)
+		if tt.valid {
+			assert.NoError(t, err, "%s to %s", tt.from, tt.to)
+			assert.Equal(t, tt.to, s.State)
+		} else {
+			assert.Error(t, err, "%s to %s", tt.from, tt.to)
+			assert.Equal(t, tt.from, s.State)
+		}
+	}
+}
+
+func TestDownloadStatusIsTerminal(t *testing.T) {
+	s := NewDownloadStatus(uuid.New(), "")
+	assert.Equal(t, StateQueued, s.State)
+	assert.False(t, s.IsTerminal())
+	s.State = StateReady
+	assert.True(t, s.IsTerminal())
+	s.State = StateFailed
+	assert.True(t, s.IsTerminal())
+}
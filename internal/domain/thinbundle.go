@@ -0,0 +1,19 @@
+package domain
+
+import (
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// ThinBundle is a bundle of the commit of a project which leaves out the history reachable
+// from a set of haves. Like full bundles it is stored by content, thin bundles with the same
+// content share their blob.
+type ThinBundle struct {
+	gorm.Model `json:"-"`
+	ProjectID  uuid.UUID `gorm:"type:uuid;index:idx_thin_bundles_commit" json:"projectId"`
+	CommitHash string    `gorm:"index:idx_thin_bundles_commit" json:"commit"`
+	// Haves identifies the set of haves the bundle leaves out
+	Haves  string `json:"haves"`
+	Digest string `gorm:"index" json:"digest"`
+	Size   int64  `json:"size"`
+}
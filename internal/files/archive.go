@@ -0,0 +1,106 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// archiveFormats are the formats the snapshot of a commit can be written in
+var archiveFormats = map[Format]bool{
+	FormatZip:   true,
+	FormatTarGz: true,
+}
+
+// ValidArchiveFormat returns an error unless the snapshot of a commit can be written in the format
+func ValidArchiveFormat(format Format) error {
+	if !archiveFormats[format] {
+		return xerrors.Errorf("%q: %w", format, ErrUnsupportedFormat)
+	}
+	return nil
+}
+
+// archiveWriter writes the files of a commit to an archive. Every entry is given the
+// time of the commit so that the archive of a commit is always the same.
+type archiveWriter interface {
+	// add writes an entry, symbolic links have their target as contents
+	add(name string, mode os.FileMode, size int64, contents io.Reader) error
+	Close() error
+}
+
+func newArchiveWriter(w io.Writer, format Format, modTime time.Time) (archiveWriter, error) {
+	switch format {
+	case FormatZip:
+		return &zipArchiveWriter{w: zip.NewWriter(w), modTime: modTime}, nil
+	case FormatTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarArchiveWriter{gz: gz, w: tar.NewWriter(gz), modTime: modTime}, nil
+	}
+	return nil, ValidArchiveFormat(format)
+}
+
+type zipArchiveWriter struct {
+	w       *zip.Writer
+	modTime time.Time
+}
+
+func (z *zipArchiveWriter) add(name string, mode os.FileMode, size int64, contents io.Reader) error {
+	h := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: z.modTime}
+	h.SetMode(mode)
+	w, err := z.w.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, contents)
+	return err
+}
+
+func (z *zipArchiveWriter) Close() error {
+	return z.w.Close()
+}
+
+type tarArchiveWriter struct {
+	gz      *gzip.Writer
+	w       *tar.Writer
+	modTime time.Time
+}
+
+func (t *tarArchiveWriter) add(name string, mode os.FileMode, size int64, contents io.Reader) error {
+	h := &tar.Header{
+		Name:    name,
+		Mode:    int64(mode.Perm()),
+		Size:    size,
+		ModTime: t.modTime,
+		Format:  tar.FormatPAX,
+	}
+	if mode&os.ModeSymlink != 0 {
+		target, err := ioutil.ReadAll(io.LimitReader(contents, size))
+		if err != nil {
+			return err
+		}
+		h.Typeflag = tar.TypeSymlink
+		h.Linkname = string(target)
+		h.Size = 0
+		return t.w.WriteHeader(h)
+	}
+
+	h.Typeflag = tar.TypeReg
+	if err := t.w.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err := io.Copy(t.w, contents)
+	return err
+}
+
+func (t *tarArchiveWriter) Close() error {
+	if err := t.w.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
@@ -0,0 +1,39 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+
+	"golang.org/x/xerrors"
+)
+
+// ContentPrefix is the key below which the blobs stored by content are kept
+const ContentPrefix = "sha256"
+
+// ContentKey returns the key of the blob whose content has the given SHA-256 digest.
+// Blobs stored by content are shared by every commit with the same bundle or archive.
+func ContentKey(digest string) string {
+	if len(digest) < 2 {
+		return path.Join(ContentPrefix, digest)
+	}
+	return path.Join(ContentPrefix, digest[:2], digest)
+}
+
+// ContentDigest returns the hex encoded SHA-256 digest of the file and its size.
+// The file is rewound afterwards.
+func ContentDigest(f File) (string, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, xerrors.Errorf("Unable to rewind file: %w", err)
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, xerrors.Errorf("Unable to hash file: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, xerrors.Errorf("Unable to rewind file: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
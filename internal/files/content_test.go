@@ -0,0 +1,32 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentDigestRewindsFile(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	assert.NoError(t, m.Put(ctx, "1/c/project.bundle", bytes.NewBufferString("Hello World")))
+
+	f, _, err := m.Get(ctx, "1/c/project.bundle")
+	assert.NoError(t, err)
+	defer f.Close()
+	ioutil.ReadAll(f)
+
+	digest, size, err := ContentDigest(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e", digest)
+	assert.Equal(t, int64(11), size)
+
+	b, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello World", string(b))
+
+	assert.Equal(t, "sha256/a5/"+digest, ContentKey(digest))
+}
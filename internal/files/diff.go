@@ -0,0 +1,114 @@
+package files
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrNoMergeBase is returned when two commits do not share any history
+var ErrNoMergeBase = errors.New("No merge base")
+
+// Statuses of the files changed between two commits
+const (
+	StatusAdded    = "added"
+	StatusModified = "modified"
+	StatusDeleted  = "deleted"
+	StatusRenamed  = "renamed"
+)
+
+// renameScore is the similarity in percent above which a deleted and an added file are
+// reported as renamed, the default of git diff -M
+const renameScore = 50
+
+// FileChange is a file changed between two commits with the number of lines added and
+// deleted. Binary files have no line stats.
+type FileChange struct {
+	Path string `json:"path"`
+	// OldPath is the path before the change of renamed files
+	OldPath   string `json:"oldPath,omitempty"`
+	Status    string `json:"status"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Binary    bool   `json:"binary,omitempty"`
+}
+
+// sortChanges orders the changes by path like git diff does
+func sortChanges(changes []FileChange) {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+}
+
+// parseNameStatus reads the output of git diff --name-status -z
+func parseNameStatus(out []byte) ([]FileChange, error) {
+	fields := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	changes := []FileChange{}
+	for i := 0; i < len(fields) && fields[i] != ""; {
+		status := fields[i]
+		c := FileChange{}
+		switch status[0] {
+		case 'A':
+			c.Status = StatusAdded
+		case 'D':
+			c.Status = StatusDeleted
+		case 'R':
+			c.Status = StatusRenamed
+		case 'M', 'T':
+			c.Status = StatusModified
+		default:
+			return nil, xerrors.Errorf("Unexpected diff status %q", status)
+		}
+
+		if c.Status == StatusRenamed {
+			if i+2 >= len(fields) {
+				return nil, xerrors.Errorf("Truncated diff output")
+			}
+			c.OldPath, c.Path = fields[i+1], fields[i+2]
+			i += 3
+		} else {
+			if i+1 >= len(fields) {
+				return nil, xerrors.Errorf("Truncated diff output")
+			}
+			c.Path = fields[i+1]
+			i += 2
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// applyNumstat sets the line stats of the changes from the output of git diff --numstat -z
+func applyNumstat(changes []FileChange, out []byte) {
+	byPath := map[string]*FileChange{}
+	for i := range changes {
+		byPath[changes[i].Path] = &changes[i]
+	}
+
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i < len(fields); i++ {
+		// <added> TAB <deleted> TAB <path>, the path is empty for renames and the
+		// old and new paths follow
+		stat := strings.SplitN(fields[i], "\t", 3)
+		if len(stat) != 3 {
+			continue
+		}
+		path := stat[2]
+		if path == "" && i+2 < len(fields) {
+			path = fields[i+2]
+			i += 2
+		}
+
+		c, ok := byPath[path]
+		if !ok {
+			continue
+		}
+		if stat[0] == "-" {
+			c.Binary = true
+			continue
+		}
+		c.Additions, _ = strconv.Atoi(stat[0])
+		c.Deletions, _ = strconv.Atoi(stat[1])
+	}
+}
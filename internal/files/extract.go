@@ -0,0 +1,133 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrUnsupportedFormat is returned for archives none of the extractors can handle
+var ErrUnsupportedFormat = errors.New("Unsupported archive format")
+
+// Format is the format of an archive downloaded from rk
+type Format string
+
+// Formats of the archives rk may serve
+const (
+	FormatZip    Format = "zip"
+	FormatTar    Format = "tar"
+	FormatTarGz  Format = "tar.gz"
+	FormatTarZst Format = "tar.zst"
+	FormatTarXz  Format = "tar.xz"
+	FormatBundle Format = "bundle"
+)
+
+// Extractor extracts an archive into the target directory within the limits
+type Extractor interface {
+	Extract(archive, target string, limits ExtractLimits) error
+}
+
+// ExtractorFunc adapts a function to the Extractor interface
+type ExtractorFunc func(archive, target string, limits ExtractLimits) error
+
+// Extract calls f(archive, target, limits)
+func (f ExtractorFunc) Extract(archive, target string, limits ExtractLimits) error {
+	return f(archive, target, limits)
+}
+
+var (
+	extractorsMu sync.RWMutex
+	extractors   = map[Format]Extractor{}
+)
+
+// RegisterExtractor makes an extractor available for the given format,
+// replacing the extractor registered before for it
+func RegisterExtractor(format Format, e Extractor) {
+	extractorsMu.Lock()
+	defer extractorsMu.Unlock()
+	extractors[format] = e
+}
+
+func extractorFor(format Format) (Extractor, bool) {
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+	e, ok := extractors[format]
+	return e, ok
+}
+
+// bundles are not registered, they are cloned by the GitBackend of the storage
+func init() {
+	RegisterExtractor(FormatZip, ExtractorFunc(extractZip))
+	RegisterExtractor(FormatTar, ExtractorFunc(extractTar))
+	RegisterExtractor(FormatTarGz, ExtractorFunc(extractTarGz))
+	RegisterExtractor(FormatTarZst, ExtractorFunc(extractTarZst))
+	RegisterExtractor(FormatTarXz, ExtractorFunc(extractTarXz))
+}
+
+// HeaderSize is the number of leading bytes DetectFormat needs to recognize every format
+const HeaderSize = 512
+
+var magics = []struct {
+	format Format
+	offset int
+	magic  []byte
+}{
+	{FormatZip, 0, []byte("PK\x03\x04")},
+	{FormatZip, 0, []byte("PK\x05\x06")},
+	{FormatTarGz, 0, []byte("\x1f\x8b")},
+	{FormatTarZst, 0, []byte("\x28\xb5\x2f\xfd")},
+	{FormatTarXz, 0, []byte("\xfd7zXZ\x00")},
+	{FormatBundle, 0, []byte("# v2 git bundle\n")},
+	{FormatBundle, 0, []byte("# v3 git bundle\n")},
+	{FormatTar, 257, []byte("ustar")},
+}
+
+var contentTypes = map[string]Format{
+	"application/zip":              FormatZip,
+	"application/x-zip-compressed": FormatZip,
+	"application/x-tar":            FormatTar,
+	"application/gzip":             FormatTarGz,
+	"application/x-gzip":           FormatTarGz,
+	"application/x-gtar":           FormatTarGz,
+	"application/zstd":             FormatTarZst,
+	"application/x-zstd":           FormatTarZst,
+	"application/x-xz":             FormatTarXz,
+	"application/x-git-bundle":     FormatBundle,
+}
+
+// DetectFormat returns the format of an archive from its leading bytes, falling back
+// on the content type announced for it when the bytes are not recognized
+func DetectFormat(header []byte, contentType string) (Format, error) {
+	for _, m := range magics {
+		if len(header) >= m.offset+len(m.magic) && bytes.Equal(header[m.offset:m.offset+len(m.magic)], m.magic) {
+			return m.format, nil
+		}
+	}
+
+	ct := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	if f, ok := contentTypes[strings.ToLower(ct)]; ok {
+		return f, nil
+	}
+	return "", &ArchiveError{Err: ErrUnsupportedFormat}
+}
+
+// DetectFileFormat returns the format of the archive at the given path
+func DetectFileFormat(archive string) (Format, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return "", xerrors.Errorf("Unable to open archive: %w", err)
+	}
+	defer f.Close()
+
+	header := make([]byte, HeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", xerrors.Errorf("Unable to read archive: %w", err)
+	}
+	return DetectFormat(header[:n], "")
+}
@@ -0,0 +1,118 @@
+package files
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestDetectFormat(t *testing.T) {
+	ustar := make([]byte, 512)
+	copy(ustar[257:], "ustar")
+
+	for _, c := range []struct {
+		header      []byte
+		contentType string
+		format      Format
+	}{
+		{[]byte("PK\x03\x04rest"), "", FormatZip},
+		{[]byte("\x1f\x8b\x08"), "application/octet-stream", FormatTarGz},
+		{[]byte("\x28\xb5\x2f\xfd"), "", FormatTarZst},
+		{[]byte("\xfd7zXZ\x00"), "", FormatTarXz},
+		{[]byte("# v2 git bundle\n"), "", FormatBundle},
+		{ustar, "", FormatTar},
+		{[]byte("????"), "application/zip; charset=binary", FormatZip},
+	} {
+		f, err := DetectFormat(c.header, c.contentType)
+		assert.NoError(t, err)
+		assert.Equal(t, c.format, f)
+	}
+
+	_, err := DetectFormat([]byte("????"), "text/html")
+	assert.True(t, xerrors.Is(err, ErrUnsupportedFormat))
+}
+
+func writeTarGz(t *testing.T, dir string, write func(tw *tar.Writer)) string {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	write(tw)
+	tw.Close()
+	gw.Close()
+
+	archive := filepath.Join(dir, "test.zip")
+	if err := ioutil.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestUnzipExtractsTarGz(t *testing.T) {
+	l, dir, cleanup := setupLocal(t)
+	defer cleanup()
+
+	archive := writeTarGz(t, dir, func(tw *tar.Writer) {
+		tw.WriteHeader(&tar.Header{Name: "src/", Typeflag: tar.TypeDir, Mode: 0755})
+		tw.WriteHeader(&tar.Header{Name: "src/main.go", Typeflag: tar.TypeReg, Mode: 0644, Size: 12})
+		tw.Write([]byte("package main"))
+		tw.WriteHeader(&tar.Header{Name: "main.go", Typeflag: tar.TypeLink, Linkname: "src/main.go"})
+	})
+
+	err := l.Unzip(archive, filepath.Join(dir, "unzip"), "project")
+	assert.NoError(t, err)
+
+	d, err := ioutil.ReadFile(filepath.Join(dir, "unzip", "project", "main.go"))
+	assert.NoError(t, err)
+	assert.Equal(t, "package main", string(d))
+
+	// a rejected archive leaves the previous extraction in place
+	archive = writeTarGz(t, dir, func(tw *tar.Writer) {
+		tw.WriteHeader(&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "../../etc"})
+	})
+	err = l.Unzip(archive, filepath.Join(dir, "unzip"), "project")
+	assert.True(t, xerrors.Is(err, ErrUnsafePath))
+
+	_, err = os.Stat(filepath.Join(dir, "unzip", "project", "main.go"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "unzip", ".project.partial"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUnzipClonesBundles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	l, dir, cleanup := setupLocal(t)
+	defer cleanup()
+
+	repo := filepath.Join(dir, "repo")
+	os.MkdirAll(repo, 0755)
+	archive := filepath.Join(dir, "test.zip")
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"-c", "user.email=test@rm.com", "-c", "user.name=rm", "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"tag", "v1"},
+		{"bundle", "create", "-q", archive, "--all"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal(string(out))
+		}
+	}
+
+	err := l.Unzip(archive, filepath.Join(dir, "unzip"), "project")
+	assert.NoError(t, err)
+
+	cmd := exec.Command("git", "rev-parse", "--verify", "v1^{commit}")
+	cmd.Dir = filepath.Join(dir, "unzip", "project")
+	assert.NoError(t, cmd.Run())
+}
@@ -0,0 +1,161 @@
+package files
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrCommitNotFound is returned when a revision does not resolve to a commit of the repository
+var ErrCommitNotFound = errors.New("Commit not found")
+
+// GitBackend defines the git operations performed on the repositories extracted by the storage.
+// repo is the directory of the working tree of a repository.
+type GitBackend interface {
+	// ResolveCommit returns the full hash of the commit the revision points to. The
+	// revision may be a full or abbreviated hash, a branch or a tag.
+	ResolveCommit(ctx context.Context, repo, rev string) (string, error)
+	// ListRefs returns the branches and tags pointing to commits, sorted by their full name
+	ListRefs(ctx context.Context, repo string) ([]Ref, error)
+	// Bundle writes a bundle of the commit and its history to file with HEAD pointing to
+	// the commit. It reads the object database only, the working tree is left untouched.
+	// The history reachable from haves is left out, those commits become prerequisites
+	// of the bundle. haves must be full hashes of commits of the repository.
+	Bundle(ctx context.Context, repo, file, commit string, haves []string) error
+	// Unbundle creates a repository with the refs and objects of a bundle
+	Unbundle(ctx context.Context, bundle, repo string) error
+	// Fetch copies the branches and tags of the repository src, and the objects they
+	// reach, into repo. Objects already in repo are kept, so commits the refs of src moved
+	// away from stay available. A detached HEAD of repo follows the HEAD of src.
+	Fetch(ctx context.Context, repo, src string) error
+	// Archive writes the files of the commit to file, without history, in one of the
+	// formats accepted by ValidArchiveFormat. Like Bundle it reads the object database only.
+	Archive(ctx context.Context, repo, file, commit string, format Format) error
+	// Tree lists the directory at path in the tree of the commit, the root for an empty path
+	Tree(ctx context.Context, repo, commit, path string) ([]TreeEntry, error)
+	// Blob returns the contents of the file at path in the tree of the commit and its size.
+	// The caller must close the reader.
+	Blob(ctx context.Context, repo, commit, path string) (io.ReadCloser, int64, error)
+	// Log returns the commits of the history selected by opts, most recent first
+	Log(ctx context.Context, repo string, opts LogOptions) ([]Commit, error)
+	// Commit returns the metadata of the commit the revision points to
+	Commit(ctx context.Context, repo, rev string) (*Commit, error)
+	// MergeBase returns the best common ancestor of two commits or ErrNoMergeBase
+	MergeBase(ctx context.Context, repo, a, b string) (string, error)
+	// Diff returns the files changed from one commit to the other, detecting renames
+	Diff(ctx context.Context, repo, from, to string) ([]FileChange, error)
+	// Patch writes the unified diff from one commit to the other to w
+	Patch(ctx context.Context, repo, from, to string, w io.Writer) error
+}
+
+// Types of the refs of a repository
+const (
+	RefBranch       = "branch"
+	RefRemoteBranch = "remote"
+	RefTag          = "tag"
+)
+
+// Ref is a branch or a tag of a repository with the commit it points to
+type Ref struct {
+	Name   string `json:"name"`
+	Ref    string `json:"ref"`
+	Type   string `json:"type"`
+	Commit string `json:"commit"`
+}
+
+// newRef returns the Ref for a full ref name or false if it is not a branch or a tag
+func newRef(name, commit string) (Ref, bool) {
+	for _, t := range []struct {
+		prefix string
+		typ    string
+	}{
+		{"refs/heads/", RefBranch},
+		{"refs/remotes/", RefRemoteBranch},
+		{"refs/tags/", RefTag},
+	} {
+		if strings.HasPrefix(name, t.prefix) {
+			short := strings.TrimPrefix(name, t.prefix)
+			if t.typ == RefRemoteBranch && strings.HasSuffix(short, "/HEAD") {
+				return Ref{}, false
+			}
+			return Ref{Name: short, Ref: name, Type: t.typ, Commit: commit}, true
+		}
+	}
+	return Ref{}, false
+}
+
+// validRev rejects revisions which the git command line would parse as options
+func validRev(rev string) error {
+	if rev == "" || strings.HasPrefix(rev, "-") {
+		return xerrors.Errorf("%q: %w", rev, ErrCommitNotFound)
+	}
+	return nil
+}
+
+const (
+	bundleSignatureV2 = "# v2 git bundle"
+	bundleSignatureV3 = "# v3 git bundle"
+)
+
+// bundleRef is a ref listed in the header of a bundle
+type bundleRef struct {
+	name string
+	hash string
+}
+
+// writeBundleHeader writes the header of a v2 bundle, the packfile follows it
+func writeBundleHeader(w io.Writer, prerequisites []string, refs []bundleRef) error {
+	var b strings.Builder
+	b.WriteString(bundleSignatureV2 + "\n")
+	for _, p := range prerequisites {
+		b.WriteString("-" + p + "\n")
+	}
+	for _, r := range refs {
+		b.WriteString(r.hash + " " + r.name + "\n")
+	}
+	b.WriteString("\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// readBundleHeader reads the header of a bundle and leaves r at the start of the packfile
+func readBundleHeader(r *bufio.Reader) (prerequisites []string, refs []bundleRef, err error) {
+	sig, err := r.ReadString('\n')
+	if err != nil {
+		return nil, nil, &ArchiveError{Err: ErrInvalidArchive}
+	}
+	sig = strings.TrimSuffix(sig, "\n")
+	if sig != bundleSignatureV2 && sig != bundleSignatureV3 {
+		return nil, nil, &ArchiveError{Err: ErrInvalidArchive}
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, nil, &ArchiveError{Err: ErrInvalidArchive}
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return prerequisites, refs, nil
+		case strings.HasPrefix(line, "@"):
+			// v3 capabilities, only the default sha1 object format is supported
+			if line != "@object-format=sha1" && !strings.HasPrefix(line, "@filter=") {
+				return nil, nil, &ArchiveError{Err: ErrUnsupportedFormat}
+			}
+		case strings.HasPrefix(line, "-"):
+			prerequisites = append(prerequisites, strings.SplitN(line[1:], " ", 2)[0])
+		default:
+			parts := strings.SplitN(line, " ", 2)
+			if len(parts) != 2 {
+				return nil, nil, &ArchiveError{Err: ErrInvalidArchive}
+			}
+			refs = append(refs, bundleRef{name: parts[1], hash: parts[0]})
+		}
+	}
+}
@@ -0,0 +1,586 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// GitError is returned when a git command fails, it carries what git wrote to stderr
+type GitError struct {
+	Args   []string
+	Stderr string
+	Err    error
+}
+
+func (e *GitError) Error() string {
+	return fmt.Sprintf("git %s: %s: %s", strings.Join(e.Args, " "), e.Err.Error(), e.Stderr)
+}
+
+// Unwrap returns the error of the command
+func (e *GitError) Unwrap() error {
+	return e.Err
+}
+
+// CLIGit is a GitBackend which runs the git command line tool
+type CLIGit struct{}
+
+// NewCLIGit creates a GitBackend running the git binary found in PATH
+func NewCLIGit() *CLIGit {
+	return &CLIGit{}
+}
+
+// ResolveCommit returns the full hash of the commit the revision points to
+func (g *CLIGit) ResolveCommit(ctx context.Context, repo, rev string) (string, error) {
+	if err := validRev(rev); err != nil {
+		return "", err
+	}
+
+	out, err := g.output(ctx, repo, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		var ee *exec.ExitError
+		if xerrors.As(err, &ee) {
+			return "", xerrors.Errorf("%q: %w", rev, ErrCommitNotFound)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ListRefs returns the branches and tags pointing to commits, sorted by their full name
+func (g *CLIGit) ListRefs(ctx context.Context, repo string) ([]Ref, error) {
+	out, err := g.output(ctx, repo, "for-each-ref", "--sort=refname",
+		"--format=%(refname)%00%(objecttype)%00%(objectname)%00%(*objecttype)%00%(*objectname)",
+		"refs/heads", "refs/remotes", "refs/tags")
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []Ref{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		f := strings.Split(line, "\x00")
+		if len(f) != 5 {
+			continue
+		}
+
+		// annotated tags are peeled to the object they point to
+		typ, hash := f[1], f[2]
+		if f[3] != "" {
+			typ, hash = f[3], f[4]
+		}
+		if typ != "commit" {
+			continue
+		}
+		if ref, ok := newRef(f[0], hash); ok {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// Bundle writes a bundle of the commit and the history not reachable from haves to file.
+// git bundle create only accepts refs, so the bundle is assembled from its header and the
+// packfile of the commit, which is what git bundle create does as well.
+func (g *CLIGit) Bundle(ctx context.Context, repo, file, commit string, haves []string) (err error) {
+	hash, err := g.ResolveCommit(ctx, repo, commit)
+	if err != nil {
+		return err
+	}
+
+	revs := hash + "\n"
+	for _, h := range haves {
+		if err := validRev(h); err != nil {
+			return err
+		}
+		revs += "^" + h + "\n"
+	}
+
+	// the commits left out which are parents of the commits in the bundle
+	var prerequisites []string
+	if len(haves) > 0 {
+		out := &bytes.Buffer{}
+		if err := g.exec(ctx, repo, strings.NewReader(revs), out, "rev-list", "--boundary", "--stdin"); err != nil {
+			return err
+		}
+		for _, line := range strings.Split(out.String(), "\n") {
+			if strings.HasPrefix(line, "-") {
+				prerequisites = append(prerequisites, line[1:])
+			}
+		}
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return xerrors.Errorf("Unable to create bundle: %w", err)
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(file)
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	if err := writeBundleHeader(w, prerequisites, []bundleRef{{name: "HEAD", hash: hash}}); err != nil {
+		return xerrors.Errorf("Unable to write bundle: %w", err)
+	}
+
+	if err := g.exec(ctx, repo, strings.NewReader(revs), w, "pack-objects", "--revs", "--stdout", "--thin", "--delta-base-offset", "-q"); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return xerrors.Errorf("Unable to write bundle: %w", err)
+	}
+	return f.Close()
+}
+
+// Unbundle clones the bundle bare so that every branch and tag of the bundle is
+// kept as a local ref, then turns it into a regular repository with an empty working tree
+func (g *CLIGit) Unbundle(ctx context.Context, bundle, repo string) error {
+	gitDir := filepath.Join(repo, ".git")
+	if err := g.run(ctx, "", "clone", "--quiet", "--bare", bundle, gitDir); err != nil {
+		return err
+	}
+	return g.run(ctx, gitDir, "config", "core.bare", "false")
+}
+
+// Fetch fetches the branches and tags of src into repo, HEAD is updated when detached
+func (g *CLIGit) Fetch(ctx context.Context, repo, src string) error {
+	if err := g.run(ctx, repo, "fetch", "--quiet", "--no-tags", "--update-head-ok", "--",
+		src, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"); err != nil {
+		return err
+	}
+
+	// a symbolic HEAD follows its branch
+	if err := g.run(ctx, repo, "symbolic-ref", "--quiet", "HEAD"); err == nil {
+		return nil
+	}
+	head, err := g.output(ctx, src, "rev-parse", "--verify", "--quiet", "HEAD^{commit}")
+	if err != nil {
+		// src has no HEAD
+		return nil
+	}
+	return g.run(ctx, repo, "update-ref", "--no-deref", "HEAD", strings.TrimSpace(string(head)))
+}
+
+// Archive writes the files of the commit to file with git archive, tar archives are
+// compressed here so that no gzip binary is needed
+func (g *CLIGit) Archive(ctx context.Context, repo, file, commit string, format Format) (err error) {
+	if err := ValidArchiveFormat(format); err != nil {
+		return err
+	}
+	hash, err := g.ResolveCommit(ctx, repo, commit)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return xerrors.Errorf("Unable to create archive: %w", err)
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(file)
+		}
+	}()
+
+	if format == FormatZip {
+		if err := g.exec(ctx, repo, nil, f, "archive", "--format=zip", hash); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	gz := gzip.NewWriter(f)
+	if err := g.exec(ctx, repo, nil, gz, "archive", "--format=tar", hash); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return xerrors.Errorf("Unable to write archive: %w", err)
+	}
+	return f.Close()
+}
+
+// Tree lists the directory at path in the tree of the commit with git ls-tree
+func (g *CLIGit) Tree(ctx context.Context, repo, commit, path string) ([]TreeEntry, error) {
+	obj, p, err := g.treeObject(ctx, repo, commit, path)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := g.objectType(ctx, repo, obj, p)
+	if err != nil {
+		return nil, err
+	}
+	if typ != EntryTree {
+		return nil, xerrors.Errorf("%q: %w", p, ErrNotADirectory)
+	}
+
+	out, err := g.output(ctx, repo, "ls-tree", "-z", "-l", obj)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []TreeEntry{}
+	for _, line := range strings.Split(string(out), "\x00") {
+		// <mode> SP <type> SP <object> SP+ <size> TAB <name>
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		f := strings.Fields(parts[0])
+		if len(f) != 4 {
+			continue
+		}
+		size, _ := strconv.ParseInt(f[3], 10, 64)
+		entries = append(entries, TreeEntry{
+			Name: parts[1],
+			Path: strings.TrimPrefix(p+"/"+parts[1], "/"),
+			Type: f[1],
+			Mode: f[0],
+			Size: size,
+			SHA:  f[2],
+		})
+	}
+	return entries, nil
+}
+
+// Blob streams the contents of the file at path in the tree of the commit with git cat-file
+func (g *CLIGit) Blob(ctx context.Context, repo, commit, path string) (io.ReadCloser, int64, error) {
+	obj, p, err := g.treeObject(ctx, repo, commit, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	typ, err := g.objectType(ctx, repo, obj, p)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ != EntryBlob {
+		return nil, 0, xerrors.Errorf("%q: %w", p, ErrNotAFile)
+	}
+
+	out, err := g.output(ctx, repo, "cat-file", "-s", obj)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("Unable to read size of %q: %w", p, err)
+	}
+
+	rc, err := g.stream(ctx, repo, "cat-file", "blob", obj)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, size, nil
+}
+
+// logFormat prints the fields of a Commit separated by NUL, -z ends every commit with NUL
+const logFormat = "--format=%H%x00%P%x00%an%x00%ae%x00%aI%x00%cn%x00%ce%x00%cI%x00%B%x00"
+
+// logFields is the number of NUL separated fields printed per commit with -z
+const logFields = 10
+
+// Log returns the commits of the history selected by opts with git log
+func (g *CLIGit) Log(ctx context.Context, repo string, opts LogOptions) ([]Commit, error) {
+	rev := opts.Rev
+	if rev == "" {
+		rev = "HEAD"
+	}
+	hash, err := g.ResolveCommit(ctx, repo, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"log", "-z", logFormat}
+	if !opts.Since.IsZero() {
+		args = append(args, "--since="+strconv.FormatInt(opts.Since.Unix(), 10))
+	}
+	if !opts.Until.IsZero() {
+		args = append(args, "--until="+strconv.FormatInt(opts.Until.Unix(), 10))
+	}
+	if opts.Skip > 0 {
+		args = append(args, "--skip="+strconv.Itoa(opts.Skip))
+	}
+	if opts.Limit > 0 {
+		args = append(args, "--max-count="+strconv.Itoa(opts.Limit))
+	}
+	args = append(args, hash, "--")
+	if opts.Path != "" {
+		p, err := cleanTreePath(opts.Path)
+		if err != nil {
+			return nil, err
+		}
+		if p != "" {
+			args = append(args, p)
+		}
+	}
+
+	out, err := g.output(ctx, repo, args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseLog(out)
+}
+
+// Commit returns the metadata of the commit the revision points to with git log
+func (g *CLIGit) Commit(ctx context.Context, repo, rev string) (*Commit, error) {
+	commits, err := g.Log(ctx, repo, LogOptions{Rev: rev, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(commits) == 0 {
+		return nil, xerrors.Errorf("%q: %w", rev, ErrCommitNotFound)
+	}
+	return &commits[0], nil
+}
+
+// parseLog reads the commits printed by git log -z with logFormat
+func parseLog(out []byte) ([]Commit, error) {
+	fields := strings.Split(string(out), "\x00")
+	commits := []Commit{}
+	for len(fields) >= logFields {
+		f := fields[:logFields]
+		fields = fields[logFields:]
+
+		author, err := parseSignature(f[2], f[3], f[4])
+		if err != nil {
+			return nil, err
+		}
+		committer, err := parseSignature(f[5], f[6], f[7])
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, Commit{
+			SHA:       f[0],
+			Parents:   append([]string{}, strings.Fields(f[1])...),
+			Author:    author,
+			Committer: committer,
+			Message:   f[8],
+		})
+	}
+	return commits, nil
+}
+
+func parseSignature(name, email, date string) (Signature, error) {
+	d, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return Signature{}, xerrors.Errorf("Unable to parse date %q: %w", date, err)
+	}
+	return Signature{Name: name, Email: email, Date: d}, nil
+}
+
+// MergeBase returns the best common ancestor of two commits with git merge-base
+func (g *CLIGit) MergeBase(ctx context.Context, repo, a, b string) (string, error) {
+	ha, err := g.ResolveCommit(ctx, repo, a)
+	if err != nil {
+		return "", err
+	}
+	hb, err := g.ResolveCommit(ctx, repo, b)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := g.output(ctx, repo, "merge-base", ha, hb)
+	if err != nil {
+		var ee *exec.ExitError
+		if xerrors.As(err, &ee) && ee.ExitCode() == 1 {
+			return "", ErrNoMergeBase
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Diff returns the files changed from one commit to the other with git diff
+func (g *CLIGit) Diff(ctx context.Context, repo, from, to string) ([]FileChange, error) {
+	hf, ht, err := g.diffCommits(ctx, repo, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := g.output(ctx, repo, "diff", "--no-ext-diff", "--no-textconv", "-M"+strconv.Itoa(renameScore)+"%", "--name-status", "-z", hf, ht, "--")
+	if err != nil {
+		return nil, err
+	}
+	changes, err := parseNameStatus(out)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err = g.output(ctx, repo, "diff", "--no-ext-diff", "--no-textconv", "-M"+strconv.Itoa(renameScore)+"%", "--numstat", "-z", hf, ht, "--")
+	if err != nil {
+		return nil, err
+	}
+	applyNumstat(changes, out)
+	sortChanges(changes)
+	return changes, nil
+}
+
+// Patch writes the unified diff from one commit to the other with git diff
+func (g *CLIGit) Patch(ctx context.Context, repo, from, to string, w io.Writer) error {
+	hf, ht, err := g.diffCommits(ctx, repo, from, to)
+	if err != nil {
+		return err
+	}
+	return g.exec(ctx, repo, nil, w, "diff", "--no-ext-diff", "--no-textconv", "--no-color", "-M"+strconv.Itoa(renameScore)+"%", hf, ht, "--")
+}
+
+func (g *CLIGit) diffCommits(ctx context.Context, repo, from, to string) (string, string, error) {
+	hf, err := g.ResolveCommit(ctx, repo, from)
+	if err != nil {
+		return "", "", err
+	}
+	ht, err := g.ResolveCommit(ctx, repo, to)
+	if err != nil {
+		return "", "", err
+	}
+	return hf, ht, nil
+}
+
+// treeObject returns the <commit>:<path> name of the object at path and the cleaned path
+func (g *CLIGit) treeObject(ctx context.Context, repo, commit, path string) (string, string, error) {
+	hash, err := g.ResolveCommit(ctx, repo, commit)
+	if err != nil {
+		return "", "", err
+	}
+	p, err := cleanTreePath(path)
+	if err != nil {
+		return "", "", err
+	}
+	return hash + ":" + p, p, nil
+}
+
+func (g *CLIGit) objectType(ctx context.Context, repo, obj, path string) (string, error) {
+	out, err := g.output(ctx, repo, "cat-file", "-t", obj)
+	if err != nil {
+		var ee *exec.ExitError
+		if xerrors.As(err, &ee) {
+			return "", xerrors.Errorf("%q: %w", path, ErrPathNotFound)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (g *CLIGit) run(ctx context.Context, dir string, args ...string) error {
+	_, err := g.output(ctx, dir, args...)
+	return err
+}
+
+// output runs git in dir and returns what it wrote to stdout
+func (g *CLIGit) output(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	stdout := &bytes.Buffer{}
+	if err := g.exec(ctx, dir, nil, stdout, args...); err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// stream runs git in dir and returns its stdout as it is written. The command is
+// waited for once the output is read or the reader is closed.
+func (g *CLIGit) stream(ctx context.Context, dir string, args ...string) (io.ReadCloser, error) {
+	stderr := &bytes.Buffer{}
+
+	cmd := gitCommand(ctx, dir, args...)
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to run git: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, &GitError{Args: args, Err: err}
+	}
+	return &cmdReader{ctx: ctx, cmd: cmd, stdout: stdout, stderr: stderr, args: args}, nil
+}
+
+// cmdReader reads the output of a running git command
+type cmdReader struct {
+	ctx    context.Context
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr *bytes.Buffer
+	args   []string
+	done   bool
+}
+
+func (c *cmdReader) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		if werr := c.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (c *cmdReader) Close() error {
+	c.stdout.Close()
+	c.wait()
+	return nil
+}
+
+func (c *cmdReader) wait() error {
+	if c.done {
+		return nil
+	}
+	c.done = true
+	if err := c.cmd.Wait(); err != nil {
+		if c.ctx.Err() != nil {
+			err = c.ctx.Err()
+		}
+		return &GitError{Args: c.args, Stderr: strings.TrimSpace(c.stderr.String()), Err: err}
+	}
+	return nil
+}
+
+// repoConfig overrides the settings of the repositories from rk which would have git run
+// commands of theirs, reach other repositories or change the output rm parses. Git passes
+// them on to the commands it runs in other repositories, such as the source of a fetch.
+var repoConfig = []string{
+	"-c", "core.hooksPath=/dev/null",
+	"-c", "core.fsmonitor=false",
+	"-c", "protocol.allow=never",
+	"-c", "protocol.file.allow=always",
+	"-c", "diff.noprefix=false",
+	"-c", "diff.mnemonicPrefix=false",
+	"-c", "diff.relative=false",
+	"-c", "log.showSignature=false",
+	"-c", "color.ui=false",
+}
+
+// gitCommand returns the command running git with args in dir, with repoConfig
+func gitCommand(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", append(append([]string{}, repoConfig...), args...)...)
+	cmd.Dir = dir
+	return cmd
+}
+
+// exec runs git in dir with the given stdin and stdout, stderr is kept for the error
+func (g *CLIGit) exec(ctx context.Context, dir string, stdin io.Reader, stdout io.Writer, args ...string) error {
+	stderr := &bytes.Buffer{}
+
+	cmd := gitCommand(ctx, dir, args...)
+	cmd.Dir = dir
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return &GitError{Args: args, Stderr: strings.TrimSpace(stderr.String()), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,713 @@
+package files
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"golang.org/x/xerrors"
+)
+
+// packWindow is the number of objects considered as delta bases when encoding a packfile
+const packWindow = 10
+
+// GoGit is a GitBackend implemented in pure Go, it does not need a git binary
+type GoGit struct{}
+
+// NewGoGit creates a GitBackend based on go-git
+func NewGoGit() *GoGit {
+	return &GoGit{}
+}
+
+// ResolveCommit returns the full hash of the commit the revision points to
+func (g *GoGit) ResolveCommit(ctx context.Context, repo, rev string) (string, error) {
+	r, err := g.open(repo)
+	if err != nil {
+		return "", err
+	}
+	c, err := resolveCommit(r, rev)
+	if err != nil {
+		return "", err
+	}
+	return c.Hash.String(), nil
+}
+
+// ListRefs returns the branches and tags pointing to commits, sorted by their full name
+func (g *GoGit) ListRefs(ctx context.Context, repo string) ([]Ref, error) {
+	r, err := g.open(repo)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := r.References()
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to list references: %w", err)
+	}
+
+	refs := []Ref{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		c, err := peelCommit(r, ref.Hash())
+		if err != nil {
+			// refs to trees or blobs
+			return nil
+		}
+		if rf, ok := newRef(ref.Name().String(), c.Hash.String()); ok {
+			refs = append(refs, rf)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to list references: %w", err)
+	}
+
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Ref < refs[j].Ref })
+	return refs, nil
+}
+
+// Bundle writes a bundle of the commit and the history not reachable from haves to file
+func (g *GoGit) Bundle(ctx context.Context, repo, file, commit string, haves []string) error {
+	r, err := g.open(repo)
+	if err != nil {
+		return err
+	}
+	c, err := resolveCommit(r, commit)
+	if err != nil {
+		return err
+	}
+
+	var hs []plumbing.Hash
+	for _, h := range haves {
+		hs = append(hs, plumbing.NewHash(h))
+	}
+	return writeBundle(ctx, r, file, c.Hash, hs)
+}
+
+// Unbundle creates a repository with the refs and objects of a bundle
+func (g *GoGit) Unbundle(ctx context.Context, bundle, repo string) error {
+	f, err := os.Open(bundle)
+	if err != nil {
+		return xerrors.Errorf("Unable to open bundle: %w", err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	prerequisites, refs, err := readBundleHeader(br)
+	if err != nil {
+		return err
+	}
+	// a thin bundle can only be applied to a repository which has its prerequisites
+	if len(prerequisites) > 0 {
+		return &ArchiveError{Err: ErrInvalidArchive}
+	}
+
+	r, err := git.PlainInit(repo, false)
+	if err != nil {
+		return xerrors.Errorf("Unable to create repository: %w", err)
+	}
+	if err := packfile.UpdateObjectStorage(r.Storer, &ctxReader{ctx: ctx, r: br}); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &ArchiveError{Err: ErrInvalidArchive}
+	}
+
+	for _, ref := range refs {
+		name := plumbing.ReferenceName(ref.name)
+		if err := r.Storer.SetReference(plumbing.NewHashReference(name, plumbing.NewHash(ref.hash))); err != nil {
+			return xerrors.Errorf("Unable to set reference %s: %w", ref.name, err)
+		}
+	}
+	return nil
+}
+
+// Archive writes the files of the commit to file, submodules are left out like git archive does
+func (g *GoGit) Archive(ctx context.Context, repo, file, commit string, format Format) (err error) {
+	if err := ValidArchiveFormat(format); err != nil {
+		return err
+	}
+	r, err := g.open(repo)
+	if err != nil {
+		return err
+	}
+	c, err := resolveCommit(r, commit)
+	if err != nil {
+		return err
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return xerrors.Errorf("Unable to read tree: %w", err)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return xerrors.Errorf("Unable to create archive: %w", err)
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(file)
+		}
+	}()
+
+	w := bufio.NewWriter(&ctxWriter{ctx: ctx, w: f})
+	aw, err := newArchiveWriter(w, format, c.Committer.When)
+	if err != nil {
+		return err
+	}
+	err = tree.Files().ForEach(func(tf *object.File) error {
+		mode, err := tf.Mode.ToOSFileMode()
+		if err != nil {
+			return err
+		}
+		contents, err := tf.Reader()
+		if err != nil {
+			return err
+		}
+		defer contents.Close()
+		return aw.add(tf.Name, mode, tf.Size, contents)
+	})
+	if err != nil {
+		return xerrors.Errorf("Unable to write archive: %w", err)
+	}
+	if err := aw.Close(); err != nil {
+		return xerrors.Errorf("Unable to write archive: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return xerrors.Errorf("Unable to write archive: %w", err)
+	}
+	return f.Close()
+}
+
+// Tree lists the directory at path in the tree of the commit
+func (g *GoGit) Tree(ctx context.Context, repo, commit, path string) ([]TreeEntry, error) {
+	r, tree, p, err := g.tree(repo, commit, path)
+	if err != nil {
+		return nil, err
+	}
+	if p != "" {
+		e, err := tree.FindEntry(p)
+		if err != nil {
+			return nil, xerrors.Errorf("%q: %w", p, ErrPathNotFound)
+		}
+		if e.Mode != filemode.Dir {
+			return nil, xerrors.Errorf("%q: %w", p, ErrNotADirectory)
+		}
+		if tree, err = r.TreeObject(e.Hash); err != nil {
+			return nil, xerrors.Errorf("Unable to read tree %q: %w", p, err)
+		}
+	}
+
+	entries := []TreeEntry{}
+	for _, e := range tree.Entries {
+		te := TreeEntry{
+			Name: e.Name,
+			Path: strings.TrimPrefix(p+"/"+e.Name, "/"),
+			Type: EntryBlob,
+			Mode: fmt.Sprintf("%06o", uint32(e.Mode)),
+			SHA:  e.Hash.String(),
+		}
+		switch e.Mode {
+		case filemode.Dir:
+			te.Type = EntryTree
+		case filemode.Submodule:
+			te.Type = EntryCommit
+		default:
+			b, err := r.BlobObject(e.Hash)
+			if err != nil {
+				return nil, xerrors.Errorf("Unable to read blob %q: %w", te.Path, err)
+			}
+			te.Size = b.Size
+		}
+		entries = append(entries, te)
+	}
+	return entries, nil
+}
+
+// Blob returns the contents of the file at path in the tree of the commit
+func (g *GoGit) Blob(ctx context.Context, repo, commit, path string) (io.ReadCloser, int64, error) {
+	r, tree, p, err := g.tree(repo, commit, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if p == "" {
+		return nil, 0, xerrors.Errorf("%q: %w", p, ErrNotAFile)
+	}
+	e, err := tree.FindEntry(p)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("%q: %w", p, ErrPathNotFound)
+	}
+	if !e.Mode.IsFile() {
+		return nil, 0, xerrors.Errorf("%q: %w", p, ErrNotAFile)
+	}
+
+	b, err := r.BlobObject(e.Hash)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("Unable to read blob %q: %w", p, err)
+	}
+	rc, err := b.Reader()
+	if err != nil {
+		return nil, 0, xerrors.Errorf("Unable to read blob %q: %w", p, err)
+	}
+	return rc, b.Size, nil
+}
+
+// Log returns the commits of the history selected by opts, ordered by committer time
+// like git log does by default
+func (g *GoGit) Log(ctx context.Context, repo string, opts LogOptions) ([]Commit, error) {
+	r, err := g.open(repo)
+	if err != nil {
+		return nil, err
+	}
+	rev := opts.Rev
+	if rev == "" {
+		rev = "HEAD"
+	}
+	c, err := resolveCommit(r, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	lo := &git.LogOptions{From: c.Hash, Order: git.LogOrderCommitterTime}
+	if opts.Path != "" {
+		p, err := cleanTreePath(opts.Path)
+		if err != nil {
+			return nil, err
+		}
+		if p != "" {
+			lo.PathFilter = func(f string) bool {
+				return f == p || strings.HasPrefix(f, p+"/")
+			}
+		}
+	}
+	iter, err := r.Log(lo)
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to read log: %w", err)
+	}
+	defer iter.Close()
+
+	commits := []Commit{}
+	skip := opts.Skip
+	err = iter.ForEach(func(c *object.Commit) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		when := c.Committer.When
+		if !opts.Since.IsZero() && when.Before(opts.Since) {
+			return nil
+		}
+		if !opts.Until.IsZero() && when.After(opts.Until) {
+			return nil
+		}
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		commits = append(commits, newCommit(c))
+		if opts.Limit > 0 && len(commits) == opts.Limit {
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to read log: %w", err)
+	}
+	return commits, nil
+}
+
+// Commit returns the metadata of the commit the revision points to
+func (g *GoGit) Commit(ctx context.Context, repo, rev string) (*Commit, error) {
+	r, err := g.open(repo)
+	if err != nil {
+		return nil, err
+	}
+	c, err := resolveCommit(r, rev)
+	if err != nil {
+		return nil, err
+	}
+	commit := newCommit(c)
+	return &commit, nil
+}
+
+// MergeBase returns the best common ancestor of two commits
+func (g *GoGit) MergeBase(ctx context.Context, repo, a, b string) (string, error) {
+	r, err := g.open(repo)
+	if err != nil {
+		return "", err
+	}
+	ca, err := resolveCommit(r, a)
+	if err != nil {
+		return "", err
+	}
+	cb, err := resolveCommit(r, b)
+	if err != nil {
+		return "", err
+	}
+
+	bases, err := ca.MergeBase(cb)
+	if err != nil {
+		return "", xerrors.Errorf("Unable to find merge base: %w", err)
+	}
+	if len(bases) == 0 {
+		return "", ErrNoMergeBase
+	}
+	return bases[0].Hash.String(), nil
+}
+
+// Diff returns the files changed from one commit to the other
+func (g *GoGit) Diff(ctx context.Context, repo, from, to string) ([]FileChange, error) {
+	patch, err := g.patch(ctx, repo, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []FileChange{}
+	for _, fp := range patch.FilePatches() {
+		c := FileChange{Status: StatusModified, Binary: fp.IsBinary()}
+		f, t := fp.Files()
+		switch {
+		case f == nil:
+			c.Status, c.Path = StatusAdded, t.Path()
+		case t == nil:
+			c.Status, c.Path = StatusDeleted, f.Path()
+		case f.Path() != t.Path():
+			c.Status, c.Path, c.OldPath = StatusRenamed, t.Path(), f.Path()
+		default:
+			c.Path = t.Path()
+		}
+
+		for _, chunk := range fp.Chunks() {
+			s := chunk.Content()
+			if s == "" {
+				continue
+			}
+			lines := strings.Count(s, "\n")
+			if !strings.HasSuffix(s, "\n") {
+				lines++
+			}
+			switch chunk.Type() {
+			case diff.Add:
+				c.Additions += lines
+			case diff.Delete:
+				c.Deletions += lines
+			}
+		}
+		changes = append(changes, c)
+	}
+	sortChanges(changes)
+	return changes, nil
+}
+
+// Patch writes the unified diff from one commit to the other to w
+func (g *GoGit) Patch(ctx context.Context, repo, from, to string, w io.Writer) error {
+	patch, err := g.patch(ctx, repo, from, to)
+	if err != nil {
+		return err
+	}
+	if err := patch.Encode(w); err != nil {
+		return xerrors.Errorf("Unable to write patch: %w", err)
+	}
+	return nil
+}
+
+func (g *GoGit) patch(ctx context.Context, repo, from, to string) (*object.Patch, error) {
+	r, err := g.open(repo)
+	if err != nil {
+		return nil, err
+	}
+	cf, err := resolveCommit(r, from)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := resolveCommit(r, to)
+	if err != nil {
+		return nil, err
+	}
+	tf, err := cf.Tree()
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to read tree: %w", err)
+	}
+	tt, err := ct.Tree()
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to read tree: %w", err)
+	}
+
+	changes, err := object.DiffTreeWithOptions(ctx, tf, tt, &object.DiffTreeOptions{
+		DetectRenames: true,
+		RenameScore:   renameScore,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to diff trees: %w", err)
+	}
+	patch, err := changes.PatchContext(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to diff trees: %w", err)
+	}
+	return patch, nil
+}
+
+func newCommit(c *object.Commit) Commit {
+	parents := []string{}
+	for _, p := range c.ParentHashes {
+		parents = append(parents, p.String())
+	}
+	return Commit{
+		SHA:       c.Hash.String(),
+		Parents:   parents,
+		Author:    Signature{Name: c.Author.Name, Email: c.Author.Email, Date: c.Author.When},
+		Committer: Signature{Name: c.Committer.Name, Email: c.Committer.Email, Date: c.Committer.When},
+		Message:   c.Message,
+	}
+}
+
+// tree returns the root tree of the commit and the cleaned path
+func (g *GoGit) tree(repo, commit, path string) (*git.Repository, *object.Tree, string, error) {
+	r, err := g.open(repo)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	c, err := resolveCommit(r, commit)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, nil, "", xerrors.Errorf("Unable to read tree: %w", err)
+	}
+	p, err := cleanTreePath(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return r, tree, p, nil
+}
+
+func (g *GoGit) open(repo string) (*git.Repository, error) {
+	r, err := git.PlainOpen(repo)
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to open repository: %w", err)
+	}
+	return r, nil
+}
+
+// resolveCommit returns the commit the revision points to, peeling annotated tags
+func resolveCommit(r *git.Repository, rev string) (*object.Commit, error) {
+	if err := validRev(rev); err != nil {
+		return nil, err
+	}
+
+	h, err := r.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, xerrors.Errorf("%q: %w", rev, ErrCommitNotFound)
+	}
+	c, err := peelCommit(r, *h)
+	if err != nil {
+		return nil, xerrors.Errorf("%q: %w", rev, ErrCommitNotFound)
+	}
+	return c, nil
+}
+
+// Fetch copies the objects reachable from the branches and tags of src which repo lacks,
+// then the refs themselves. Objects are copied one by one, without negotiation.
+func (g *GoGit) Fetch(ctx context.Context, repo, src string) error {
+	r, err := g.open(repo)
+	if err != nil {
+		return err
+	}
+	s, err := g.open(src)
+	if err != nil {
+		return err
+	}
+
+	var refs []*plumbing.Reference
+	iter, err := s.References()
+	if err != nil {
+		return xerrors.Errorf("Unable to list refs: %w", err)
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && (ref.Name().IsBranch() || ref.Name().IsTag()) {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	head, headErr := s.Head()
+
+	// what repo has already, as far as src knows it, needs no copy
+	var wants, haves []plumbing.Hash
+	for _, ref := range refs {
+		wants = append(wants, ref.Hash())
+	}
+	if headErr == nil {
+		wants = append(wants, head.Hash())
+	}
+	iter, err = r.References()
+	if err != nil {
+		return xerrors.Errorf("Unable to list refs: %w", err)
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && s.Storer.HasEncodedObject(ref.Hash()) == nil {
+			haves = append(haves, ref.Hash())
+		}
+		return nil
+	})
+
+	hashes, err := revlist.Objects(s.Storer, wants, haves)
+	if err != nil {
+		return xerrors.Errorf("Unable to list objects: %w", err)
+	}
+	for _, h := range hashes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if r.Storer.HasEncodedObject(h) == nil {
+			continue
+		}
+		o, err := s.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return xerrors.Errorf("Unable to read object %s: %w", h, err)
+		}
+		if _, err := r.Storer.SetEncodedObject(o); err != nil {
+			return xerrors.Errorf("Unable to write object %s: %w", h, err)
+		}
+	}
+
+	for _, ref := range refs {
+		if err := r.Storer.SetReference(ref); err != nil {
+			return xerrors.Errorf("Unable to set reference %s: %w", ref.Name(), err)
+		}
+	}
+	if current, err := r.Storer.Reference(plumbing.HEAD); err == nil && current.Type() == plumbing.HashReference && headErr == nil {
+		if err := r.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, head.Hash())); err != nil {
+			return xerrors.Errorf("Unable to set reference HEAD: %w", err)
+		}
+	}
+	return nil
+}
+
+// peelCommit returns the commit the object points to, following annotated tags
+func peelCommit(r *git.Repository, h plumbing.Hash) (*object.Commit, error) {
+	for {
+		o, err := r.Object(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, err
+		}
+		switch o := o.(type) {
+		case *object.Commit:
+			return o, nil
+		case *object.Tag:
+			h = o.Target
+		default:
+			return nil, ErrCommitNotFound
+		}
+	}
+}
+
+// writeBundle writes a bundle with HEAD pointing to the commit and the objects reachable
+// from it but not from haves
+func writeBundle(ctx context.Context, r *git.Repository, file string, commit plumbing.Hash, haves []plumbing.Hash) (err error) {
+	hashes, err := revlist.Objects(r.Storer, []plumbing.Hash{commit}, haves)
+	if err != nil {
+		return xerrors.Errorf("Unable to list objects: %w", err)
+	}
+	prerequisites, err := boundary(r, commit, hashes)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return xerrors.Errorf("Unable to create bundle: %w", err)
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(file)
+		}
+	}()
+
+	w := bufio.NewWriter(&ctxWriter{ctx: ctx, w: f})
+	if err := writeBundleHeader(w, prerequisites, []bundleRef{{name: "HEAD", hash: commit.String()}}); err != nil {
+		return xerrors.Errorf("Unable to write bundle: %w", err)
+	}
+	if _, err := packfile.NewEncoder(w, r.Storer, false).Encode(hashes, packWindow); err != nil {
+		return xerrors.Errorf("Unable to write bundle: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return xerrors.Errorf("Unable to write bundle: %w", err)
+	}
+	return f.Close()
+}
+
+// boundary returns the parents of the commits in objects which are not in objects
+// themselves, starting from commit. The receiver of a bundle made of objects must have them.
+func boundary(r *git.Repository, commit plumbing.Hash, objects []plumbing.Hash) ([]string, error) {
+	included := map[plumbing.Hash]bool{}
+	for _, h := range objects {
+		included[h] = true
+	}
+	if !included[commit] {
+		return nil, nil
+	}
+
+	var parents []string
+	visited := map[plumbing.Hash]bool{commit: true}
+	pending := []plumbing.Hash{commit}
+	for len(pending) > 0 {
+		c, err := r.CommitObject(pending[0])
+		if err != nil {
+			return nil, xerrors.Errorf("Unable to read commit: %w", err)
+		}
+		pending = pending[1:]
+
+		for _, p := range c.ParentHashes {
+			if visited[p] {
+				continue
+			}
+			visited[p] = true
+			if included[p] {
+				pending = append(pending, p)
+			} else {
+				parents = append(parents, p.String())
+			}
+		}
+	}
+	return parents, nil
+}
+
+// ctxWriter stops writing once the context is done
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c *ctxWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+// ctxReader stops reading once the context is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
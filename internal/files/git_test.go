@@ -0,0 +1,458 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+// setupRepo creates a repository with one commit per content of file.txt and
+// returns its directory and the hashes of the commits
+func setupRepo(t *testing.T, contents ...string) (string, []string) {
+	dir, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var commits []string
+	for i, c := range contents {
+		if err := ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+		w.Add("file.txt")
+		h, err := w.Commit(c, &git.CommitOptions{Author: &object.Signature{
+			Name:  "rm",
+			Email: "test@rm.com",
+			When:  time.Unix(int64(1600000000+i), 0),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits = append(commits, h.String())
+	}
+	return dir, commits
+}
+
+func backends(t *testing.T) map[string]GitBackend {
+	b := map[string]GitBackend{"go": NewGoGit()}
+	if _, err := exec.LookPath("git"); err == nil {
+		b["cli"] = NewCLIGit()
+	}
+	return b
+}
+
+func TestGitBackendsResolveCommits(t *testing.T) {
+	repo, commits := setupRepo(t, "one", "two")
+	defer os.RemoveAll(repo)
+
+	for name, g := range backends(t) {
+		c, err := g.ResolveCommit(context.Background(), repo, "HEAD~1")
+		assert.NoError(t, err, name)
+		assert.Equal(t, commits[0], c, name)
+
+		_, err = g.ResolveCommit(context.Background(), repo, "0000000000000000000000000000000000000000")
+		assert.True(t, xerrors.Is(err, ErrCommitNotFound), name)
+
+		_, err = g.ResolveCommit(context.Background(), repo, "--all")
+		assert.True(t, xerrors.Is(err, ErrCommitNotFound), name)
+	}
+}
+
+func TestGitBackendsBundleAndUnbundle(t *testing.T) {
+	repo, commits := setupRepo(t, "one", "two")
+	defer os.RemoveAll(repo)
+
+	for name, g := range backends(t) {
+		dir, err := ioutil.TempDir("", "bundle")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		bundle := filepath.Join(dir, "project.bundle")
+		assert.NoError(t, g.Bundle(context.Background(), repo, bundle, commits[0], nil), name)
+
+		// every backend reads the bundles of every other backend
+		for other, o := range backends(t) {
+			target := filepath.Join(dir, other)
+			assert.NoError(t, o.Unbundle(context.Background(), bundle, target), name+"->"+other)
+
+			c, err := o.ResolveCommit(context.Background(), target, commits[0])
+			assert.NoError(t, err, name+"->"+other)
+			assert.Equal(t, commits[0], c)
+
+			_, err = o.ResolveCommit(context.Background(), target, commits[1])
+			assert.True(t, xerrors.Is(err, ErrCommitNotFound), name+"->"+other)
+		}
+	}
+}
+
+func TestGitBackendsBundleSinceHaves(t *testing.T) {
+	repo, commits := setupRepo(t, "one", "two", "three")
+	defer os.RemoveAll(repo)
+
+	for name, g := range backends(t) {
+		dir, err := ioutil.TempDir("", "bundle")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		full := filepath.Join(dir, "full.bundle")
+		thin := filepath.Join(dir, "thin.bundle")
+		assert.NoError(t, g.Bundle(context.Background(), repo, full, commits[0], nil), name)
+		assert.NoError(t, g.Bundle(context.Background(), repo, thin, commits[2], []string{commits[0]}), name)
+
+		f, err := os.Open(thin)
+		assert.NoError(t, err)
+		prerequisites, refs, err := readBundleHeader(bufio.NewReader(f))
+		f.Close()
+		assert.NoError(t, err, name)
+		assert.Equal(t, []string{commits[0]}, prerequisites, name)
+		assert.Equal(t, []bundleRef{{name: "HEAD", hash: commits[2]}}, refs, name)
+
+		// a client holding the older commit fetches the missing history from the thin bundle
+		if _, err := exec.LookPath("git"); err == nil {
+			client := filepath.Join(dir, "client")
+			assert.NoError(t, NewCLIGit().Unbundle(context.Background(), full, client), name)
+			cmd := exec.Command("git", "fetch", "--quiet", thin, "HEAD")
+			cmd.Dir = client
+			out, err := cmd.CombinedOutput()
+			assert.NoError(t, err, string(out))
+
+			c, err := NewCLIGit().ResolveCommit(context.Background(), client, "FETCH_HEAD")
+			assert.NoError(t, err, name)
+			assert.Equal(t, commits[2], c, name)
+		}
+	}
+}
+
+func TestGitBackendsListAndResolveRefs(t *testing.T) {
+	repo, commits := setupRepo(t, "one", "two")
+	defer os.RemoveAll(repo)
+
+	r, err := git.PlainOpen(repo)
+	assert.NoError(t, err)
+	_, err = r.CreateTag("v1", plumbing.NewHash(commits[0]), &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "rm", Email: "test@rm.com", When: time.Unix(1600000000, 0)},
+		Message: "v1",
+	})
+	assert.NoError(t, err)
+
+	for name, g := range backends(t) {
+		refs, err := g.ListRefs(context.Background(), repo)
+		assert.NoError(t, err, name)
+		assert.Equal(t, []Ref{
+			{Name: "master", Ref: "refs/heads/master", Type: RefBranch, Commit: commits[1]},
+			{Name: "v1", Ref: "refs/tags/v1", Type: RefTag, Commit: commits[0]},
+		}, refs, name)
+
+		for rev, commit := range map[string]string{"v1": commits[0], "master": commits[1], commits[0][:8]: commits[0]} {
+			c, err := g.ResolveCommit(context.Background(), repo, rev)
+			assert.NoError(t, err, name)
+			assert.Equal(t, commit, c, name+" "+rev)
+		}
+	}
+}
+
+func TestGitBackendsArchiveCommits(t *testing.T) {
+	repo, commits := setupRepo(t, "one", "two")
+	defer os.RemoveAll(repo)
+
+	for name, g := range backends(t) {
+		dir, err := ioutil.TempDir("", "archive")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		zipFile := filepath.Join(dir, "project.zip")
+		assert.NoError(t, g.Archive(context.Background(), repo, zipFile, commits[0], FormatZip), name)
+		zr, err := zip.OpenReader(zipFile)
+		assert.NoError(t, err, name)
+		found := false
+		for _, f := range zr.File {
+			if f.Name != "file.txt" {
+				continue
+			}
+			rc, err := f.Open()
+			assert.NoError(t, err, name)
+			b, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			assert.Equal(t, "one", string(b), name)
+			found = true
+		}
+		zr.Close()
+		assert.True(t, found, name)
+
+		tarFile := filepath.Join(dir, "project.tar.gz")
+		assert.NoError(t, g.Archive(context.Background(), repo, tarFile, commits[1], FormatTarGz), name)
+		f, err := os.Open(tarFile)
+		assert.NoError(t, err)
+		gz, err := gzip.NewReader(f)
+		assert.NoError(t, err, name)
+		tr := tar.NewReader(gz)
+		found = false
+		for {
+			h, err := tr.Next()
+			if err != nil {
+				break
+			}
+			if h.Name == "file.txt" {
+				b, _ := ioutil.ReadAll(tr)
+				assert.Equal(t, "two", string(b), name)
+				found = true
+			}
+		}
+		f.Close()
+		assert.True(t, found, name)
+
+		err = g.Archive(context.Background(), repo, filepath.Join(dir, "project.tar.xz"), commits[1], FormatTarXz)
+		assert.True(t, xerrors.Is(err, ErrUnsupportedFormat), name)
+	}
+}
+
+func TestGitBackendsTreeAndBlob(t *testing.T) {
+	repo, _ := setupRepo(t, "one")
+	defer os.RemoveAll(repo)
+
+	r, err := git.PlainOpen(repo)
+	assert.NoError(t, err)
+	w, err := r.Worktree()
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Join(repo, "dir"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, "dir", "main.go"), []byte("package main\n"), 0755))
+	w.Add("dir/main.go")
+	h, err := w.Commit("dir", &git.CommitOptions{Author: &object.Signature{Name: "rm", Email: "test@rm.com", When: time.Unix(1600000001, 0)}})
+	assert.NoError(t, err)
+	commit := h.String()
+
+	for name, g := range backends(t) {
+		entries, err := g.Tree(context.Background(), repo, commit, "")
+		assert.NoError(t, err, name)
+		assert.Len(t, entries, 2, name)
+		assert.Equal(t, TreeEntry{Name: "dir", Path: "dir", Type: EntryTree, Mode: "040000", SHA: entries[0].SHA}, entries[0], name)
+		assert.Equal(t, "file.txt", entries[1].Path, name)
+		assert.Equal(t, int64(3), entries[1].Size, name)
+
+		entries, err = g.Tree(context.Background(), repo, commit, "/dir/")
+		assert.NoError(t, err, name)
+		assert.Equal(t, []TreeEntry{{Name: "main.go", Path: "dir/main.go", Type: EntryBlob, Mode: "100755", Size: 13, SHA: entries[0].SHA}}, entries, name)
+
+		rc, size, err := g.Blob(context.Background(), repo, commit, "dir/main.go")
+		assert.NoError(t, err, name)
+		b, err := ioutil.ReadAll(rc)
+		assert.NoError(t, err, name)
+		assert.NoError(t, rc.Close(), name)
+		assert.Equal(t, "package main\n", string(b), name)
+		assert.Equal(t, int64(13), size, name)
+
+		_, err = g.Tree(context.Background(), repo, commit, "file.txt")
+		assert.True(t, xerrors.Is(err, ErrNotADirectory), name)
+		_, _, err = g.Blob(context.Background(), repo, commit, "dir")
+		assert.True(t, xerrors.Is(err, ErrNotAFile), name)
+		_, _, err = g.Blob(context.Background(), repo, commit, "../missing")
+		assert.True(t, xerrors.Is(err, ErrPathNotFound), name)
+	}
+}
+
+func TestGitBackendsLog(t *testing.T) {
+	repo, commits := setupRepo(t, "one", "two", "three")
+	defer os.RemoveAll(repo)
+
+	for name, g := range backends(t) {
+		log, err := g.Log(context.Background(), repo, LogOptions{})
+		assert.NoError(t, err, name)
+		assert.Len(t, log, 3, name)
+		assert.Equal(t, commits[2], log[0].SHA, name)
+		assert.Equal(t, []string{commits[1]}, log[0].Parents, name)
+		assert.Equal(t, []string{}, log[2].Parents, name)
+		assert.Equal(t, "rm", log[0].Author.Name, name)
+		assert.Equal(t, "test@rm.com", log[0].Committer.Email, name)
+		assert.Equal(t, int64(1600000002), log[0].Author.Date.Unix(), name)
+		assert.Equal(t, "three", log[0].Message, name)
+
+		log, err = g.Log(context.Background(), repo, LogOptions{Rev: commits[2], Skip: 1, Limit: 1})
+		assert.NoError(t, err, name)
+		assert.Len(t, log, 1, name)
+		assert.Equal(t, commits[1], log[0].SHA, name)
+
+		log, err = g.Log(context.Background(), repo, LogOptions{Until: time.Unix(1600000001, 0)})
+		assert.NoError(t, err, name)
+		assert.Len(t, log, 2, name)
+		assert.Equal(t, commits[1], log[0].SHA, name)
+
+		log, err = g.Log(context.Background(), repo, LogOptions{Path: "missing.txt"})
+		assert.NoError(t, err, name)
+		assert.Len(t, log, 0, name)
+
+		c, err := g.Commit(context.Background(), repo, commits[0][:8])
+		assert.NoError(t, err, name)
+		assert.Equal(t, commits[0], c.SHA, name)
+
+		_, err = g.Commit(context.Background(), repo, "missing")
+		assert.True(t, xerrors.Is(err, ErrCommitNotFound), name)
+	}
+}
+
+func TestGitBackendsDiff(t *testing.T) {
+	repo, commits := setupRepo(t, "one\ntwo\n")
+	defer os.RemoveAll(repo)
+
+	r, err := git.PlainOpen(repo)
+	assert.NoError(t, err)
+	w, err := r.Worktree()
+	assert.NoError(t, err)
+	write := func(name, contents string) {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, name), []byte(contents), 0644))
+		_, err := w.Add(name)
+		assert.NoError(t, err)
+	}
+	write("moved.txt", "a\nb\nc\nd\ne\n")
+	write("removed.txt", "gone\n")
+	h, err := w.Commit("add", &git.CommitOptions{Author: &object.Signature{Name: "rm", Email: "test@rm.com", When: time.Unix(1600000001, 0)}})
+	assert.NoError(t, err)
+	base := h.String()
+
+	write("file.txt", "one\nthree\nfour\n")
+	write("added.txt", "new\n")
+	assert.NoError(t, os.Rename(filepath.Join(repo, "moved.txt"), filepath.Join(repo, "renamed.txt")))
+	_, err = w.Remove("moved.txt")
+	assert.NoError(t, err)
+	write("renamed.txt", "a\nb\nc\nd\ne\n")
+	_, err = w.Remove("removed.txt")
+	assert.NoError(t, err)
+	h, err = w.Commit("change", &git.CommitOptions{Author: &object.Signature{Name: "rm", Email: "test@rm.com", When: time.Unix(1600000002, 0)}})
+	assert.NoError(t, err)
+	head := h.String()
+
+	for name, g := range backends(t) {
+		changes, err := g.Diff(context.Background(), repo, base, head)
+		assert.NoError(t, err, name)
+		assert.Equal(t, []FileChange{
+			{Path: "added.txt", Status: StatusAdded, Additions: 1},
+			{Path: "file.txt", Status: StatusModified, Additions: 2, Deletions: 1},
+			{Path: "removed.txt", Status: StatusDeleted, Deletions: 1},
+			{Path: "renamed.txt", OldPath: "moved.txt", Status: StatusRenamed},
+		}, changes, name)
+
+		mb, err := g.MergeBase(context.Background(), repo, commits[0], head)
+		assert.NoError(t, err, name)
+		assert.Equal(t, commits[0], mb, name)
+
+		patch := &bytes.Buffer{}
+		assert.NoError(t, g.Patch(context.Background(), repo, base, head, patch), name)
+		assert.Contains(t, patch.String(), "+three\n", name)
+		assert.Contains(t, patch.String(), "-two\n", name)
+	}
+}
+
+func TestGitBackendsFetch(t *testing.T) {
+	repo, commits := setupRepo(t, "one", "two")
+	defer os.RemoveAll(repo)
+	// the history rk returns after a force push
+	src, rewritten := setupRepo(t, "one", "other", "three")
+	defer os.RemoveAll(src)
+
+	for name, g := range backends(t) {
+		dir, err := ioutil.TempDir("", "fetch")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		bundle := filepath.Join(dir, "project.bundle")
+		assert.NoError(t, g.Bundle(context.Background(), repo, bundle, commits[1], nil), name)
+		target := filepath.Join(dir, "project")
+		assert.NoError(t, g.Unbundle(context.Background(), bundle, target), name)
+
+		assert.NoError(t, g.Fetch(context.Background(), target, src), name)
+		assert.NoError(t, g.Fetch(context.Background(), target, src), name)
+
+		for _, c := range append(commits, rewritten...) {
+			h, err := g.ResolveCommit(context.Background(), target, c)
+			assert.NoError(t, err, name)
+			assert.Equal(t, c, h, name)
+		}
+		h, err := g.ResolveCommit(context.Background(), target, "master")
+		assert.NoError(t, err, name)
+		assert.Equal(t, rewritten[2], h, name)
+		h, err = g.ResolveCommit(context.Background(), target, "HEAD")
+		assert.NoError(t, err, name)
+		assert.Equal(t, rewritten[2], h, name)
+	}
+}
+
+func TestCLIGitFetchRunsNoHooksOfTheRepositories(t *testing.T) {
+	repo, commits := setupRepo(t, "one")
+	defer os.RemoveAll(repo)
+	src, _ := setupRepo(t, "one", "two")
+	defer os.RemoveAll(src)
+
+	dir, err := ioutil.TempDir("", "fetch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	g := NewCLIGit()
+	bundle := filepath.Join(dir, "project.bundle")
+	assert.NoError(t, g.Bundle(context.Background(), repo, bundle, commits[0], nil))
+	target := filepath.Join(dir, "project")
+	assert.NoError(t, g.Unbundle(context.Background(), bundle, target))
+
+	// the hooks of the archives from rk, wherever their config points to, are not run
+	marker := filepath.Join(dir, "hooked")
+	hook := []byte("#!/bin/sh\ntouch " + marker + "\n")
+	for _, r := range []string{target, src} {
+		hooks := filepath.Join(r, ".git", "hooks")
+		assert.NoError(t, os.MkdirAll(hooks, 0755))
+		for _, name := range []string{"reference-transaction", "post-checkout", "pre-auto-gc"} {
+			assert.NoError(t, ioutil.WriteFile(filepath.Join(hooks, name), hook, 0755))
+		}
+		assert.NoError(t, g.run(context.Background(), r, "config", "core.hooksPath", hooks))
+	}
+
+	assert.NoError(t, g.Fetch(context.Background(), target, src))
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCLIGitIgnoresTheDiffSettingsOfTheRepositories(t *testing.T) {
+	repo, commits := setupRepo(t, "one\n", "two\n")
+	defer os.RemoveAll(repo)
+
+	g := NewCLIGit()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, ".gitattributes"), []byte("*.txt diff=upper\n"), 0644))
+	for _, kv := range [][]string{
+		{"diff.upper.textconv", "tr a-z A-Z"},
+		{"diff.noprefix", "true"},
+		{"color.ui", "always"},
+	} {
+		assert.NoError(t, exec.Command("git", "-C", repo, "config", kv[0], kv[1]).Run())
+	}
+
+	changes, err := g.Diff(context.Background(), repo, commits[0], commits[1])
+	assert.NoError(t, err)
+	assert.Equal(t, []FileChange{{Path: "file.txt", Status: StatusModified, Additions: 1, Deletions: 1}}, changes)
+
+	patch := &bytes.Buffer{}
+	assert.NoError(t, g.Patch(context.Background(), repo, commits[0], commits[1], patch))
+	assert.Contains(t, patch.String(), "--- a/file.txt\n")
+	assert.Contains(t, patch.String(), "-one\n+two\n")
+	assert.NotContains(t, patch.String(), "\x1b[")
+}
@@ -0,0 +1,61 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ProjectKey is the key below which the blobs of a project are kept
+func ProjectKey(projectID string) string {
+	return projectID
+}
+
+// CommitKey is the key below which the bundles and snapshots of a commit are kept
+func CommitKey(projectID, commit string) string {
+	return path.Join(projectID, commit)
+}
+
+// BundleKey returns the key of the bundle of a commit. Bundles left out of the history
+// reachable from haves have one key per set of haves, which identifies them in the cache
+// of generated bundles. Thin bundles are stored by content, older ones under these keys.
+func BundleKey(projectID, commit, projectName string, haves ...string) string {
+	bundleFile := projectName + ".bundle"
+	if len(haves) == 0 {
+		return path.Join(projectID, commit, bundleFile)
+	}
+
+	return path.Join(ThinBundlesKey(projectID, commit), HavesKey(haves), bundleFile)
+}
+
+// HavesKey identifies a set of haves whatever their order
+func HavesKey(haves []string) string {
+	sorted := append([]string{}, haves...)
+	sort.Strings(sorted)
+	key := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return hex.EncodeToString(key[:8])
+}
+
+// ThinBundlesKey is the key below which the bundles of a commit left out of the history
+// reachable from haves were kept before they were stored by content
+func ThinBundlesKey(projectID, commit string) string {
+	return path.Join(projectID, commit, "thin")
+}
+
+// ArchiveKey returns the key of the snapshot of the files of a commit in the given format,
+// next to its bundle
+func ArchiveKey(projectID, commit, projectName string, format Format) string {
+	return path.Join(projectID, commit, projectName+"."+string(format))
+}
+
+// ZipKey returns the key of the archive downloaded from rk, whatever its format
+func ZipKey(projectID, projectName string) string {
+	return path.Join(ZipPrefix(projectID), projectName+".zip")
+}
+
+// ZipPrefix is the key below which the archive downloaded from rk is kept
+func ZipPrefix(projectID string) string {
+	return path.Join(projectID, "zip")
+}
@@ -1,67 +1,95 @@
 package files
 
 import (
-	"fmt"
+	"context"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/iantal/rm/internal/util"
 	"golang.org/x/xerrors"
 )
 
-// Local is an implementation of the Storage interface which works with the
-// local disk on the current machine
+// Local is an implementation of the BlobStore and Workspace interfaces which works
+// with the local disk on the current machine. The workspace of a project is kept
+// in its directory, next to its blobs.
 type Local struct {
 	log         *util.StandardLogger
 	maxFileSize int // maximum numbber of bytes for files
 	basePath    string
+	limits      ExtractLimits
+	git         GitBackend
 }
 
 // NewLocal creates a new Local filesytem with the given base path
 // basePath is the base directory to save files to
-// maxSize is the max number of bytes that a file can be
-func NewLocal(l *util.StandardLogger, basePath string, maxSize int) (*Local, error) {
+// maxSize is the max number of bytes that a file can be, it also bounds the
+// uncompressed size of an extracted archive
+// git is the backend running the git operations on the extracted repositories
+func NewLocal(l *util.StandardLogger, basePath string, maxSize int, git GitBackend) (*Local, error) {
 	p, err := filepath.Abs(basePath)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Local{l, maxSize, p}, nil
+	limits := ExtractLimits{
+		MaxTotalSize: int64(maxSize),
+		MaxEntries:   1000000,
+		MaxRatio:     200,
+	}
+	return &Local{l, maxSize, p, limits, git}, nil
 }
 
 // FullPath returns the absolute path
+// paths which already point inside the base path are returned unchanged
 func (l *Local) FullPath(path string) string {
+	if rel, err := filepath.Rel(l.basePath, path); err == nil && filepath.IsAbs(path) && !strings.HasPrefix(rel, "..") {
+		return filepath.Clean(path)
+	}
+
 	// append the given path to the base path
 	return filepath.Join(l.basePath, path)
 }
 
-func (l *Local) ProjectPath(projectID string) string {
-	return filepath.Join(l.basePath, projectID)
-}
+// workspaceDir is the name of the directory of a project holding its extracted repositories
+const workspaceDir = "unzip"
 
-func (l *Local) CommitPath(projectID, commit string) string {
-	return filepath.Join(l.basePath, projectID, commit)
+// blobPath returns the path of the file of the blob under key. Keys recorded as paths
+// inside the base path are accepted as well.
+func (l *Local) blobPath(key string) string {
+	if filepath.IsAbs(key) && l.FullPath(key) == filepath.Clean(key) {
+		return key
+	}
+	return filepath.Join(l.basePath, filepath.FromSlash(cleanKey(key)))
 }
 
-func (l *Local) BundleFilePath(projectID, commit, projectName string) string {
-	bundleFile := projectName + ".bundle"
-	return filepath.Join(l.basePath, projectID, commit, bundleFile)
+// workspacePath returns the directory the repositories of a project are extracted into
+func (l *Local) workspacePath(projectID string) string {
+	return filepath.Join(l.basePath, filepath.FromSlash(cleanKey(projectID)), workspaceDir)
 }
 
-func (l *Local) ZipFilePath(projectID, projectName string) string {
-	zipFile := projectName + ".zip"
-	return filepath.Join(l.basePath, projectID, "zip", zipFile)
+// isWorkspace reports whether the path is the workspace of a project
+func (l *Local) isWorkspace(p string) bool {
+	rel, err := filepath.Rel(l.basePath, p)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	return len(parts) == 2 && parts[1] == workspaceDir
 }
 
-func (l *Local) UnzipPath(projectID string) string {
-	return filepath.Join(l.basePath, projectID, "unzip")
-}
+// partialSuffix marks the files being written by Save, which are not blobs yet
+const partialSuffix = ".part"
 
 // Save the contents of the Writer to the given path
 // path is a relative path, basePath will be appended
-func (l *Local) Save(fp string, contents io.Reader) error {
+// the contents are written next to the file and renamed once complete, so that a failed
+// write leaves the file as it was
+func (l *Local) Save(path string, contents io.Reader) error {
+	fp := l.FullPath(path)
+
 	// get the directory and make sure it exists
 	d := filepath.Dir(fp)
 	err := os.MkdirAll(d, os.ModePerm)
@@ -69,112 +97,416 @@ func (l *Local) Save(fp string, contents io.Reader) error {
 		return xerrors.Errorf("Unable to create directory: %w", err)
 	}
 
-	// if the file exists delete it
-	_, err = os.Stat(fp)
-	if err == nil {
-		err = os.Remove(fp)
-		if err != nil {
-			return xerrors.Errorf("Unable to delete file: %w", err)
-		}
-	} else if !os.IsNotExist(err) {
-		// if this is anything other than a not exists error
-		return xerrors.Errorf("Unable to get file info: %w", err)
-	}
-
-	// create a new file at the path
-	f, err := os.Create(fp)
+	f, err := ioutil.TempFile(d, "."+filepath.Base(fp)+".*"+partialSuffix)
 	if err != nil {
 		return xerrors.Errorf("Unable to create file: %w", err)
 	}
+	defer os.Remove(f.Name())
 	defer f.Close()
 
 	// write the contents to the new file
-	// ensure that we are not writing greater than max bytes
 	_, err = io.Copy(f, contents)
+	if err == nil {
+		err = f.Sync()
+	}
 	if err != nil {
 		return xerrors.Errorf("Unable to write to file: %w", err)
 	}
+	if err := f.Chmod(0644); err != nil {
+		return xerrors.Errorf("Unable to set file mode: %w", err)
+	}
 
+	if err := os.Rename(f.Name(), fp); err != nil {
+		return xerrors.Errorf("Unable to move file: %w", err)
+	}
 	return nil
 }
 
-// Get the file at the given path and return a Reader
-// the calling function is responsible for closing the reader
-func (l *Local) Get(path string) (*os.File, error) {
-	// get the full path for the file
-	fp := l.FullPath(path)
+// isPartial reports whether the file is being written by Save, or was left by a write
+// interrupted by a crash
+func isPartial(p string) bool {
+	name := filepath.Base(p)
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, partialSuffix)
+}
 
-	// open the file
-	f, err := os.Open(fp)
+// RemovePartial deletes the files left by writes interrupted by a crash. It is called on
+// startup, before anything is written.
+func (l *Local) RemovePartial() (int, error) {
+	removed := 0
+	err := filepath.Walk(l.basePath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && l.isWorkspace(p) {
+			return filepath.SkipDir
+		}
+		if fi.Mode().IsRegular() && isPartial(p) {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, xerrors.Errorf("Unable to open file: %w", err)
+		return removed, xerrors.Errorf("Unable to remove partial files: %w", err)
 	}
+	return removed, nil
+}
 
-	return f, nil
+// Size returns the number of bytes used by the files under the given path,
+// 0 if the path does not exist
+func (l *Local) Size(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(l.FullPath(path), func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, xerrors.Errorf("Unable to compute size: %w", err)
+	}
+	return size, nil
 }
 
-// Unzip uses the unzip command line tool to extract the project to the specified target directory
-func (l *Local) Unzip(archive, target, name string) error {
-	td := filepath.Join(target, name)
-	if err := os.MkdirAll(td, 0755); err != nil {
-		return xerrors.Errorf("Unable to create target directory: %w", err)
+// Put saves the contents of the reader as the blob under key. Files built in the
+// workspace are moved in place rather than copied.
+func (l *Local) Put(ctx context.Context, key string, contents io.Reader) error {
+	fp := l.blobPath(key)
+	if s, ok := contents.(*spoolFile); ok && s.owner == l {
+		if err := os.MkdirAll(filepath.Dir(fp), os.ModePerm); err != nil {
+			return xerrors.Errorf("Unable to create directory: %w", err)
+		}
+		if err := os.Rename(s.Name(), fp); err == nil {
+			return nil
+		}
 	}
+	return l.Save(fp, contents)
+}
+
+// Get opens the blob under key for reading
+// the calling function is responsible for closing the file
+func (l *Local) Get(ctx context.Context, key string) (File, BlobInfo, error) {
+	fp := l.blobPath(key)
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, BlobInfo{}, xerrors.Errorf("Unable to open file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.IsDir() {
+		err = notExist("open", key)
+	}
+	if err != nil {
+		f.Close()
+		return nil, BlobInfo{}, xerrors.Errorf("Unable to open file: %w", err)
+	}
+	return f, BlobInfo{Key: cleanKey(key), Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
 
-	cmd := exec.Command("unzip", "-qq", archive, "-d", td)
+// Stat returns information on the blob under key
+func (l *Local) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	fi, err := os.Stat(l.blobPath(key))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	if fi.IsDir() {
+		return BlobInfo{}, notExist("stat", key)
+	}
+	return BlobInfo{Key: cleanKey(key), Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
 
-	if err := cmd.Run(); err != nil {
-		return xerrors.Errorf("Unable to unzip archive: %w", err)
+// Delete removes the blob under key and the blobs below it, the workspace of a project
+// is left in place
+func (l *Local) Delete(ctx context.Context, key string) error {
+	fp := l.blobPath(key)
+	if fp == l.basePath {
+		return xerrors.Errorf("Refusing to delete the base path")
 	}
 
-	cmd.ProcessState.Sys()
+	fi, err := os.Stat(fp)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("Unable to delete: %w", err)
+	}
+	if fi.IsDir() && filepath.Dir(fp) == l.basePath {
+		// a project, its workspace is removed through Remove
+		entries, err := ioutil.ReadDir(fp)
+		if err != nil {
+			return xerrors.Errorf("Unable to delete: %w", err)
+		}
+		for _, e := range entries {
+			p := filepath.Join(fp, e.Name())
+			if l.isWorkspace(p) {
+				continue
+			}
+			if err := os.RemoveAll(p); err != nil {
+				return xerrors.Errorf("Unable to delete: %w", err)
+			}
+		}
+		os.Remove(fp)
+		return nil
+	}
+
+	if err := os.RemoveAll(fp); err != nil {
+		return xerrors.Errorf("Unable to delete: %w", err)
+	}
 	return nil
 }
 
-func (l *Local) Checkout(src, dest, commit, projectID, name string) error {
-	if err := os.MkdirAll(dest, 0755); err != nil {
-		return xerrors.Errorf("Unable to create target directory: %w", err)
+// List returns the blobs under prefix, skipping the workspaces of the projects and the
+// files being written
+func (l *Local) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	err := filepath.Walk(l.blobPath(prefix), func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && l.isWorkspace(p) {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() || isPartial(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(l.basePath, p)
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, BlobInfo{Key: filepath.ToSlash(rel), Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to list files: %w", err)
 	}
+	return blobs, nil
+}
 
-	os.Chdir(filepath.Join(src, name))
+// Extract extracts the archive read from the reader as the repository name of the project.
+// Archives which are not files of this storage are copied to the workspace first.
+func (l *Local) Extract(ctx context.Context, projectID, name string, archive io.Reader) error {
+	ws := l.workspacePath(projectID)
+	if f, ok := archive.(*os.File); ok {
+		return l.Unzip(f.Name(), ws, name)
+	}
 
-	// checkout the commit
-	cmd := exec.Command("git", "checkout", commit)
-	err := runCmd(cmd)
+	s, err := l.spool(projectID, ".archive-")
 	if err != nil {
-		return xerrors.Errorf("Git checkout error: %w", err)
+		return err
+	}
+	defer s.Close()
+	if _, err := io.Copy(s, archive); err != nil {
+		return xerrors.Errorf("Unable to copy archive: %w", err)
+	}
+	return l.Unzip(s.Name(), ws, name)
+}
+
+// Refresh extracts the archive next to the repository name of the project and fetches
+// from it
+func (l *Local) Refresh(ctx context.Context, projectID, name string, archive io.Reader) error {
+	if !l.Extracted(projectID, name) {
+		return l.Extract(ctx, projectID, name, archive)
+	}
+
+	update := "." + name + ".refresh"
+	if err := l.Extract(ctx, projectID, update, archive); err != nil {
+		return err
+	}
+	defer os.RemoveAll(l.repo(projectID, update))
+
+	if err := l.git.Fetch(ctx, l.repo(projectID, name), l.repo(projectID, update)); err != nil {
+		return xerrors.Errorf("Git fetch error: %w", err)
+	}
+	return nil
+}
+
+// Extracted reports whether the repository name of the project was extracted
+func (l *Local) Extracted(projectID, name string) bool {
+	fi, err := os.Stat(filepath.Join(l.workspacePath(projectID), name))
+	return err == nil && fi.IsDir()
+}
+
+// Remove deletes the repositories extracted for the project
+func (l *Local) Remove(projectID string) error {
+	if err := os.RemoveAll(l.workspacePath(projectID)); err != nil {
+		return xerrors.Errorf("Unable to delete: %w", err)
+	}
+	return nil
+}
+
+// Usage returns the number of bytes used by the repositories of the project, or of
+// every project when projectID is empty
+func (l *Local) Usage(projectID string) (int64, error) {
+	if projectID != "" {
+		return l.Size(l.workspacePath(projectID))
 	}
 
-	// bundle the commit
-	bf := name + ".bundle"
-	cmd = exec.Command("git", "bundle", "create", filepath.Join(dest, bf), "HEAD")
-	err = runCmd(cmd)
+	projects, err := l.Projects()
 	if err != nil {
-		return xerrors.Errorf("Git bundle error: %w", err)
+		return 0, err
+	}
+	var size int64
+	for _, p := range projects {
+		s, err := l.Size(l.workspacePath(p))
+		if err != nil {
+			return 0, err
+		}
+		size += s
 	}
+	return size, nil
+}
 
-	// reset
-	cmd = exec.Command("git", "reset", "--hard")
-	err = runCmd(cmd)
+// Projects returns the projects with a workspace
+func (l *Local) Projects() ([]string, error) {
+	entries, err := ioutil.ReadDir(l.basePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
-		return xerrors.Errorf("Git reset error: %w", err)
+		return nil, xerrors.Errorf("Unable to list projects: %w", err)
 	}
 
-	os.Chdir("-")
-	return nil
+	var projects []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if fi, err := os.Stat(l.workspacePath(e.Name())); err == nil && fi.IsDir() {
+			projects = append(projects, e.Name())
+		}
+	}
+	return projects, nil
+}
 
+// repo returns the path of the repository name extracted for the project
+func (l *Local) repo(projectID, name string) string {
+	return filepath.Join(l.workspacePath(projectID), name)
 }
 
-func runCmd(cmd *exec.Cmd) error {
-	if err := cmd.Run(); err != nil {
-		if err != nil {
-			os.Stderr.WriteString(fmt.Sprintf("Error: %s\n", err.Error()))
+// ResolveCommit returns the full hash of the commit rev points to in the repository of the project
+func (l *Local) ResolveCommit(ctx context.Context, projectID, name, rev string) (string, error) {
+	return l.git.ResolveCommit(ctx, l.repo(projectID, name), rev)
+}
+
+// ListRefs returns the branches and tags of the repository of the project
+func (l *Local) ListRefs(ctx context.Context, projectID, name string) ([]Ref, error) {
+	return l.git.ListRefs(ctx, l.repo(projectID, name))
+}
+
+// Tree lists the directory at path in the commit of the repository of the project
+func (l *Local) Tree(ctx context.Context, projectID, name, commit, path string) ([]TreeEntry, error) {
+	return l.git.Tree(ctx, l.repo(projectID, name), commit, path)
+}
+
+// Blob returns the contents of the file at path in the commit of the repository of the project
+func (l *Local) Blob(ctx context.Context, projectID, name, commit, path string) (io.ReadCloser, int64, error) {
+	return l.git.Blob(ctx, l.repo(projectID, name), commit, path)
+}
+
+// Log returns the commits selected by opts in the repository of the project
+func (l *Local) Log(ctx context.Context, projectID, name string, opts LogOptions) ([]Commit, error) {
+	return l.git.Log(ctx, l.repo(projectID, name), opts)
+}
+
+// Commit returns the metadata of the commit rev points to in the repository of the project
+func (l *Local) Commit(ctx context.Context, projectID, name, rev string) (*Commit, error) {
+	return l.git.Commit(ctx, l.repo(projectID, name), rev)
+}
+
+// MergeBase returns the best common ancestor of two commits of the repository of the project
+func (l *Local) MergeBase(ctx context.Context, projectID, name, a, b string) (string, error) {
+	return l.git.MergeBase(ctx, l.repo(projectID, name), a, b)
+}
+
+// Diff returns the files changed between two commits of the repository of the project
+func (l *Local) Diff(ctx context.Context, projectID, name, from, to string) ([]FileChange, error) {
+	return l.git.Diff(ctx, l.repo(projectID, name), from, to)
+}
+
+// Patch writes the unified diff between two commits of the repository of the project to w
+func (l *Local) Patch(ctx context.Context, projectID, name, from, to string, w io.Writer) error {
+	return l.git.Patch(ctx, l.repo(projectID, name), from, to, w)
+}
+
+// Bundle creates the bundle of the commit from the repository of the project, leaving out
+// the history reachable from haves. The working tree of the repository is not modified.
+func (l *Local) Bundle(ctx context.Context, projectID, name, commit string, haves []string) (File, error) {
+	return l.build(projectID, ".bundle-", func(file string) error {
+		if err := l.git.Bundle(ctx, l.repo(projectID, name), file, commit, haves); err != nil {
+			return xerrors.Errorf("Git bundle error: %w", err)
 		}
-		if exitError, ok := err.(*exec.ExitError); ok {
-			exitError.Sys()
+		return nil
+	})
+}
+
+// Archive creates the snapshot of the files of the commit from the repository of the project
+func (l *Local) Archive(ctx context.Context, projectID, name, commit string, format Format) (File, error) {
+	return l.build(projectID, ".archive-", func(file string) error {
+		if err := l.git.Archive(ctx, l.repo(projectID, name), file, commit, format); err != nil {
+			return xerrors.Errorf("Git archive error: %w", err)
 		}
-		return err
+		return nil
+	})
+}
+
+// build runs write on a new file of the workspace of the project and opens the result
+func (l *Local) build(projectID, pattern string, write func(file string) error) (File, error) {
+	s, err := l.spool(projectID, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if err := write(s.Name()); err != nil {
+		s.Close()
+		return nil, err
 	}
 
-	cmd.ProcessState.Sys()
-	return nil
-}
\ No newline at end of file
+	// the backend replaced the file, read what it wrote
+	f, err := os.Open(s.Name())
+	if err != nil {
+		s.Close()
+		return nil, xerrors.Errorf("Unable to open file: %w", err)
+	}
+	s.File.Close()
+	s.File = f
+	return s, nil
+}
+
+// Spool creates a temporary file in the workspace of the project
+func (l *Local) Spool(projectID string) (TempFile, error) {
+	return l.spool(projectID, ".spool-")
+}
+
+// spool creates a temporary file in the workspace of the project
+func (l *Local) spool(projectID, pattern string) (*spoolFile, error) {
+	ws := l.workspacePath(projectID)
+	if err := os.MkdirAll(ws, 0755); err != nil {
+		return nil, xerrors.Errorf("Unable to create target directory: %w", err)
+	}
+	f, err := ioutil.TempFile(ws, pattern)
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to create file: %w", err)
+	}
+	return &spoolFile{File: f, owner: l}, nil
+}
+
+// spoolFile is a temporary file of the workspace, removed once closed
+type spoolFile struct {
+	*os.File
+	owner *Local
+}
+
+func (s *spoolFile) Close() error {
+	err := s.File.Close()
+	os.Remove(s.Name())
+	return err
+}
@@ -2,6 +2,9 @@ package files
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -17,7 +20,7 @@ func setupLocal(t *testing.T) (*Local, string, func()) {
 		t.Fatal(err)
 	}
 
-	l, err := NewLocal(nil, dir, 10000)
+	l, err := NewLocal(nil, dir, 10000, NewGoGit())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -58,7 +61,7 @@ func TestGetsContentsAndWritesToWriter(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Read the file back
-	r, err := l.Get(savePath)
+	r, _, err := l.Get(context.Background(), savePath)
 	assert.NoError(t, err)
 	defer r.Close()
 
@@ -66,3 +69,54 @@ func TestGetsContentsAndWritesToWriter(t *testing.T) {
 	d, err := ioutil.ReadAll(r)
 	assert.Equal(t, fileContents, string(d))
 }
+
+func TestSizeSumsFilesUnderPath(t *testing.T) {
+	l, _, cleanup := setupLocal(t)
+	defer cleanup()
+
+	assert.NoError(t, l.Save("/1/a/one.txt", bytes.NewBufferString("12345")))
+	assert.NoError(t, l.Save("/1/b/two.txt", bytes.NewBufferString("123")))
+
+	size, err := l.Size("/1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), size)
+
+	size, err = l.Size("/1/a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), size)
+
+	size, err = l.Size("/missing")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+}
+
+func TestSaveKeepsFileWhenWriteFails(t *testing.T) {
+	l, dir, _ := setupLocal(t)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, l.Save("1/zip/project.zip", bytes.NewBufferString("complete")))
+	err := l.Save("1/zip/project.zip", io.MultiReader(bytes.NewBufferString("partial"), &failingReader{}))
+	assert.Error(t, err)
+
+	d, err := ioutil.ReadFile(filepath.Join(dir, "1", "zip", "project.zip"))
+	assert.NoError(t, err)
+	assert.Equal(t, "complete", string(d))
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "1", "zip"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// files left by a crash are not blobs and are removed on startup
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1", "zip", ".project.zip.123.part"), []byte("part"), 0644))
+	blobs, err := l.List(context.Background(), "1")
+	assert.NoError(t, err)
+	assert.Len(t, blobs, 1)
+	n, err := l.RemovePartial()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
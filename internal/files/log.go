@@ -0,0 +1,36 @@
+package files
+
+import (
+	"time"
+)
+
+// Signature is the author or the committer of a commit
+type Signature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+}
+
+// Commit is the metadata of a commit
+type Commit struct {
+	SHA       string    `json:"sha"`
+	Parents   []string  `json:"parents"`
+	Author    Signature `json:"author"`
+	Committer Signature `json:"committer"`
+	Message   string    `json:"message"`
+}
+
+// LogOptions selects the commits returned by GitBackend.Log
+type LogOptions struct {
+	// Rev is where the history starts, HEAD when empty
+	Rev string
+	// Path limits the history to the commits changing the file or directory at path
+	Path string
+	// Since and Until limit the history to the commits made in between, by committer date
+	Since time.Time
+	Until time.Time
+	// Skip is the number of matching commits left out before the first one returned
+	Skip int
+	// Limit is the maximum number of commits returned, 0 for no limit
+	Limit int
+}
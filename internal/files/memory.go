@@ -0,0 +1,113 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Memory is an implementation of the BlobStore interface which keeps the blobs in memory.
+// It is meant for tests.
+type Memory struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemory creates an empty in-memory blob store
+func NewMemory() *Memory {
+	return &Memory{blobs: map[string]memoryBlob{}}
+}
+
+// Put stores the contents of the reader under key
+func (m *Memory) Put(ctx context.Context, key string, contents io.Reader) error {
+	data, err := ioutil.ReadAll(contents)
+	if err != nil {
+		return xerrors.Errorf("Unable to read contents: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[cleanKey(key)] = memoryBlob{data, time.Now()}
+	return nil
+}
+
+// Get returns a reader of the blob under key, later changes to the blob do not affect it
+func (m *Memory) Get(ctx context.Context, key string) (File, BlobInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key = cleanKey(key)
+	b, ok := m.blobs[key]
+	if !ok {
+		return nil, BlobInfo{}, notExist("open", key)
+	}
+	return memoryFile{bytes.NewReader(b.data)}, b.info(key), nil
+}
+
+// Stat returns information on the blob under key
+func (m *Memory) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key = cleanKey(key)
+	b, ok := m.blobs[key]
+	if !ok {
+		return BlobInfo{}, notExist("stat", key)
+	}
+	return b.info(key), nil
+}
+
+// Delete removes the blob under key and the blobs below it
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key = cleanKey(key)
+	if key == "" {
+		return xerrors.Errorf("Refusing to delete every blob")
+	}
+	for k := range m.blobs {
+		if below(k, key) {
+			delete(m.blobs, k)
+		}
+	}
+	return nil
+}
+
+// List returns the blobs under prefix ordered by key
+func (m *Memory) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	prefix = cleanKey(prefix)
+	var blobs []BlobInfo
+	for k, b := range m.blobs {
+		if below(k, prefix) {
+			blobs = append(blobs, b.info(k))
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	return blobs, nil
+}
+
+func (b memoryBlob) info(key string) BlobInfo {
+	return BlobInfo{Key: key, Size: int64(len(b.data)), ModTime: b.modTime}
+}
+
+// memoryFile is a blob opened for reading
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error { return nil }
@@ -0,0 +1,179 @@
+package files
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/iantal/rm/internal/util"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"golang.org/x/xerrors"
+)
+
+// s3PartSize is the size of the parts of multipart uploads, objects smaller than it
+// are uploaded with a single request
+const s3PartSize = 64 * 1024 * 1024
+
+// S3Options configures the connection of the S3 storage to its bucket
+type S3Options struct {
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Region    string
+	Secure    bool
+	Bucket    string
+	// Prefix is prepended to the keys of the objects
+	Prefix string
+	// PresignExpiry is how long the presigned URLs returned for downloads are valid,
+	// 0 disables them and downloads are streamed through rm
+	PresignExpiry time.Duration
+}
+
+// S3 is an implementation of the BlobStore interface which keeps the blobs as objects
+// of an S3-compatible bucket
+type S3 struct {
+	log     *util.StandardLogger
+	client  *minio.Client
+	bucket  string
+	prefix  string
+	presign time.Duration
+}
+
+// NewS3 creates a blob store backed by the bucket of an S3-compatible object store
+func NewS3(l *util.StandardLogger, opts S3Options) (*S3, error) {
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""),
+		Secure: opts.Secure,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to create S3 client: %w", err)
+	}
+
+	prefix := strings.Trim(opts.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3{l, client, opts.Bucket, prefix, opts.PresignExpiry}, nil
+}
+
+// object returns the name of the object of the blob under key
+func (s *S3) object(key string) string {
+	return s.prefix + cleanKey(key)
+}
+
+// Put uploads the contents of the reader as the object of the blob under key.
+// Contents of a known size smaller than a part are uploaded with a single request.
+func (s *S3) Put(ctx context.Context, key string, contents io.Reader) error {
+	size := int64(-1)
+	if f, ok := contents.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := f.Stat(); err == nil {
+			size = fi.Size()
+		}
+	}
+
+	_, err := s.client.PutObject(ctx, s.bucket, s.object(key), contents, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    s3PartSize,
+	})
+	if err != nil {
+		return xerrors.Errorf("Unable to upload object: %w", err)
+	}
+	return nil
+}
+
+// Get streams the object of the blob under key
+func (s *S3) Get(ctx context.Context, key string) (File, BlobInfo, error) {
+	o, err := s.client.GetObject(ctx, s.bucket, s.object(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, BlobInfo{}, xerrors.Errorf("Unable to get object: %w", err)
+	}
+	info, err := o.Stat()
+	if err != nil {
+		o.Close()
+		if notFound(err) {
+			return nil, BlobInfo{}, notExist("open", key)
+		}
+		return nil, BlobInfo{}, xerrors.Errorf("Unable to get object: %w", err)
+	}
+	return o, s.info(info), nil
+}
+
+// Stat returns information on the object of the blob under key
+func (s *S3) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, s.object(key), minio.StatObjectOptions{})
+	if notFound(err) {
+		return BlobInfo{}, notExist("stat", key)
+	}
+	if err != nil {
+		return BlobInfo{}, xerrors.Errorf("Unable to stat object: %w", err)
+	}
+	return s.info(info), nil
+}
+
+// Delete removes the object of the blob under key and the objects below it
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if cleanKey(key) == "" {
+		return xerrors.Errorf("Refusing to delete every object of the prefix")
+	}
+	blobs, err := s.List(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		if err := s.client.RemoveObject(ctx, s.bucket, s.object(b.Key), minio.RemoveObjectOptions{}); err != nil {
+			return xerrors.Errorf("Unable to delete object: %w", err)
+		}
+	}
+	return nil
+}
+
+// List returns the blobs under prefix
+func (s *S3) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	prefix = cleanKey(prefix)
+	var blobs []BlobInfo
+	for o := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix + prefix, Recursive: true}) {
+		if o.Err != nil {
+			return nil, xerrors.Errorf("Unable to list objects: %w", o.Err)
+		}
+		b := s.info(o)
+		if below(b.Key, prefix) {
+			blobs = append(blobs, b)
+		}
+	}
+	return blobs, nil
+}
+
+// PresignedURL returns a URL the blob under key can be downloaded from as filename
+// without going through rm, or an empty string when presigning is disabled
+func (s *S3) PresignedURL(ctx context.Context, key, filename string) (string, error) {
+	if s.presign <= 0 {
+		return "", nil
+	}
+
+	params := url.Values{}
+	params.Set("response-content-disposition", "attachment; filename=\""+filename+"\"")
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, s.object(key), s.presign, params)
+	if err != nil {
+		return "", xerrors.Errorf("Unable to presign object: %w", err)
+	}
+	return u.String(), nil
+}
+
+// info returns the information on the blob stored as the given object
+func (s *S3) info(o minio.ObjectInfo) BlobInfo {
+	return BlobInfo{Key: strings.TrimPrefix(o.Key, s.prefix), Size: o.Size, ModTime: o.LastModified}
+}
+
+func notFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	r := minio.ToErrorResponse(err)
+	return r.StatusCode == http.StatusNotFound || r.Code == "NoSuchKey"
+}
@@ -0,0 +1,223 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is an in-process S3 server holding the objects of a single bucket in memory.
+// It implements the requests the S3 storage makes and ignores authentication.
+type fakeS3 struct {
+	bucket  string
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+}
+
+func (f *fakeS3) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != f.bucket {
+		f.error(rw, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	q := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(rw, q.Get("prefix"))
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		f.get(rw, r, key)
+	case r.Method == http.MethodPost && q.Get("uploads") == "" && q["uploads"] != nil:
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(rw, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", f.bucket, key, id)
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		f.uploads[q.Get("uploadId")][n] = readPayload(r)
+		rw.Header().Set("ETag", fmt.Sprintf("\"part%d\"", n))
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		ioutil.ReadAll(r.Body)
+		upload := f.uploads[q.Get("uploadId")]
+		var numbers []int
+		for n := range upload {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, upload[n]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, q.Get("uploadId"))
+		fmt.Fprintf(rw, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>", f.bucket, key)
+	case r.Method == http.MethodPut:
+		f.objects[key] = readPayload(r)
+		rw.Header().Set("ETag", "\"etag\"")
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(rw, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) get(rw http.ResponseWriter, r *http.Request, key string) {
+	data, ok := f.objects[key]
+	if !ok {
+		f.error(rw, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	rw.Header().Set("ETag", "\"etag\"")
+	rw.Header().Set("Last-Modified", time.Unix(1600000000, 0).UTC().Format(http.TimeFormat))
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(rw, r, key, time.Unix(1600000000, 0), bytes.NewReader(data))
+}
+
+func (f *fakeS3) list(rw http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		Size         int64
+		ETag         string
+		LastModified string
+	}
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Name     string
+		Prefix   string
+		KeyCount int
+		Contents []content
+	}{Name: f.bucket, Prefix: prefix}
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		result.Contents = append(result.Contents, content{
+			Key:          k,
+			Size:         int64(len(f.objects[k])),
+			ETag:         "\"etag\"",
+			LastModified: time.Unix(1600000000, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	result.KeyCount = len(keys)
+	xml.NewEncoder(rw).Encode(result)
+}
+
+func (f *fakeS3) error(rw http.ResponseWriter, status int, code string) {
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.WriteHeader(status)
+	fmt.Fprintf(rw, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// readPayload reads the body of an upload, decoding the chunks of streaming signatures
+func readPayload(r *http.Request) []byte {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		b, _ := ioutil.ReadAll(r.Body)
+		return b
+	}
+
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		header, err := br.ReadString('\n')
+		if err != nil {
+			return data
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(header), ";", 2)[0], 16, 64)
+		if err != nil || size == 0 {
+			return data
+		}
+		chunk := make([]byte, size)
+		io.ReadFull(br, chunk)
+		data = append(data, chunk...)
+		br.ReadString('\n')
+	}
+}
+
+func setupS3(t *testing.T, presign time.Duration) (*S3, *fakeS3) {
+	fake := newFakeS3("rm-bucket")
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	s, err := NewS3(nil, S3Options{
+		Endpoint:      strings.TrimPrefix(server.URL, "http://"),
+		AccessKey:     "access",
+		SecretKey:     "secret",
+		Region:        "us-east-1",
+		Bucket:        "rm-bucket",
+		Prefix:        "data",
+		PresignExpiry: presign,
+	})
+	assert.NoError(t, err)
+	return s, fake
+}
+
+func TestS3BlobStore(t *testing.T) {
+	s, fake := setupS3(t, 0)
+	testBlobStore(t, s)
+
+	// objects are named after the keys, below the prefix
+	assert.Equal(t, []byte("other"), fake.objects["data/12/zip/project.zip"])
+	assert.Len(t, fake.objects, 1)
+}
+
+func TestS3UploadsFilesOfTheWorkspace(t *testing.T) {
+	s, fake := setupS3(t, 0)
+	l, dir, _ := setupLocal(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	f, err := l.spool("p", ".bundle-")
+	assert.NoError(t, err)
+	f.WriteString("Hello World")
+	f.Seek(0, io.SeekStart)
+	assert.NoError(t, s.Put(ctx, "p/c/project.bundle", f))
+	f.Close()
+	assert.Equal(t, []byte("Hello World"), fake.objects["data/p/c/project.bundle"])
+
+	_, err = os.Stat(f.Name())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestS3PresignsDownloads(t *testing.T) {
+	s, _ := setupS3(t, 0)
+	u, err := s.PresignedURL(context.Background(), "1/c/project.bundle", "project.bundle")
+	assert.NoError(t, err)
+	assert.Empty(t, u)
+
+	s, _ = setupS3(t, time.Minute)
+	u, err = s.PresignedURL(context.Background(), "1/c/project.bundle", "project.bundle")
+	assert.NoError(t, err)
+	assert.Contains(t, u, "/rm-bucket/data/1/c/project.bundle?")
+	assert.Contains(t, u, "X-Amz-Signature=")
+}
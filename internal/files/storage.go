@@ -1,18 +1,113 @@
 package files
 
-import "io"
-
-// Storage defines the behavior for file operations
-// Implementations may be of the time local disk, or cloud storage, etc
-type Storage interface {
-	FullPath(path string) string
-	ProjectPath(projectID string) string
-	CommitPath(projectID, commit string) string
-	BundleFilePath(projectID, commit, projectName string) string
-	ZipFilePath(projectID, projectName string) string
-	UnzipPath(projectID string) string
-
-	Save(path string, file io.Reader) error
-	Unzip(src, dest, name string) error
-	Checkout(src, dest, commit, projectID, name string) error
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File is a blob of the store opened for reading
+type File interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// TempFile is a temporary file of the workspace, removed once closed. Putting it into a
+// blob store of the same storage moves it in place rather than copying it.
+type TempFile interface {
+	File
+	io.Writer
+	Name() string
+	Sync() error
+	Truncate(size int64) error
+}
+
+// BlobInfo describes a blob of the store
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore keeps the files served by rm by key: the archives downloaded from rk, the
+// bundles and the snapshots of commits. Keys are slash separated paths built with the
+// Key functions. Implementations may be of the type local disk, memory, or cloud storage.
+// Missing blobs are reported by errors for which xerrors.Is(err, os.ErrNotExist) holds.
+type BlobStore interface {
+	// Put stores the contents of the reader under key, replacing any previous blob
+	Put(ctx context.Context, key string, contents io.Reader) error
+	// Get opens the blob under key for reading
+	Get(ctx context.Context, key string) (File, BlobInfo, error)
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	// Delete removes the blob under key and the blobs whose keys are below it,
+	// deleting a key which does not exist is not an error. An empty key is refused.
+	Delete(ctx context.Context, key string) error
+	// List returns the blob under prefix and the blobs whose keys are below it,
+	// every blob for an empty prefix
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+}
+
+// Presigner is implemented by blob stores whose blobs can be downloaded without going
+// through rm. PresignedURL returns an empty string when this is not possible.
+type Presigner interface {
+	PresignedURL(ctx context.Context, key, filename string) (string, error)
+}
+
+// Workspace is where the repositories of projects are extracted and git runs on them.
+// Its files are derived from the blobs and can be removed at any time.
+type Workspace interface {
+	// Extract extracts the archive read from the reader as the repository name of the project
+	Extract(ctx context.Context, projectID, name string, archive io.Reader) error
+	// Refresh merges the refs and objects of the archive read from the reader into the
+	// repository name of the project, which keeps the commits it had. The repository is
+	// extracted when there is none.
+	Refresh(ctx context.Context, projectID, name string, archive io.Reader) error
+	// Extracted reports whether the repository name of the project was extracted
+	Extracted(projectID, name string) bool
+	// Remove deletes the repositories extracted for the project
+	Remove(projectID string) error
+	// Usage returns the number of bytes used by the repositories of the project,
+	// or of every project when projectID is empty
+	Usage(projectID string) (int64, error)
+	// Projects returns the projects with files in the workspace
+	Projects() ([]string, error)
+	// Spool creates a TempFile in the workspace of the project
+	Spool(projectID string) (TempFile, error)
+
+	ResolveCommit(ctx context.Context, projectID, name, rev string) (string, error)
+	ListRefs(ctx context.Context, projectID, name string) ([]Ref, error)
+	Tree(ctx context.Context, projectID, name, commit, path string) ([]TreeEntry, error)
+	Blob(ctx context.Context, projectID, name, commit, path string) (io.ReadCloser, int64, error)
+	Log(ctx context.Context, projectID, name string, opts LogOptions) ([]Commit, error)
+	Commit(ctx context.Context, projectID, name, rev string) (*Commit, error)
+	MergeBase(ctx context.Context, projectID, name, a, b string) (string, error)
+	Diff(ctx context.Context, projectID, name, from, to string) ([]FileChange, error)
+	Patch(ctx context.Context, projectID, name, from, to string, w io.Writer) error
+	// Bundle creates the bundle of the commit, leaving out the history reachable from haves.
+	// The bundle is removed from the workspace once the returned file is closed.
+	Bundle(ctx context.Context, projectID, name, commit string, haves []string) (File, error)
+	// Archive creates the snapshot of the files of the commit in the given format.
+	// The snapshot is removed from the workspace once the returned file is closed.
+	Archive(ctx context.Context, projectID, name, commit string, format Format) (File, error)
+}
+
+// cleanKey returns the canonical form of a key, without leading or trailing slashes.
+// Keys cannot point above the root of the store.
+func cleanKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(key)), "/")
+}
+
+// below reports whether key is prefix or a key below it
+func below(key, prefix string) bool {
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+// notExist returns the error reporting a missing blob
+func notExist(op, key string) error {
+	return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
 }
@@ -0,0 +1,191 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+// testBlobStore checks the behavior every BlobStore implementation shares
+func testBlobStore(t *testing.T, s BlobStore) {
+	ctx := context.Background()
+
+	assert.NoError(t, s.Put(ctx, "1/zip/project.zip", bytes.NewBufferString("Hello World")))
+	assert.NoError(t, s.Put(ctx, "1/c/project.bundle", bytes.NewBufferString("bundle")))
+	assert.NoError(t, s.Put(ctx, "12/zip/project.zip", bytes.NewBufferString("other")))
+
+	info, err := s.Stat(ctx, "1/zip/project.zip")
+	assert.NoError(t, err)
+	assert.Equal(t, "1/zip/project.zip", info.Key)
+	assert.Equal(t, int64(11), info.Size)
+
+	f, info, err := s.Get(ctx, "/1/zip/project.zip")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), info.Size)
+	f.Seek(6, io.SeekStart)
+	b, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "World", string(b))
+	f.Close()
+
+	// prefixes match whole path segments
+	blobs, err := s.List(ctx, "1")
+	assert.NoError(t, err)
+	var keys []string
+	for _, b := range blobs {
+		keys = append(keys, b.Key)
+	}
+	assert.ElementsMatch(t, []string{"1/zip/project.zip", "1/c/project.bundle"}, keys)
+	blobs, err = s.List(ctx, "")
+	assert.NoError(t, err)
+	assert.Len(t, blobs, 3)
+
+	// a prefix is not a blob
+	_, err = s.Stat(ctx, "1/zip")
+	assert.True(t, xerrors.Is(err, os.ErrNotExist))
+
+	// deleting every blob is refused
+	assert.Error(t, s.Delete(ctx, ""))
+	assert.Error(t, s.Delete(ctx, "/"))
+	blobs, err = s.List(ctx, "")
+	assert.NoError(t, err)
+	assert.Len(t, blobs, 3)
+
+	assert.NoError(t, s.Delete(ctx, "1"))
+	assert.NoError(t, s.Delete(ctx, "1"))
+	_, err = s.Stat(ctx, "1/zip/project.zip")
+	assert.True(t, xerrors.Is(err, os.ErrNotExist))
+	_, _, err = s.Get(ctx, "1/c/project.bundle")
+	assert.True(t, xerrors.Is(err, os.ErrNotExist))
+	blobs, err = s.List(ctx, "")
+	assert.NoError(t, err)
+	assert.Len(t, blobs, 1)
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	l, dir, _ := setupLocal(t)
+	defer os.RemoveAll(dir)
+	testBlobStore(t, l)
+}
+
+func TestMemoryBlobStore(t *testing.T) {
+	testBlobStore(t, NewMemory())
+}
+
+func TestLocalWorkspaceBuildsBlobs(t *testing.T) {
+	l, dir, _ := setupLocal(t)
+	defer os.RemoveAll(dir)
+	repo, commits := setupRepo(t, "one", "two")
+	defer os.RemoveAll(repo)
+	ctx := context.Background()
+
+	// a bundle of the repository is the archive downloaded from rk
+	bundle := filepath.Join(repo, "..", filepath.Base(repo)+".bundle")
+	defer os.Remove(bundle)
+	assert.NoError(t, NewGoGit().Bundle(ctx, repo, bundle, commits[1], nil))
+	b, err := ioutil.ReadFile(bundle)
+	assert.NoError(t, err)
+
+	// the archive is not a file of the storage
+	assert.NoError(t, l.Extract(ctx, "p", "project", bytes.NewReader(b)))
+	assert.True(t, l.Extracted("p", "project"))
+	assert.False(t, l.Extracted("p", "other"))
+	c, err := l.ResolveCommit(ctx, "p", "project", "HEAD~1")
+	assert.NoError(t, err)
+	assert.Equal(t, commits[0], c)
+
+	// the workspace is not part of the blobs
+	blobs, err := l.List(ctx, "")
+	assert.NoError(t, err)
+	assert.Empty(t, blobs)
+	usage, err := l.Usage("")
+	assert.NoError(t, err)
+	assert.True(t, usage > 0)
+
+	// bundles built in the workspace are moved to the blobs
+	rc, err := l.Bundle(ctx, "p", "project", commits[0], nil)
+	assert.NoError(t, err)
+	key := BundleKey("p", commits[0], "project")
+	assert.NoError(t, l.Put(ctx, key, rc))
+	rc.Close()
+
+	f, _, err := l.Get(ctx, key)
+	assert.NoError(t, err)
+	_, refs, err := readBundleHeader(bufio.NewReader(f))
+	f.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, []bundleRef{{name: "HEAD", hash: commits[0]}}, refs)
+
+	// and copied to other stores
+	m := NewMemory()
+	rc, err = l.Archive(ctx, "p", "project", commits[0], FormatZip)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Put(ctx, ArchiveKey("p", commits[0], "project", FormatZip), rc))
+	rc.Close()
+	info, err := m.Stat(ctx, ArchiveKey("p", commits[0], "project", FormatZip))
+	assert.NoError(t, err)
+	assert.True(t, info.Size > 0)
+
+	// no temporary file is left in the workspace
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "p", "unzip"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// deleting the blobs of the project leaves the workspace in place
+	assert.NoError(t, l.Delete(ctx, ProjectKey("p")))
+	assert.True(t, l.Extracted("p", "project"))
+	projects, err := l.Projects()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"p"}, projects)
+
+	assert.NoError(t, l.Remove("p"))
+	assert.False(t, l.Extracted("p", "project"))
+}
+
+func TestLocalWorkspaceRefreshKeepsCommits(t *testing.T) {
+	l, dir, _ := setupLocal(t)
+	defer os.RemoveAll(dir)
+	repo, commits := setupRepo(t, "one", "two")
+	defer os.RemoveAll(repo)
+	ctx := context.Background()
+
+	bundle := func(commit string) *os.File {
+		f, err := ioutil.TempFile("", "bundle")
+		assert.NoError(t, err)
+		f.Close()
+		assert.NoError(t, NewGoGit().Bundle(ctx, repo, f.Name(), commit, nil))
+		f, err = os.Open(f.Name())
+		assert.NoError(t, err)
+		return f
+	}
+
+	first := bundle(commits[0])
+	defer os.Remove(first.Name())
+	assert.NoError(t, l.Refresh(ctx, "p", "project", first))
+	first.Close()
+	_, err := l.ResolveCommit(ctx, "p", "project", commits[1])
+	assert.True(t, xerrors.Is(err, ErrCommitNotFound))
+
+	second := bundle(commits[1])
+	defer os.Remove(second.Name())
+	assert.NoError(t, l.Refresh(ctx, "p", "project", second))
+	second.Close()
+	for _, c := range commits {
+		h, err := l.ResolveCommit(ctx, "p", "project", c)
+		assert.NoError(t, err)
+		assert.Equal(t, c, h)
+	}
+
+	// only the repository is left in the workspace
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "p", "unzip"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -0,0 +1,148 @@
+package files
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/xerrors"
+)
+
+// tarDecompressors return the tar stream of the archives of the tar formats
+var tarDecompressors = map[Format]func(io.Reader) (io.ReadCloser, error){
+	FormatTar: func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(r), nil
+	},
+	FormatTarGz: func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	FormatTarZst: func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+	FormatTarXz: func(r io.Reader) (io.ReadCloser, error) {
+		x, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(x), nil
+	},
+}
+
+func extractTar(archive, target string, limits ExtractLimits) error {
+	return extractTarStream(archive, target, limits, tarDecompressors[FormatTar])
+}
+
+func extractTarGz(archive, target string, limits ExtractLimits) error {
+	return extractTarStream(archive, target, limits, tarDecompressors[FormatTarGz])
+}
+
+func extractTarZst(archive, target string, limits ExtractLimits) error {
+	return extractTarStream(archive, target, limits, tarDecompressors[FormatTarZst])
+}
+
+func extractTarXz(archive, target string, limits ExtractLimits) error {
+	return extractTarStream(archive, target, limits, tarDecompressors[FormatTarXz])
+}
+
+// extractTarStream extracts a tar archive compressed with the given decompressor.
+// The compression ratio is enforced on the whole archive since tar entries are not
+// compressed individually.
+func extractTarStream(archive, target string, limits ExtractLimits, decompress func(io.Reader) (io.ReadCloser, error)) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return xerrors.Errorf("Unable to open archive: %w", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return xerrors.Errorf("Unable to stat archive: %w", err)
+	}
+
+	dr, err := decompress(f)
+	if err != nil {
+		return &ArchiveError{Err: ErrInvalidArchive}
+	}
+	defer dr.Close()
+
+	x, err := newExtractor(target, limits)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(dr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &ArchiveError{Err: ErrInvalidArchive}
+		}
+
+		limit := int64(-1)
+		if limits.MaxRatio > 0 {
+			limit = fi.Size()*limits.MaxRatio - x.written
+		}
+
+		open := func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(tr), nil
+		}
+
+		switch h.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeDir:
+			err = x.extract(h.Name, h.FileInfo().Mode(), limit, open)
+		case tar.TypeSymlink:
+			err = x.extract(h.Name, os.ModeSymlink|0777, limit, func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(h.Linkname)), nil
+			})
+		case tar.TypeLink:
+			err = x.link(h.Name, h.Linkname)
+		default:
+			// pax headers written by git archive, devices, fifos, etc.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// link creates a hard link to an entry extracted before
+func (x *extractor) link(name, linkname string) error {
+	target, err := x.targetPath(name)
+	if err != nil {
+		return err
+	}
+	src, err := x.targetPath(linkname)
+	if err != nil {
+		return err
+	}
+
+	// the source must be a regular file which was extracted below root
+	resolved, err := filepath.EvalSymlinks(src)
+	if err != nil || !x.within(resolved) {
+		return &ArchiveError{Entry: name, Err: ErrUnsafePath}
+	}
+	if fi, err := os.Stat(resolved); err != nil || !fi.Mode().IsRegular() {
+		return &ArchiveError{Entry: name, Err: ErrUnsafePath}
+	}
+
+	if err := x.parent(name, target); err != nil {
+		return err
+	}
+	if err := os.Link(resolved, target); err != nil {
+		return xerrors.Errorf("Unable to create link: %w", err)
+	}
+	return nil
+}
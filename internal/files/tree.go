@@ -0,0 +1,47 @@
+package files
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	// ErrPathNotFound is returned when a path does not exist in the tree of a commit
+	ErrPathNotFound = errors.New("Path not found")
+	// ErrNotADirectory is returned when listing a path of a commit which is not a directory
+	ErrNotADirectory = errors.New("Not a directory")
+	// ErrNotAFile is returned when reading a path of a commit which is not a file
+	ErrNotAFile = errors.New("Not a file")
+)
+
+// Types of the entries of a tree, as named by git
+const (
+	EntryTree   = "tree"
+	EntryBlob   = "blob"
+	EntryCommit = "commit"
+)
+
+// TreeEntry is a file, a directory or a submodule in the tree of a commit
+type TreeEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Type string `json:"type"`
+	// Mode is the octal git file mode, e.g. 100644 or 040000
+	Mode string `json:"mode"`
+	// Size is the size of blobs in bytes
+	Size int64  `json:"size,omitempty"`
+	SHA  string `json:"sha"`
+}
+
+// cleanTreePath returns the path relative to the root of a tree, empty for the root itself.
+// .. does not go above the root.
+func cleanTreePath(p string) (string, error) {
+	p = path.Clean("/" + strings.Trim(p, "/"))
+	if strings.Contains(p, "\x00") {
+		return "", xerrors.Errorf("%q: %w", p, ErrPathNotFound)
+	}
+	return strings.TrimPrefix(p, "/"), nil
+}
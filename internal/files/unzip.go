@@ -0,0 +1,373 @@
+package files
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Errors returned when an archive is rejected during extraction
+var (
+	ErrInvalidArchive   = errors.New("Invalid archive")
+	ErrUnsafePath       = errors.New("Entry escapes the target directory")
+	ErrArchiveTooLarge  = errors.New("Archive exceeds the maximum uncompressed size")
+	ErrTooManyEntries   = errors.New("Archive exceeds the maximum number of entries")
+	ErrCompressionRatio = errors.New("Entry exceeds the maximum compression ratio")
+)
+
+// ArchiveError describes why an archive, or one of its entries, was rejected
+type ArchiveError struct {
+	Entry string
+	Err   error
+}
+
+func (e *ArchiveError) Error() string {
+	if e.Entry == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Err.Error(), e.Entry)
+}
+
+// Unwrap returns the reason the archive was rejected
+func (e *ArchiveError) Unwrap() error {
+	return e.Err
+}
+
+// IsArchiveError reports whether err was caused by a rejected archive
+func IsArchiveError(err error) bool {
+	var ae *ArchiveError
+	return errors.As(err, &ae)
+}
+
+// ExtractLimits bounds the resources an archive may use once extracted
+type ExtractLimits struct {
+	MaxTotalSize int64 // maximum number of uncompressed bytes
+	MaxEntries   int   // maximum number of entries
+	MaxRatio     int64 // maximum uncompressed to compressed size ratio of an entry
+}
+
+// maxSymlinkSize is the maximum length of the target of a symlink
+const maxSymlinkSize = 4096
+
+// Unzip extracts the archive into the name directory of the target directory.
+// The format of the archive is detected from its content. The archive is extracted
+// next to the name directory first, so the name directory only ever holds a complete
+// extraction.
+func (l *Local) Unzip(archive, target, name string) error {
+	format, err := DetectFileFormat(archive)
+	if err != nil {
+		return err
+	}
+	e, ok := extractorFor(format)
+	if format == FormatBundle {
+		e, ok = ExtractorFunc(l.unbundle), true
+	}
+	if !ok {
+		return &ArchiveError{Err: ErrUnsupportedFormat}
+	}
+
+	td := filepath.Join(target, name)
+	tmp := filepath.Join(target, "."+name+".partial")
+	if err := os.RemoveAll(tmp); err != nil {
+		return xerrors.Errorf("Unable to clean target directory: %w", err)
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return xerrors.Errorf("Unable to create target directory: %w", err)
+	}
+
+	if err := e.Extract(archive, tmp, l.limits); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	if err := os.RemoveAll(td); err != nil {
+		return xerrors.Errorf("Unable to clean target directory: %w", err)
+	}
+	if err := os.Rename(tmp, td); err != nil {
+		return xerrors.Errorf("Unable to move extracted archive: %w", err)
+	}
+	return nil
+}
+
+// unbundle clones a git bundle into the target directory
+func (l *Local) unbundle(archive, target string, limits ExtractLimits) error {
+	err := l.git.Unbundle(context.Background(), archive, target)
+
+	// the header was recognized, failing to clone means the bundle is corrupt
+	var ge *GitError
+	if xerrors.As(err, &ge) {
+		return &ArchiveError{Err: ErrInvalidArchive}
+	}
+	return err
+}
+
+// extractZip extracts a zip archive into the target directory
+func extractZip(archive, target string, limits ExtractLimits) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return &ArchiveError{Err: ErrInvalidArchive}
+	}
+	defer zr.Close()
+
+	x, err := newExtractor(target, limits)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if err := x.extractZipEntry(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractor writes the entries of an archive below root while enforcing the limits
+type extractor struct {
+	root    string
+	limits  ExtractLimits
+	entries int
+	written int64
+}
+
+func newExtractor(root string, limits ExtractLimits) (*extractor, error) {
+	r, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to resolve target directory: %w", err)
+	}
+	return &extractor{root: r, limits: limits}, nil
+}
+
+func (x *extractor) extractZipEntry(f *zip.File) error {
+	if f.CompressedSize64 > 0 && x.limits.MaxRatio > 0 && f.UncompressedSize64/f.CompressedSize64 > uint64(x.limits.MaxRatio) {
+		return &ArchiveError{Entry: f.Name, Err: ErrCompressionRatio}
+	}
+
+	// the declared size may lie, the copy is bounded by the ratio as well
+	limit := int64(-1)
+	if x.limits.MaxRatio > 0 {
+		limit = int64(f.CompressedSize64) * x.limits.MaxRatio
+	}
+
+	open := func() (io.ReadCloser, error) {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, &ArchiveError{Entry: f.Name, Err: ErrInvalidArchive}
+		}
+		return rc, nil
+	}
+	return x.extract(f.Name, f.Mode(), limit, open)
+}
+
+// extract writes a single entry. limit bounds the size of the entry, -1 means unbounded.
+func (x *extractor) extract(name string, mode os.FileMode, limit int64, open func() (io.ReadCloser, error)) error {
+	x.entries++
+	if x.limits.MaxEntries > 0 && x.entries > x.limits.MaxEntries {
+		return &ArchiveError{Err: ErrTooManyEntries}
+	}
+
+	target, err := x.targetPath(name)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case mode.IsDir():
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return xerrors.Errorf("Unable to create directory: %w", err)
+		}
+		return nil
+	case mode&os.ModeSymlink != 0:
+		return x.symlink(name, target, open)
+	case mode.IsRegular():
+		return x.file(name, target, mode, limit, open)
+	default:
+		// devices, pipes and sockets are never extracted
+		return nil
+	}
+}
+
+// targetPath returns the path of the entry below root or an error if it escapes it
+func (x *extractor) targetPath(name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || strings.HasPrefix(name, `\`) || filepath.VolumeName(name) != "" {
+		return "", &ArchiveError{Entry: name, Err: ErrUnsafePath}
+	}
+	target := filepath.Join(x.root, name)
+	if !x.within(target) {
+		return "", &ArchiveError{Entry: name, Err: ErrUnsafePath}
+	}
+	return target, nil
+}
+
+func (x *extractor) within(path string) bool {
+	return path == x.root || strings.HasPrefix(path, x.root+string(os.PathSeparator))
+}
+
+// parent creates the parent directory of target and makes sure it does not resolve
+// outside of root through a symlink extracted earlier
+func (x *extractor) parent(name, target string) error {
+	dir := filepath.Dir(target)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return xerrors.Errorf("Unable to create directory: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil || !x.within(resolved) {
+		return &ArchiveError{Entry: name, Err: ErrUnsafePath}
+	}
+
+	// never write through an existing entry, it may be a symlink. Directories are not
+	// replaced since the symlinks extracted before were resolved through them.
+	if fi, err := os.Lstat(target); err == nil && fi.IsDir() {
+		return &ArchiveError{Entry: name, Err: ErrUnsafePath}
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return xerrors.Errorf("Unable to replace file: %w", err)
+	}
+	return nil
+}
+
+func (x *extractor) symlink(name, target string, open func() (io.ReadCloser, error)) error {
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	link, err := ioutil.ReadAll(io.LimitReader(rc, maxSymlinkSize+1))
+	if err != nil {
+		return &ArchiveError{Entry: name, Err: ErrInvalidArchive}
+	}
+	if len(link) > maxSymlinkSize {
+		return &ArchiveError{Entry: name, Err: ErrUnsafePath}
+	}
+
+	dest := filepath.FromSlash(string(link))
+	if filepath.IsAbs(dest) || filepath.VolumeName(dest) != "" {
+		return &ArchiveError{Entry: name, Err: ErrUnsafePath}
+	}
+
+	if err := x.parent(name, target); err != nil {
+		return err
+	}
+	if !x.resolvesWithin(filepath.Dir(target), dest) {
+		return &ArchiveError{Entry: name, Err: ErrUnsafePath}
+	}
+	if err := os.Symlink(dest, target); err != nil {
+		return xerrors.Errorf("Unable to create symlink: %w", err)
+	}
+	return nil
+}
+
+// resolvesWithin reports whether the relative path dest, followed from the directory dir,
+// stays below root. The symlinks extracted before are resolved on the way. A missing
+// entry may become a symlink later, so dest must not go up from it.
+func (x *extractor) resolvesWithin(dir, dest string) bool {
+	current, err := filepath.EvalSymlinks(dir)
+	if err != nil || !x.within(current) {
+		return false
+	}
+
+	missing := false
+	for _, c := range strings.Split(dest, string(os.PathSeparator)) {
+		switch {
+		case c == "" || c == ".":
+			continue
+		case c == "..":
+			if missing {
+				return false
+			}
+			current = filepath.Dir(current)
+		case missing:
+			current = filepath.Join(current, c)
+		default:
+			next := filepath.Join(current, c)
+			fi, err := os.Lstat(next)
+			if os.IsNotExist(err) {
+				missing = true
+			} else if err != nil {
+				return false
+			} else if fi.Mode()&os.ModeSymlink != 0 {
+				if next, err = filepath.EvalSymlinks(next); err != nil {
+					return false
+				}
+			}
+			current = next
+		}
+		if !x.within(current) {
+			return false
+		}
+	}
+	return true
+}
+
+func (x *extractor) file(name, target string, mode os.FileMode, limit int64, open func() (io.ReadCloser, error)) error {
+	if err := x.parent(name, target); err != nil {
+		return err
+	}
+
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm()|0600)
+	if err != nil {
+		return xerrors.Errorf("Unable to create file: %w", err)
+	}
+	defer f.Close()
+
+	// read one byte more than allowed to detect entries exceeding the limits
+	remaining := x.limits.MaxTotalSize - x.written
+	if x.limits.MaxTotalSize <= 0 {
+		remaining = -1
+	}
+	max := remaining
+	if limit >= 0 && (max < 0 || limit < max) {
+		max = limit
+	}
+
+	// errors reading the entry come from a corrupt archive
+	var r io.Reader = &readErrReader{r: rc}
+	if max >= 0 {
+		r = io.LimitReader(r, max+1)
+	}
+	n, err := io.Copy(f, r)
+	x.written += n
+	if err != nil {
+		if xerrors.Is(err, errRead) {
+			return &ArchiveError{Entry: name, Err: ErrInvalidArchive}
+		}
+		return xerrors.Errorf("Unable to write file: %w", err)
+	}
+	if max >= 0 && n > max {
+		if max == limit {
+			return &ArchiveError{Entry: name, Err: ErrCompressionRatio}
+		}
+		return &ArchiveError{Err: ErrArchiveTooLarge}
+	}
+	return nil
+}
+
+// errRead marks errors returned while reading the content of an entry
+var errRead = errors.New("Unable to read entry")
+
+type readErrReader struct {
+	r io.Reader
+}
+
+func (r *readErrReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		return n, xerrors.Errorf("%v: %w", err, errRead)
+	}
+	return n, err
+}
@@ -0,0 +1,152 @@
+package files
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+type zipEntry struct {
+	name    string
+	mode    os.FileMode
+	content string
+}
+
+func writeZip(t *testing.T, dir string, entries []zipEntry) string {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		h.SetMode(e.mode)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fp := filepath.Join(dir, "test.zip")
+	if err := ioutil.WriteFile(fp, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fp
+}
+
+func TestUnzipExtractsFilesModesAndSymlinks(t *testing.T) {
+	l, dir, cleanup := setupLocal(t)
+	defer cleanup()
+
+	archive := writeZip(t, dir, []zipEntry{
+		{name: "src/", mode: os.ModeDir | 0755},
+		{name: "src/run.sh", mode: 0755, content: "#!/bin/sh"},
+		{name: "link", mode: os.ModeSymlink | 0777, content: "src/run.sh"},
+	})
+
+	err := l.Unzip(archive, filepath.Join(dir, "unzip"), "project")
+	assert.NoError(t, err)
+
+	fi, err := os.Stat(filepath.Join(dir, "unzip", "project", "src", "run.sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+
+	d, err := ioutil.ReadFile(filepath.Join(dir, "unzip", "project", "link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh", string(d))
+}
+
+func TestUnzipResolvesSymlinksWithinTheTarget(t *testing.T) {
+	l, dir, cleanup := setupLocal(t)
+	defer cleanup()
+
+	archive := writeZip(t, dir, []zipEntry{
+		{name: "src/run.sh", mode: 0755, content: "#!/bin/sh"},
+		{name: "a/src", mode: os.ModeSymlink | 0777, content: "../src"},
+		{name: "a/up", mode: os.ModeSymlink | 0777, content: "src/../a"},
+		{name: "b/run", mode: os.ModeSymlink | 0777, content: "../a/src/run.sh"},
+	})
+	assert.NoError(t, l.Unzip(archive, filepath.Join(dir, "unzip"), "project"))
+
+	d, err := ioutil.ReadFile(filepath.Join(dir, "unzip", "project", "b", "run"))
+	assert.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh", string(d))
+}
+
+func TestUnzipRejectsEntriesEscapingTheTarget(t *testing.T) {
+	for _, entries := range [][]zipEntry{
+		{{name: "../evil", mode: 0644, content: "x"}},
+		{{name: "link", mode: os.ModeSymlink | 0777, content: "../../etc"}},
+		{{name: "link", mode: os.ModeSymlink | 0777, content: "/etc"}},
+		// the chain only escapes once the symlinks extracted before are resolved
+		{
+			{name: "a/s", mode: os.ModeSymlink | 0777, content: ".."},
+			{name: "a/t", mode: os.ModeSymlink | 0777, content: "s/.."},
+		},
+		{
+			{name: "a/s", mode: os.ModeSymlink | 0777, content: ".."},
+			{name: "a/s/l", mode: os.ModeSymlink | 0777, content: "../etc"},
+		},
+		// a missing entry may be extracted as a symlink later
+		{
+			{name: "a/t", mode: os.ModeSymlink | 0777, content: "x/../.."},
+			{name: "a/x", mode: os.ModeSymlink | 0777, content: "."},
+		},
+		{
+			{name: "a/x/", mode: os.ModeDir | 0755},
+			{name: "a/t", mode: os.ModeSymlink | 0777, content: "x/.."},
+			{name: "a/x", mode: os.ModeSymlink | 0777, content: ".."},
+		},
+	} {
+		l, dir, cleanup := setupLocal(t)
+		defer cleanup()
+
+		archive := writeZip(t, dir, entries)
+		err := l.Unzip(archive, filepath.Join(dir, "unzip"), "project")
+		assert.True(t, IsArchiveError(err))
+		assert.True(t, xerrors.Is(err, ErrUnsafePath))
+	}
+}
+
+func TestUnzipEnforcesLimits(t *testing.T) {
+	l, dir, cleanup := setupLocal(t)
+	defer cleanup()
+
+	// highly compressible content exceeds the ratio
+	archive := writeZip(t, dir, []zipEntry{{name: "bomb", mode: 0644, content: strings.Repeat("0", 5000)}})
+	err := l.Unzip(archive, filepath.Join(dir, "unzip"), "project")
+	assert.True(t, xerrors.Is(err, ErrCompressionRatio))
+
+	// the storage of the test allows 10000 bytes
+	l.limits.MaxRatio = 0
+	archive = writeZip(t, dir, []zipEntry{{name: "big", mode: 0644, content: strings.Repeat("0", 20000)}})
+	err = l.Unzip(archive, filepath.Join(dir, "unzip2"), "project")
+	assert.True(t, xerrors.Is(err, ErrArchiveTooLarge))
+
+	l.limits.MaxEntries = 1
+	archive = writeZip(t, dir, []zipEntry{{name: "a", mode: 0644}, {name: "b", mode: 0644}})
+	err = l.Unzip(archive, filepath.Join(dir, "unzip3"), "project")
+	assert.True(t, xerrors.Is(err, ErrTooManyEntries))
+}
+
+func TestUnzipRejectsInvalidArchives(t *testing.T) {
+	l, dir, cleanup := setupLocal(t)
+	defer cleanup()
+
+	fp := filepath.Join(dir, "test.zip")
+	ioutil.WriteFile(fp, []byte("PK\x03\x04not a zip"), 0644)
+	err := l.Unzip(fp, filepath.Join(dir, "unzip"), "project")
+	assert.True(t, xerrors.Is(err, ErrInvalidArchive))
+
+	ioutil.WriteFile(fp, []byte("not an archive"), 0644)
+	err = l.Unzip(fp, filepath.Join(dir, "unzip"), "project")
+	assert.True(t, xerrors.Is(err, ErrUnsupportedFormat))
+}
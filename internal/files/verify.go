@@ -0,0 +1,134 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+// VerifyArchive reads the archive at the given path through without extracting it, and
+// returns an ArchiveError when it is truncated or corrupt. The checksums of zip entries
+// and of the packfile of bundles are checked.
+func VerifyArchive(archive string) error {
+	format, err := DetectFileFormat(archive)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatZip:
+		return verifyZip(archive)
+	case FormatBundle:
+		return verifyBundle(archive)
+	}
+	decompress, ok := tarDecompressors[format]
+	if !ok {
+		return &ArchiveError{Err: ErrUnsupportedFormat}
+	}
+	return verifyTar(archive, decompress)
+}
+
+func verifyZip(archive string) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return &ArchiveError{Err: ErrInvalidArchive}
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			return &ArchiveError{Entry: f.Name, Err: ErrInvalidArchive}
+		}
+		// the checksum of the entry is checked once it is read through
+		_, err = io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return &ArchiveError{Entry: f.Name, Err: ErrInvalidArchive}
+		}
+	}
+	return nil
+}
+
+func verifyTar(archive string, decompress func(io.Reader) (io.ReadCloser, error)) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return xerrors.Errorf("Unable to open archive: %w", err)
+	}
+	defer f.Close()
+
+	dr, err := decompress(f)
+	if err != nil {
+		return &ArchiveError{Err: ErrInvalidArchive}
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			// the checksum of the compressed stream follows the end of the tar archive
+			if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+				return &ArchiveError{Err: ErrInvalidArchive}
+			}
+			return nil
+		}
+		if err != nil {
+			return &ArchiveError{Err: ErrInvalidArchive}
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return &ArchiveError{Entry: h.Name, Err: ErrInvalidArchive}
+		}
+	}
+}
+
+// verifyBundle checks the header of a bundle and the trailing checksum of its packfile
+func verifyBundle(archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return xerrors.Errorf("Unable to open archive: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if _, _, err := readBundleHeader(r); err != nil {
+		return err
+	}
+	if sig, err := r.Peek(4); err != nil || string(sig) != "PACK" {
+		return &ArchiveError{Err: ErrInvalidArchive}
+	}
+
+	t := &tailHasher{h: sha1.New()}
+	if _, err := io.Copy(t, r); err != nil {
+		return xerrors.Errorf("Unable to read archive: %w", err)
+	}
+	if len(t.tail) != sha1.Size || !bytes.Equal(t.h.Sum(nil), t.tail) {
+		return &ArchiveError{Err: ErrInvalidArchive}
+	}
+	return nil
+}
+
+// tailHasher hashes what is written to it except for the last bytes, which are the
+// checksum of a packfile
+type tailHasher struct {
+	h    hash.Hash
+	tail []byte
+}
+
+func (t *tailHasher) Write(p []byte) (int, error) {
+	buf := append(t.tail, p...)
+	if len(buf) > sha1.Size {
+		t.h.Write(buf[:len(buf)-sha1.Size])
+		buf = append([]byte{}, buf[len(buf)-sha1.Size:]...)
+	}
+	t.tail = buf
+	return len(p), nil
+}
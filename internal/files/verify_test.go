@@ -0,0 +1,46 @@
+package files
+
+import (
+	"archive/tar"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// truncate drops the last bytes of the file
+func truncate(t *testing.T, file string, n int64) {
+	fi, err := os.Stat(file)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(file, fi.Size()-n))
+}
+
+func TestVerifyArchiveDetectsTruncatedArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	repo, commits := setupRepo(t, "one", "two")
+	defer os.RemoveAll(repo)
+
+	zipFile := writeZip(t, dir, []zipEntry{{name: "a.txt", mode: 0644, content: "Hello World"}})
+	bundleFile := filepath.Join(dir, "test.bundle")
+	assert.NoError(t, NewGoGit().Bundle(context.Background(), repo, bundleFile, commits[1], nil))
+	archives := map[string]string{"zip": zipFile, "bundle": bundleFile}
+
+	for format, archive := range archives {
+		assert.NoError(t, VerifyArchive(archive), format)
+		truncate(t, archive, 10)
+		assert.True(t, IsArchiveError(VerifyArchive(archive)), format)
+	}
+
+	tarGz := writeTarGz(t, dir, func(tw *tar.Writer) {
+		tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0644, Size: 11, Typeflag: tar.TypeReg})
+		tw.Write([]byte("Hello World"))
+	})
+	assert.NoError(t, VerifyArchive(tarGz))
+	truncate(t, tarGz, 10)
+	assert.True(t, IsArchiveError(VerifyArchive(tarGz)))
+}
@@ -1,10 +1,14 @@
 package repository
 
 import (
+	"strings"
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/iantal/rm/internal/domain"
 	"github.com/iantal/rm/internal/util"
 	"github.com/jinzhu/gorm"
+	"golang.org/x/xerrors"
 )
 
 // ProjectDB defines the CRUD operations for storing projects in the db
@@ -15,7 +19,7 @@ type ProjectDB struct {
 
 // NewProjectDB returns a ProjectDB object for handling CRUD operations
 func NewProjectDB(log *util.StandardLogger, db *gorm.DB) *ProjectDB {
-	db.AutoMigrate(&domain.Project{})
+	db.AutoMigrate(&domain.Project{}, &domain.Pin{}, &domain.ThinBundle{})
 	return &ProjectDB{
 		log: log,
 		db:  db,
@@ -28,15 +32,42 @@ func (p *ProjectDB) AddProject(project *domain.Project) {
 	return
 }
 
-func (p *ProjectDB) UpdateProject(project *domain.Project) {
+// SaveBundle records the bundle of the commit of the project, adding the commit to the db
+// if it does not exist yet. The archives and the access time of an existing commit are
+// kept. It returns the commit as stored.
+func (p *ProjectDB) SaveBundle(project *domain.Project) (*domain.Project, error) {
 	ep := &domain.Project{}
-	p.db.Find(&ep, "project_id = ? and commit_hash = ?", project.ProjectID, project.CommitHash)
+	if p.db.Find(ep, "project_id = ? and commit_hash = ?", project.ProjectID, project.CommitHash).RecordNotFound() {
+		return project, p.db.Create(project).Error
+	}
+
+	err := p.db.Model(ep).Updates(map[string]interface{}{
+		"name":          project.Name,
+		"bundle_path":   project.BundlePath,
+		"bundle_digest": project.BundleDigest,
+		"bundle_size":   project.BundleSize,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	ep.Name = project.Name
+	ep.BundlePath = project.BundlePath
+	ep.BundleDigest = project.BundleDigest
+	ep.BundleSize = project.BundleSize
+	return ep, nil
+}
 
-	if ep != nil {
-		p.db.Save(&ep)
-	} else {
-		p.AddProject(project)
+// SaveArchive records the archive of the commit of the project in the given format, the
+// other columns of the commit are kept
+func (p *ProjectDB) SaveArchive(project *domain.Project, format string) error {
+	a := project.Archive(format)
+	if a == nil {
+		return xerrors.Errorf("unsupported archive format %q", format)
 	}
+	prefix := strings.Replace(format, ".", "_", -1) + "_archive_"
+	return p.db.Model(&domain.Project{}).
+		Where("project_id = ? AND commit_hash = ?", project.ProjectID, project.CommitHash).
+		Updates(map[string]interface{}{prefix + "path": a.Path, prefix + "size": a.Size, prefix + "digest": a.Digest}).Error
 }
 
 // GetProjects returns all existing projects in the db
@@ -75,3 +106,205 @@ func (p *ProjectDB) GetProjectByIDAndCommit(id, commit string) *domain.Project {
 	}
 	return nil
 }
+
+// projectSummaryColumns aggregates the commits of a project into a domain.ProjectSummary
+const projectSummaryColumns = "project_id, max(name) as name, count(*) as commits, " +
+	"min(created_at) as created_at, max(last_accessed_at) as last_accessed_at"
+
+// ListProjects returns a page of the projects whose name contains the given text,
+// ordered by name, and the number of such projects
+func (p *ProjectDB) ListProjects(name string, offset, limit int) ([]*domain.ProjectSummary, int, error) {
+	q := p.db.Model(&domain.Project{})
+	if name != "" {
+		// the filter is a plain substring, LIKE wildcards are escaped
+		escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(strings.ToLower(name))
+		q = q.Where("lower(name) LIKE ? ESCAPE '\\'", "%"+escaped+"%")
+	}
+
+	var total int
+	if err := q.Select("count(distinct project_id)").Row().Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	summaries := []*domain.ProjectSummary{}
+	err := q.Select(projectSummaryColumns).
+		Group("project_id").
+		Order("name, project_id").
+		Offset(offset).
+		Limit(limit).
+		Scan(&summaries).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return summaries, total, nil
+}
+
+// GetProjectSummary returns the project with the given id across its commits or nil if not found
+func (p *ProjectDB) GetProjectSummary(id string) (*domain.ProjectSummary, error) {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return nil, nil
+	}
+
+	summaries := []*domain.ProjectSummary{}
+	err = p.db.Model(&domain.Project{}).
+		Select(projectSummaryColumns).
+		Where("project_id = ?", uid).
+		Group("project_id").
+		Scan(&summaries).Error
+	if err != nil || len(summaries) == 0 {
+		return nil, err
+	}
+	return summaries[0], nil
+}
+
+// GetProjectCommits returns the commits of the project with the given id, most recent first
+func (p *ProjectDB) GetProjectCommits(id string) ([]*domain.Project, error) {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return nil, nil
+	}
+
+	var projects []*domain.Project
+	err = p.db.Where("project_id = ?", uid).Order("created_at desc").Find(&projects).Error
+	return projects, err
+}
+
+// SetLastAccessed records when the commit of the project was last served, the time the
+// project was updated at is left unchanged
+func (p *ProjectDB) SetLastAccessed(project *domain.Project, t time.Time) error {
+	return p.db.Model(&domain.Project{}).
+		Where("project_id = ? AND commit_hash = ?", project.ProjectID, project.CommitHash).
+		UpdateColumn("last_accessed_at", t).Error
+}
+
+// ClearBundle forgets the bundle of the commit of the project, the commit and its archives
+// are kept
+func (p *ProjectDB) ClearBundle(project *domain.Project) error {
+	return p.db.Model(&domain.Project{}).
+		Where("project_id = ? AND commit_hash = ?", project.ProjectID, project.CommitHash).
+		UpdateColumns(map[string]interface{}{"bundle_path": "", "bundle_digest": "", "bundle_size": 0}).Error
+}
+
+// DeleteProjectCommit soft deletes the commit of the project with the given id and its
+// thin bundles
+func (p *ProjectDB) DeleteProjectCommit(id, commit string) error {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return err
+	}
+	if err := p.db.Where("project_id = ? AND commit_hash = ?", uid, commit).Delete(&domain.ThinBundle{}).Error; err != nil {
+		return err
+	}
+	return p.db.Where("project_id = ? AND commit_hash = ?", uid, commit).Delete(&domain.Project{}).Error
+}
+
+// DeleteProject soft deletes every commit of the project with the given id and their
+// thin bundles
+func (p *ProjectDB) DeleteProject(id string) error {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return err
+	}
+	if err := p.db.Where("project_id = ?", uid).Delete(&domain.ThinBundle{}).Error; err != nil {
+		return err
+	}
+	return p.db.Where("project_id = ?", uid).Delete(&domain.Project{}).Error
+}
+
+// GetThinBundle returns the thin bundle of the commit of the project for the given haves,
+// or nil when it was not built
+func (p *ProjectDB) GetThinBundle(project *domain.Project, haves string) *domain.ThinBundle {
+	b := &domain.ThinBundle{}
+	if p.db.Find(b, "project_id = ? AND commit_hash = ? AND haves = ?", project.ProjectID, project.CommitHash, haves).RecordNotFound() {
+		return nil
+	}
+	return b
+}
+
+// SaveThinBundle records a thin bundle, replacing the one recorded for the same haves
+func (p *ProjectDB) SaveThinBundle(b *domain.ThinBundle) error {
+	existing := &domain.ThinBundle{}
+	if p.db.Find(existing, "project_id = ? AND commit_hash = ? AND haves = ?", b.ProjectID, b.CommitHash, b.Haves).RecordNotFound() {
+		return p.db.Create(b).Error
+	}
+	b.Model = existing.Model
+	return p.db.Model(existing).Updates(map[string]interface{}{"digest": b.Digest, "size": b.Size}).Error
+}
+
+// GetThinBundles returns the thin bundles of the commit of the project with the given id,
+// or of all its commits when commit is empty
+func (p *ProjectDB) GetThinBundles(id, commit string) ([]*domain.ThinBundle, error) {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+	q := p.db.Where("project_id = ?", uid)
+	if commit != "" {
+		q = q.Where("commit_hash = ?", commit)
+	}
+	var bundles []*domain.ThinBundle
+	err = q.Find(&bundles).Error
+	return bundles, err
+}
+
+// DeleteThinBundles soft deletes the thin bundles of the commit of the project
+func (p *ProjectDB) DeleteThinBundles(project *domain.Project) error {
+	return p.db.Where("project_id = ? AND commit_hash = ?", project.ProjectID, project.CommitHash).
+		Delete(&domain.ThinBundle{}).Error
+}
+
+// CountDigestReferences returns the number of commits whose bundle or archives have the
+// content with the given digest, and of thin bundles with that content
+func (p *ProjectDB) CountDigestReferences(digest string) (int, error) {
+	var n, thin int
+	err := p.db.Model(&domain.Project{}).
+		Where("bundle_digest = ? OR zip_archive_digest = ? OR tar_gz_archive_digest = ?", digest, digest, digest).
+		Count(&n).Error
+	if err != nil {
+		return 0, err
+	}
+	err = p.db.Model(&domain.ThinBundle{}).Where("digest = ?", digest).Count(&thin).Error
+	return n + thin, err
+}
+
+// GetEvictableCommits returns the commits of every project, least recently accessed first.
+// Commits never accessed are ordered by their creation.
+func (p *ProjectDB) GetEvictableCommits() ([]*domain.Project, error) {
+	var projects []*domain.Project
+	err := p.db.Order("coalesce(last_accessed_at, created_at)").Find(&projects).Error
+	return projects, err
+}
+
+// Pin protects the project with the given id from eviction
+func (p *ProjectDB) Pin(id string) error {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return err
+	}
+	pin := &domain.Pin{}
+	return p.db.Where(domain.Pin{ProjectID: uid}).FirstOrCreate(pin).Error
+}
+
+// Unpin lets the project with the given id be evicted again
+func (p *ProjectDB) Unpin(id string) error {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return err
+	}
+	return p.db.Unscoped().Where("project_id = ?", uid).Delete(&domain.Pin{}).Error
+}
+
+// GetPinnedProjects returns the ids of the pinned projects
+func (p *ProjectDB) GetPinnedProjects() (map[string]bool, error) {
+	var pins []*domain.Pin
+	if err := p.db.Find(&pins).Error; err != nil {
+		return nil, err
+	}
+
+	pinned := map[string]bool{}
+	for _, pin := range pins {
+		pinned[pin.ProjectID.String()] = true
+	}
+	return pinned, nil
+}
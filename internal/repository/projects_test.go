@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/repository/repositorytest"
+	"github.com/iantal/rm/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveBundleKeepsArchivesAndAccessTime(t *testing.T) {
+	db := NewProjectDB(util.NewLogger(), repositorytest.NewDB(t))
+	id := uuid.New()
+
+	p := domain.NewProject(id, "c1", "project", "", "bundle-1")
+	p.BundleDigest = "sha256/1"
+	p.BundleSize = 10
+	saved, err := db.SaveBundle(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "bundle-1", saved.BundlePath)
+
+	saved.ZipArchive = domain.Archive{Path: "sha256/zip", Size: 5, Digest: "zip"}
+	assert.NoError(t, db.SaveArchive(saved, "zip"))
+	accessed := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.NoError(t, db.SetLastAccessed(saved, accessed))
+
+	p = domain.NewProject(id, "c1", "renamed", "", "bundle-2")
+	p.BundleDigest = "sha256/2"
+	p.BundleSize = 20
+	saved, err = db.SaveBundle(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "renamed", saved.Name)
+	assert.Equal(t, domain.Archive{Path: "sha256/zip", Size: 5, Digest: "zip"}, saved.ZipArchive)
+
+	stored := db.GetProjectByIDAndCommit(id.String(), "c1")
+	if assert.NotNil(t, stored) {
+		assert.Equal(t, "bundle-2", stored.BundlePath)
+		assert.Equal(t, "sha256/2", stored.BundleDigest)
+		assert.Equal(t, int64(20), stored.BundleSize)
+		assert.Equal(t, domain.Archive{Path: "sha256/zip", Size: 5, Digest: "zip"}, stored.ZipArchive)
+		if assert.NotNil(t, stored.LastAccessedAt) {
+			assert.True(t, accessed.Equal(*stored.LastAccessedAt))
+		}
+	}
+
+	n, err := db.CountDigestReferences("zip")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestSaveArchiveRejectsUnknownFormats(t *testing.T) {
+	db := NewProjectDB(util.NewLogger(), repositorytest.NewDB(t))
+	assert.Error(t, db.SaveArchive(domain.NewProject(uuid.New(), "c1", "project", "", ""), "rar"))
+}
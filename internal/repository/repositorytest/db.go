@@ -0,0 +1,100 @@
+// Package repositorytest provides databases for tests
+package repositorytest
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite" // sqlite
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	sql.Register(driverName, timesDriver{&sqlite3.SQLiteDriver{}})
+}
+
+// driverName is the sqlite driver which returns times aggregated by queries as times
+const driverName = "sqlite3_times"
+
+// NewDB opens an empty in-memory database which is closed at the end of the test. The
+// tables are created by the constructors of the repository.
+func NewDB(t *testing.T) *gorm.DB {
+	conn, err := sql.Open(driverName, ":memory:")
+	if err != nil {
+		t.Fatalf("Unable to open database: %v", err)
+	}
+	// every connection to :memory: has a database of its own
+	conn.SetMaxOpenConns(1)
+
+	db, err := gorm.Open("sqlite3", conn)
+	if err != nil {
+		t.Fatalf("Unable to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// timesDriver is a sqlite driver returning the values of the columns named like times,
+// which sqlite returns as text once aggregated, as times as postgres does
+type timesDriver struct {
+	driver.Driver
+}
+
+func (d timesDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return timesConn{c}, nil
+}
+
+type timesConn struct {
+	driver.Conn
+}
+
+func (c timesConn) Prepare(query string) (driver.Stmt, error) {
+	s, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return timesStmt{s}, nil
+}
+
+type timesStmt struct {
+	driver.Stmt
+}
+
+func (s timesStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, err := s.Stmt.Query(args)
+	if err != nil {
+		return nil, err
+	}
+	return timesRows{rows}, nil
+}
+
+type timesRows struct {
+	driver.Rows
+}
+
+func (r timesRows) Next(dest []driver.Value) error {
+	if err := r.Rows.Next(dest); err != nil {
+		return err
+	}
+	for i, column := range r.Columns() {
+		s, ok := dest[i].(string)
+		if !ok || !strings.HasSuffix(column, "_at") {
+			continue
+		}
+		for _, format := range sqlite3.SQLiteTimestampFormats {
+			if t, err := time.Parse(format, s); err == nil {
+				dest[i] = t
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"github.com/google/uuid"
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/util"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/xerrors"
+)
+
+// DownloadStatusDB persists the state machine of the bundle preparation jobs
+type DownloadStatusDB struct {
+	log *util.StandardLogger
+	db  *gorm.DB
+}
+
+// NewDownloadStatusDB returns a DownloadStatusDB object for handling the job states
+func NewDownloadStatusDB(log *util.StandardLogger, db *gorm.DB) *DownloadStatusDB {
+	db.AutoMigrate(&domain.DownloadStatus{})
+	return &DownloadStatusDB{
+		log: log,
+		db:  db,
+	}
+}
+
+// AddDownloadStatus adds a new job to the db
+func (d *DownloadStatusDB) AddDownloadStatus(status *domain.DownloadStatus) error {
+	if err := d.db.Create(status).Error; err != nil {
+		return xerrors.Errorf("Unable to add download status: %w", err)
+	}
+	return nil
+}
+
+// SetState moves the job to the given state and persists it. The cause is
+// recorded on the job when it fails.
+func (d *DownloadStatusDB) SetState(status *domain.DownloadStatus, state domain.DownloadState, cause error) error {
+	if err := status.Transition(state); err != nil {
+		return err
+	}
+	if cause != nil {
+		status.Error = cause.Error()
+	}
+	if err := d.db.Save(status).Error; err != nil {
+		return xerrors.Errorf("Unable to update download status: %w", err)
+	}
+	return nil
+}
+
+// GetDownloadStatus returns the job with the given id or nil if not found
+func (d *DownloadStatusDB) GetDownloadStatus(id string) *domain.DownloadStatus {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		d.log.WithField("uuid", id).Error("Cannot parse uuid")
+		return nil
+	}
+	status := &domain.DownloadStatus{}
+	if d.db.Where("job_id = ?", uid).First(status).RecordNotFound() {
+		return nil
+	}
+	return status
+}
+
+// GetActiveDownloadStatus returns the unfinished job for the given project and commit or nil if there is none
+func (d *DownloadStatusDB) GetActiveDownloadStatus(projectID, commit string) *domain.DownloadStatus {
+	status := &domain.DownloadStatus{}
+	err := d.db.Where("project_id = ? AND commit_hash = ? AND state NOT IN (?)", projectID, commit, terminalStates()).
+		Order("created_at desc").
+		First(status).Error
+	if err != nil {
+		return nil
+	}
+	return status
+}
+
+// GetLatestDownloadStatus returns the most recent job for the given project and commit or nil if there is none
+func (d *DownloadStatusDB) GetLatestDownloadStatus(projectID, commit string) *domain.DownloadStatus {
+	status := &domain.DownloadStatus{}
+	err := d.db.Where("project_id = ? AND commit_hash = ?", projectID, commit).
+		Order("created_at desc").
+		First(status).Error
+	if err != nil {
+		return nil
+	}
+	return status
+}
+
+// GetUnfinishedDownloadStatuses returns all jobs which did not reach a terminal state
+func (d *DownloadStatusDB) GetUnfinishedDownloadStatuses() ([]*domain.DownloadStatus, error) {
+	var statuses []*domain.DownloadStatus
+	if err := d.db.Where("state NOT IN (?)", terminalStates()).Find(&statuses).Error; err != nil {
+		return nil, xerrors.Errorf("Unable to get unfinished download statuses: %w", err)
+	}
+	return statuses, nil
+}
+
+func terminalStates() []domain.DownloadState {
+	return []domain.DownloadState{domain.StateReady, domain.StateFailed}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/iantal/rm/internal/files"
+	"github.com/iantal/rm/internal/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// Tree returns the entries of a directory at a specific commit as JSON, read from the
+// extracted repository of the project. The repository is extracted first if needed.
+func (p *Projects) Tree(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["id"]
+
+	p.withRepository(rw, projectID, func(projectName string) {
+		p.resolveInRepository(rw, r, projectID, projectName, vars["commit"], func(commit string) {
+			entries, err := p.repositoryManager.Tree(r.Context(), projectID, projectName, commit, vars["path"])
+			if err != nil {
+				p.browseError(rw, projectID, commit, vars["path"], err)
+				return
+			}
+
+			rw.Header().Set("Content-Type", "application/json")
+			util.ToJSON(entries, rw)
+		})
+	})
+}
+
+// Blob streams the raw contents of a file at a specific commit, read from the extracted
+// repository of the project. The repository is extracted first if needed.
+func (p *Projects) Blob(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["id"]
+
+	p.withRepository(rw, projectID, func(projectName string) {
+		p.resolveInRepository(rw, r, projectID, projectName, vars["commit"], func(commit string) {
+			rc, size, err := p.repositoryManager.Blob(r.Context(), projectID, projectName, commit, vars["path"])
+			if err != nil {
+				p.browseError(rw, projectID, commit, vars["path"], err)
+				return
+			}
+			defer rc.Close()
+
+			// the content type is guessed from the extension, then from the contents
+			br := bufio.NewReaderSize(rc, 512)
+			contentType := mime.TypeByExtension(path.Ext(vars["path"]))
+			if contentType == "" {
+				header, _ := br.Peek(512)
+				contentType = http.DetectContentType(header)
+			}
+			if activeContent(contentType) {
+				contentType = "text/plain; charset=utf-8"
+			}
+
+			// files of repositories are never run as pages of rm
+			rw.Header().Set("Content-Type", contentType)
+			rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			rw.Header().Set("X-Content-Type-Options", "nosniff")
+			rw.Header().Set("Content-Security-Policy", "sandbox")
+			if _, err := io.Copy(rw, br); err != nil {
+				p.l.WithFields(logrus.Fields{
+					"projectID": projectID,
+					"commit":    commit,
+					"path":      vars["path"],
+					"error":     err,
+				}).Error("Unable to send blob")
+			}
+		})
+	})
+}
+
+// activeContentTypes are the media types browsers run scripts of
+var activeContentTypes = map[string]bool{
+	"text/html":              true,
+	"application/xhtml+xml":  true,
+	"image/svg+xml":          true,
+	"text/xml":               true,
+	"application/xml":        true,
+	"text/javascript":        true,
+	"application/javascript": true,
+}
+
+// activeContent reports whether the content type is one browsers may run scripts of
+func activeContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err != nil || activeContentTypes[strings.ToLower(mediaType)]
+}
+
+// browseError responds to a failure to read the tree of a commit
+func (p *Projects) browseError(rw http.ResponseWriter, projectID, commit, path string, err error) {
+	for _, e := range []error{files.ErrPathNotFound, files.ErrNotADirectory, files.ErrNotAFile} {
+		if xerrors.Is(err, e) {
+			writeError(rw, http.StatusNotFound, CodeNotFound, e.Error())
+			return
+		}
+	}
+
+	p.failed(rw, err, "Unable to read tree", logrus.Fields{
+		"projectID": projectID,
+		"commit":    commit,
+		"path":      path,
+	})
+}
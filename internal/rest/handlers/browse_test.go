@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActiveContentIsDetected(t *testing.T) {
+	for contentType, active := range map[string]bool{
+		"text/html; charset=utf-8":  true,
+		"image/svg+xml":             true,
+		"TEXT/HTML":                 true,
+		"application/xhtml+xml":     true,
+		"invalid;;":                 true,
+		"text/plain; charset=utf-8": false,
+		"image/png":                 false,
+		"application/octet-stream":  false,
+	} {
+		assert.Equal(t, active, activeContent(contentType), contentType)
+	}
+}
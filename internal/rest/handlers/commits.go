@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/iantal/rm/internal/service"
+	"github.com/iantal/rm/internal/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// Commits returns a page of the history of a project as JSON, most recent commits first.
+// The history can be limited with ref=, path=, since= and until= (RFC 3339), the page
+// size with limit=. The next page is requested with the cursor= returned as next.
+func (p *Projects) Commits(rw http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	q := service.LogQuery{
+		Ref:    query.Get("ref"),
+		Path:   query.Get("path"),
+		Cursor: query.Get("cursor"),
+	}
+	var err error
+	if l := query.Get("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit <= 0 {
+			badRequest(rw, "Invalid limit")
+			return
+		}
+	}
+	if s := query.Get("since"); s != "" {
+		if q.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			badRequest(rw, "Invalid since, expected an RFC 3339 date")
+			return
+		}
+	}
+	if u := query.Get("until"); u != "" {
+		if q.Until, err = time.Parse(time.RFC3339, u); err != nil {
+			badRequest(rw, "Invalid until, expected an RFC 3339 date")
+			return
+		}
+	}
+
+	p.withRepository(rw, projectID, func(projectName string) {
+		page, err := p.repositoryManager.Log(r.Context(), projectID, projectName, q)
+		if err != nil {
+			p.commitError(rw, projectID, err)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		util.ToJSON(page, rw)
+	})
+}
+
+// Commit returns the metadata of a single commit of a project as JSON
+func (p *Projects) Commit(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["id"]
+
+	p.withRepository(rw, projectID, func(projectName string) {
+		commit, err := p.repositoryManager.Commit(r.Context(), projectID, projectName, vars["commit"])
+		if err != nil {
+			p.commitError(rw, projectID, err)
+			return
+		}
+
+		rw.Header().Set(ResolvedCommitHeader, commit.SHA)
+		rw.Header().Set("Content-Type", "application/json")
+		util.ToJSON(commit, rw)
+	})
+}
+
+// commitError responds to a failure to read the history of a project
+func (p *Projects) commitError(rw http.ResponseWriter, projectID string, err error) {
+	switch {
+	case xerrors.Is(err, service.ErrInvalidCursor):
+		badRequest(rw, err.Error())
+	default:
+		p.failed(rw, err, "Unable to read history", logrus.Fields{"projectID": projectID})
+	}
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/iantal/rm/internal/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Compare returns the files changed on head since it diverged from base as JSON, for a
+// {base}...{head} range of commits, branches or tags. With format=patch the unified diff
+// is streamed instead.
+func (p *Projects) Compare(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["id"]
+
+	refs := strings.SplitN(vars["range"], "...", 2)
+	if len(refs) != 2 || refs[0] == "" || refs[1] == "" {
+		badRequest(rw, "Expected a {base}...{head} range")
+		return
+	}
+	base, head := refs[0], refs[1]
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "patch" {
+		badRequest(rw, "Unsupported format")
+		return
+	}
+
+	p.withRepository(rw, projectID, func(projectName string) {
+		if format == "patch" {
+			w := &trackingWriter{w: rw}
+			rw.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+			err := p.repositoryManager.ComparePatch(r.Context(), projectID, projectName, base, head, w)
+			if err != nil && !w.written {
+				p.commitError(rw, projectID, err)
+			} else if err != nil {
+				p.l.WithFields(logrus.Fields{
+					"projectID": projectID,
+					"base":      base,
+					"head":      head,
+					"error":     err,
+				}).Error("Unable to send patch")
+			}
+			return
+		}
+
+		c, err := p.repositoryManager.Compare(r.Context(), projectID, projectName, base, head)
+		if err != nil {
+			p.commitError(rw, projectID, err)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		util.ToJSON(c, rw)
+	})
+}
+
+// trackingWriter records whether anything was written, after which the status of the
+// response cannot change anymore
+type trackingWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	t.written = true
+	return t.w.Write(p)
+}
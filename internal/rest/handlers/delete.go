@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// DeleteCommit removes the bundle and the archives of a specific commit
+func (p *Projects) DeleteCommit(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	p.deleted(rw, vars["id"], p.repositoryManager.DeleteCommit(vars["id"], vars["commit"]))
+}
+
+// Delete removes everything rm holds for a project
+func (p *Projects) Delete(rw http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["id"]
+	p.deleted(rw, projectID, p.repositoryManager.DeleteProject(projectID))
+}
+
+func (p *Projects) deleted(rw http.ResponseWriter, projectID string, err error) {
+	if err == nil {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	p.failed(rw, err, "Unable to delete", logrus.Fields{"projectID": projectID})
+}
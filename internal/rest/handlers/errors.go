@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/iantal/rm/internal/service"
+	"github.com/iantal/rm/internal/util"
+	"github.com/sirupsen/logrus"
+)
+
+// GenericError represents an error of the system. Clients branch on the code, which does
+// not change between versions, the message is meant for humans. The request ID is the one
+// of the RequestIDHeader, to be quoted when reporting the error.
+type GenericError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Codes of the errors which are not failures of the repository manager, whose codes are
+// the ones of the service package
+const (
+	CodeBadRequest = "bad_request"
+	CodeNotFound   = "not_found"
+	CodeQueueFull  = "queue_full"
+	CodeInternal   = "internal"
+)
+
+// codeStatus is the status of the responses to the failures of the repository manager
+var codeStatus = map[string]int{
+	service.CodeProjectNotFound:     http.StatusNotFound,
+	service.CodeCommitNotFound:      http.StatusNotFound,
+	service.CodeUpstreamUnavailable: http.StatusBadGateway,
+	service.CodeArchiveInvalid:      http.StatusUnprocessableEntity,
+	service.CodeStorageFull:         http.StatusInsufficientStorage,
+}
+
+// RequestIDHeader carries the ID of a request, taken from the client when it sets one
+const RequestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[0-9A-Za-z._:-]{1,128}$`)
+
+// RequestID is a middleware giving each request an ID, which is sent back in the
+// RequestIDHeader and in the body of errors
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.New().String()
+		}
+		rw.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// writeError responds with the status and an error of the given code
+func writeError(rw http.ResponseWriter, status int, code, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	util.ToJSON(&GenericError{Code: code, Message: message, RequestID: rw.Header().Get(RequestIDHeader)}, rw)
+}
+
+func badRequest(rw http.ResponseWriter, message string) {
+	writeError(rw, http.StatusBadRequest, CodeBadRequest, message)
+}
+
+// failed responds to a failure of the repository manager, which is logged with fields and
+// the request ID. Failures of a known kind get the status, the code and the message of their
+// kind, which do not tell the internals of rm. Others are answered with 500 and message.
+func (p *Projects) failed(rw http.ResponseWriter, err error, message string, fields logrus.Fields) {
+	fields["error"] = err
+	fields["requestId"] = rw.Header().Get(RequestIDHeader)
+	if kind := service.KindOf(err); kind != nil {
+		code := service.ErrorCode(kind)
+		fields["code"] = code
+		p.l.WithFields(fields).Warn(message)
+		writeError(rw, codeStatus[code], code, kind.Error())
+		return
+	}
+
+	p.l.WithFields(fields).Error(message)
+	writeError(rw, http.StatusInternalServerError, CodeInternal, message)
+}
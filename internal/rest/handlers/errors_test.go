@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iantal/rm/internal/service"
+	"github.com/iantal/rm/internal/util"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestFailedLogsEveryErrorWithTheRequestID(t *testing.T) {
+	l := util.NewLogger()
+	hook := test.NewLocal(l.Logger)
+	p := &Projects{l: l}
+
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+		level  logrus.Level
+	}{
+		{xerrors.Errorf("rk: %w", service.ErrUpstreamUnavailable), http.StatusBadGateway, service.CodeUpstreamUnavailable, logrus.WarnLevel},
+		{errors.New("disk on fire"), http.StatusInternalServerError, CodeInternal, logrus.ErrorLevel},
+	} {
+		hook.Reset()
+		rw := httptest.NewRecorder()
+		rw.Header().Set(RequestIDHeader, "req-1")
+		p.failed(rw, tc.err, "Unable to bundle commit", logrus.Fields{"projectID": "p1"})
+
+		assert.Equal(t, tc.status, rw.Code)
+		body := &GenericError{}
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(body))
+		assert.Equal(t, tc.code, body.Code)
+		assert.Equal(t, "req-1", body.RequestID)
+
+		if assert.Len(t, hook.Entries, 1) {
+			e := hook.LastEntry()
+			assert.Equal(t, tc.level, e.Level)
+			assert.Equal(t, "Unable to bundle commit", e.Message)
+			assert.Equal(t, "req-1", e.Data["requestId"])
+			assert.Equal(t, "p1", e.Data["projectID"])
+			assert.Equal(t, tc.err, e.Data["error"])
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/iantal/rm/internal/service"
+	"github.com/iantal/rm/internal/util"
+	"github.com/sirupsen/logrus"
+)
+
+// List returns a page of the projects held by rm as JSON. The projects can be filtered
+// with name=, paginated with offset= and limit=.
+func (p *Projects) List(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var offset, limit int
+	var err error
+	if o := query.Get("offset"); o != "" {
+		if offset, err = strconv.Atoi(o); err != nil || offset < 0 {
+			badRequest(rw, "Invalid offset")
+			return
+		}
+	}
+	if l := query.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			badRequest(rw, "Invalid limit")
+			return
+		}
+	}
+
+	page, err := p.repositoryManager.ListProjects(query.Get("name"), offset, limit)
+	if err != nil {
+		p.inventoryError(rw, "", err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	util.ToJSON(page, rw)
+}
+
+// Get returns a project with the number of its cached commits as JSON
+func (p *Projects) Get(rw http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["id"]
+
+	project, err := p.repositoryManager.GetProject(projectID)
+	if err != nil {
+		p.inventoryError(rw, projectID, err)
+		return
+	}
+
+	if project == nil {
+		writeError(rw, http.StatusNotFound, service.CodeProjectNotFound, service.ErrProjectNotFound.Error())
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	util.ToJSON(project, rw)
+}
+
+// CachedCommits returns the commits of a project whose bundle is on disk as JSON
+func (p *Projects) CachedCommits(rw http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["id"]
+
+	commits, err := p.repositoryManager.CachedCommits(projectID)
+	if err != nil {
+		p.inventoryError(rw, projectID, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	util.ToJSON(commits, rw)
+}
+
+// Pin protects the files of a project from the garbage collector
+func (p *Projects) Pin(rw http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["id"]
+	if err := p.repositoryManager.Pin(projectID); err != nil {
+		p.inventoryError(rw, projectID, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Unpin lets the garbage collector evict the files of a project again
+func (p *Projects) Unpin(rw http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["id"]
+	if err := p.repositoryManager.Unpin(projectID); err != nil {
+		p.inventoryError(rw, projectID, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Projects) inventoryError(rw http.ResponseWriter, projectID string, err error) {
+	p.failed(rw, err, "Unable to read projects", logrus.Fields{"projectID": projectID})
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/files"
+	"github.com/iantal/rm/internal/repository"
+	"github.com/iantal/rm/internal/repository/repositorytest"
+	"github.com/iantal/rm/internal/service"
+	"github.com/iantal/rm/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupProjects(t *testing.T) (*Projects, *repository.ProjectDB) {
+	db := repositorytest.NewDB(t)
+	l := util.NewLogger()
+	projects := repository.NewProjectDB(l, db)
+	rm := service.NewRepositoryManager(l, files.NewMemory(), nil, projects, repository.NewDownloadStatusDB(l, db), nil)
+	return NewProjects(l, rm), projects
+}
+
+func listProjects(t *testing.T, p *Projects, query string) (*httptest.ResponseRecorder, *service.ProjectsPage) {
+	rw := httptest.NewRecorder()
+	p.List(rw, httptest.NewRequest(http.MethodGet, "/api/v1/projects?"+query, nil))
+	page := &service.ProjectsPage{}
+	if rw.Code == http.StatusOK {
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(page))
+	}
+	return rw, page
+}
+
+func names(page *service.ProjectsPage) []string {
+	names := []string{}
+	for _, p := range page.Projects {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func TestListProjectsPaginatesAndFilters(t *testing.T) {
+	p, db := setupProjects(t)
+	for _, name := range []string{"alpha", "beta", "gamma", "100%_done", "100 done", "a_b", "axb"} {
+		id := uuid.New()
+		db.SaveBundle(domain.NewProject(id, "c1", name, "", ""))
+		db.SaveBundle(domain.NewProject(id, "c2", name, "", ""))
+	}
+
+	rw, page := listProjects(t, p, "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 7, page.Total)
+	assert.Equal(t, service.DefaultProjectsLimit, page.Limit)
+	assert.Equal(t, []string{"100 done", "100%_done", "a_b", "alpha", "axb", "beta", "gamma"}, names(page))
+	assert.Equal(t, 2, page.Projects[0].Commits)
+	assert.False(t, page.Projects[0].CreatedAt.IsZero())
+
+	_, page = listProjects(t, p, "offset=2&limit=2")
+	assert.Equal(t, 7, page.Total)
+	assert.Equal(t, []string{"a_b", "alpha"}, names(page))
+
+	_, page = listProjects(t, p, "offset=10")
+	assert.Equal(t, 7, page.Total)
+	assert.Empty(t, page.Projects)
+
+	_, page = listProjects(t, p, "limit=100000")
+	assert.Equal(t, service.MaxProjectsLimit, page.Limit)
+
+	// the name is matched case insensitively as a substring, wildcards match themselves
+	for query, expected := range map[string][]string{
+		"name=A":       {"a_b", "alpha", "axb", "beta", "gamma"},
+		"name=%25":     {"100%_done"},
+		"name=_":       {"100%_done", "a_b"},
+		"name=a_":      {"a_b"},
+		"name=%25_":    {"100%_done"},
+		"name=missing": {},
+	} {
+		_, page = listProjects(t, p, query)
+		assert.Equal(t, expected, names(page), query)
+		assert.Equal(t, len(expected), page.Total, query)
+	}
+}
+
+func TestListProjectsRejectsInvalidParameters(t *testing.T) {
+	p, _ := setupProjects(t)
+	for _, query := range []string{"offset=-1", "offset=x", "limit=0", "limit=-5", "limit=x"} {
+		rw, _ := listProjects(t, p, query)
+		assert.Equal(t, http.StatusBadRequest, rw.Code, query)
+
+		e := &GenericError{}
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(e))
+		assert.Equal(t, CodeBadRequest, e.Code, query)
+	}
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/iantal/rm/internal/service"
+	"github.com/iantal/rm/internal/util"
+)
+
+// Jobs is a handler for reading the status of the bundle preparation jobs
+type Jobs struct {
+	l                 *util.StandardLogger
+	repositoryManager *service.RepositoryManager
+}
+
+// NewJobs creates a handler for jobs
+func NewJobs(log *util.StandardLogger, rm *service.RepositoryManager) *Jobs {
+	return &Jobs{
+		l:                 log,
+		repositoryManager: rm,
+	}
+}
+
+// Get returns the status of the job with the given id
+func (j *Jobs) Get(rw http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+
+	job := j.repositoryManager.GetJob(jobID)
+	if job == nil {
+		writeError(rw, http.StatusNotFound, CodeNotFound, "Job not found")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	util.ToJSON(job, rw)
+}
@@ -1,14 +1,21 @@
 package handlers
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"io"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/iantal/rm/internal/domain"
 	"github.com/iantal/rm/internal/files"
-	"github.com/iantal/rm/internal/repository"
 	"github.com/iantal/rm/internal/service"
 	"github.com/iantal/rm/internal/util"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
 )
 
 // Projects is a handler for reading and writing projects to a storage and db
@@ -18,117 +25,292 @@ type Projects struct {
 }
 
 // NewProjects creates a handler for projects
-func NewProjects(log *util.StandardLogger, store files.Storage, db *repository.ProjectDB, rkHost string) *Projects {
-	rm := service.NewRepositoryManager(log, store, db, rkHost)
+func NewProjects(log *util.StandardLogger, rm *service.RepositoryManager) *Projects {
 	return &Projects{
 		l:                 log,
 		repositoryManager: rm,
 	}
 }
 
-// GenericError represents an error of the system
-type GenericError struct {
-	Message string `json:"message"`
-}
+// maxHaves is the maximum number of commits a client can announce to get a thin bundle
+const maxHaves = 64
 
-// Download handles the download process for a specific commit and provides the .bundle file as response or an error message
+// Download provides the .bundle file for a specific commit as response. If the bundle
+// is not ready yet its preparation is started and the job is returned with 202 Accepted.
+// Clients holding older commits pass them with since= or have= to get a bundle of the
+// missing history only. The commit may be a branch, a tag or an abbreviated hash.
 func (p *Projects) Download(rw http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	projectID := vars["id"]
-	commit := vars["commit"]
 
-	// 0. project with commit already exists
+	haves := r.URL.Query()["have"]
+	if since := r.URL.Query().Get("since"); since != "" {
+		haves = append(haves, since)
+	}
+	if len(haves) > maxHaves {
+		badRequest(rw, "Too many haves")
+		return
+	}
+
+	p.resolveCommit(rw, r, projectID, vars["commit"], func(commit string) {
+		p.download(rw, r, projectID, commit, haves)
+	})
+}
+
+func (p *Projects) download(rw http.ResponseWriter, r *http.Request, projectID, commit string, haves []string) {
 	if project := p.repositoryManager.GetProjectForCommit(projectID, commit); project != nil {
+		if p.repositoryManager.BundlesOnDemand() {
+			p.serveGeneratedBundle(rw, r, project, haves)
+			return
+		}
+
+		bundleKey, digest := project.BundlePath, project.BundleDigest
+		if len(haves) > 0 {
+			var err error
+			bundleKey, digest, err = p.repositoryManager.ThinBundle(r.Context(), project, haves)
+			if err != nil {
+				p.failed(rw, err, "Unable to bundle commit", logrus.Fields{
+					"projectID": projectID,
+					"commit":    commit,
+					"haves":     haves,
+				})
+				return
+			}
+		}
+
 		rw.Header().Set("Content-type", "application/octet-stream")
-		rw.Header().Set("Content-Disposition", "attachment; filename=\""+project.Name+".bundle\"")
-		http.ServeFile(rw, r, project.BundlePath)
+		p.serveFile(rw, r, project, bundleKey, digest, project.Name+".bundle")
 		return
 	}
 
-	// get projectName from rk
-	projectName, err := p.repositoryManager.GetProjectName(projectID)
+	p.notReady(rw, projectID, commit)
+}
+
+// serveGeneratedBundle generates the bundle of the commit of a project, leaving out the
+// history reachable from haves, and sends it as an attachment once it is complete
+func (p *Projects) serveGeneratedBundle(rw http.ResponseWriter, r *http.Request, project *domain.Project, haves []string) {
+	f, err := p.repositoryManager.OpenBundle(r.Context(), project, haves)
 	if err != nil {
-		p.l.WithFields(logrus.Fields{
-			"projectID": projectID,
-			"error":     err,
-		}).Error("Could not get project name")
-		rw.WriteHeader(http.StatusInternalServerError)
-		util.ToJSON(&GenericError{Message: "Project not found"}, rw)
+		p.failed(rw, err, "Unable to bundle commit", logrus.Fields{
+			"projectID": project.ProjectID,
+			"commit":    project.CommitHash,
+			"haves":     haves,
+		})
 		return
 	}
+	defer f.Close()
 
-	p.l.WithFields(logrus.Fields{
-		"projectID": projectID,
-		"projectName": projectName,
-	}).Info("Project name obtained from rk")
+	filename := project.Name + ".bundle"
+	rw.Header().Set("Content-type", "application/octet-stream")
+	rw.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	serveWhole(rw, r, filename, time.Time{}, f)
+	p.repositoryManager.MarkAccessed(project)
+}
 
-	// 1. is downloaded, just checkout the commit
-	if p.repositoryManager.IsDownloaded(projectID, projectName) {
-		p.l.WithFields(logrus.Fields{
-			"projectId": projectID,
-			"projectName": projectName,
-		}).Info("Performing checkout on already downloaded project")
-		err = p.repositoryManager.CheckoutCommit(commit, projectID, projectName)
+// archiveContentTypes are the content types of the snapshots served by Archive
+var archiveContentTypes = map[files.Format]string{
+	files.FormatZip:   "application/zip",
+	files.FormatTarGz: "application/gzip",
+}
+
+// Archive provides a snapshot of the files of a specific commit, without history, as zip
+// or tar.gz. Like Download it starts the preparation of the commit when it is not ready.
+func (p *Projects) Archive(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["id"]
+
+	format := files.Format(r.URL.Query().Get("format"))
+	if format == "" {
+		format = files.FormatZip
+	}
+	contentType, ok := archiveContentTypes[format]
+	if !ok {
+		badRequest(rw, "Unsupported archive format")
+		return
+	}
+
+	p.resolveCommit(rw, r, projectID, vars["commit"], func(commit string) {
+		project := p.repositoryManager.GetProjectForCommit(projectID, commit)
+		if project == nil {
+			p.notReady(rw, projectID, commit)
+			return
+		}
+
+		archive, err := p.repositoryManager.SourceArchive(r.Context(), project, format)
 		if err != nil {
-			p.l.WithFields(
-				logrus.Fields{
-					"projectID":   projectID,
-					"commit":      commit,
-					"projectName": projectName,
-					"error":       err,
-				}).Error("Unable to checkout")
-			rw.WriteHeader(http.StatusInternalServerError)
-			util.ToJSON(&GenericError{Message: "Project not found"}, rw)
+			p.failed(rw, err, "Unable to archive commit", logrus.Fields{
+				"projectID": projectID,
+				"commit":    commit,
+				"format":    format,
+			})
 			return
 		}
-		project := p.repositoryManager.SaveToDb(projectName, projectID, commit)
-		rw.Header().Set("Content-type", "application/octet-stream")
-		rw.Header().Set("Content-Disposition", "attachment; filename=\""+project.Name+".bundle\"")
-		http.ServeFile(rw, r, project.BundlePath)
+
+		rw.Header().Set("Content-type", contentType)
+		p.serveFile(rw, r, project, archive.Path, archive.Digest, project.Name+"."+string(format))
+	})
+}
+
+// serveFile sends a blob of the commit of a project as an attachment named filename, or
+// redirects to where the blob store serves it from. Blobs stored by content are tagged
+// with their digest, which the client can revalidate with or resume a range of the blob
+// against. A blob deleted since the project was looked up is prepared again.
+func (p *Projects) serveFile(rw http.ResponseWriter, r *http.Request, project *domain.Project, key, digest, filename string) {
+	projectID := project.ProjectID.String()
+	if notModified(rw, r, digest) {
+		p.repositoryManager.MarkAccessed(project)
+		return
+	}
+	if u := p.repositoryManager.PresignedURL(r.Context(), projectID, key, filename); u != "" {
+		p.repositoryManager.MarkAccessed(project)
+		http.Redirect(rw, r, u, http.StatusTemporaryRedirect)
 		return
 	}
 
-	// 2. not downloaded => download from rk
-	zipFile, err := p.repositoryManager.DownloadZip(projectID, projectName)
+	f, info, err := p.repositoryManager.OpenFile(r.Context(), projectID, key)
+	if xerrors.Is(err, os.ErrNotExist) {
+		p.notReady(rw, projectID, project.CommitHash)
+		return
+	}
 	if err != nil {
-		p.l.WithFields(logrus.Fields{
+		p.failed(rw, err, "Unable to open file", logrus.Fields{
 			"projectID": projectID,
-			"error":     err,
-		}).Error("Could not download project from rk")
-		rw.WriteHeader(http.StatusInternalServerError)
-		util.ToJSON(&GenericError{Message: "Project not found"}, rw)
+			"commit":    project.CommitHash,
+			"key":       key,
+		})
 		return
 	}
+	defer f.Close()
 
-	// 3. unzip
-	err = p.repositoryManager.ExtractZip(zipFile, projectID, projectName)
-	if err != nil {
+	rw.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	if digest == "" {
+		serveWhole(rw, r, filename, info.ModTime, f)
+	} else {
+		// ranges, If-Range and the other conditions are evaluated against the ETag
+		setDigest(rw, digest)
+		http.ServeContent(rw, r, filename, info.ModTime, f)
+	}
+	p.repositoryManager.MarkAccessed(project)
+}
+
+// serveWhole sends content without an ETag, such as bundles generated for the request,
+// as a whole. A range of it could not be told apart from a range of the content generated
+// again since, so ranges are neither offered nor honoured.
+func serveWhole(rw http.ResponseWriter, r *http.Request, name string, modtime time.Time, content io.ReadSeeker) {
+	r.Header.Del("Range")
+	r.Header.Del("If-Range")
+	http.ServeContent(wholeResponse{rw}, r, name, modtime, content)
+}
+
+// wholeResponse tells clients that ranges of the content are not served
+type wholeResponse struct {
+	http.ResponseWriter
+}
+
+func (w wholeResponse) WriteHeader(status int) {
+	w.Header().Set("Accept-Ranges", "none")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// setDigest sets the ETag and Digest headers of a blob stored by content from its
+// hex encoded SHA-256 digest
+func setDigest(rw http.ResponseWriter, digest string) {
+	sum, err := hex.DecodeString(digest)
+	if digest == "" || err != nil {
+		return
+	}
+	rw.Header().Set("ETag", "\""+digest+"\"")
+	rw.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+}
+
+// notModified answers a request with If-None-Match matching the ETag of a blob stored by
+// content with 304 Not Modified, so that blobs the client holds already are neither opened
+// nor redirected to
+func notModified(rw http.ResponseWriter, r *http.Request, digest string) bool {
+	inm := r.Header.Get("If-None-Match")
+	if digest == "" || inm == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	etag := "\"" + digest + "\""
+	for _, tag := range strings.Split(inm, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			rw.Header().Del("Content-Type")
+			setDigest(rw, digest)
+			rw.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// notReady answers a request for a commit which is not prepared yet: its preparation is
+// started, unless the archive of the project was rejected or the commit is unknown
+func (p *Projects) notReady(rw http.ResponseWriter, projectID, commit string) {
+	// a rejected archive is not retried implicitly, the client can retry through prepare,
+	// nor is a commit rk did not have until the project can be fetched again
+	if job := p.repositoryManager.GetLatestJob(projectID, commit); job != nil {
+		if job.ErrorCode == service.CodeArchiveInvalid || p.repositoryManager.CommitUnknown(job) {
+			writeError(rw, codeStatus[job.ErrorCode], job.ErrorCode, job.Error)
+			return
+		}
+	}
+
+	p.prepare(rw, projectID, commit)
+}
+
+// Prepare starts the preparation of the bundle for a specific commit and returns the job
+// tracking it with 202 Accepted, or redirects to the download if the bundle is ready.
+// Without a commit the project is only downloaded and extracted.
+func (p *Projects) Prepare(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["id"]
+
+	ref, ok := vars["commit"]
+	if !ok {
+		p.withRepository(rw, projectID, func(string) {
+			rw.WriteHeader(http.StatusNoContent)
+		})
+		return
+	}
+
+	p.resolveCommit(rw, r, projectID, ref, func(commit string) {
+		if project := p.repositoryManager.GetProjectForCommit(projectID, commit); project != nil {
+			rw.Header().Set("Location", "/api/v1/projects/"+projectID+"/"+commit+"/download")
+			rw.WriteHeader(http.StatusSeeOther)
+			return
+		}
+
+		p.prepare(rw, projectID, commit)
+	})
+}
+
+func (p *Projects) prepare(rw http.ResponseWriter, projectID, commit string) {
+	job, err := p.repositoryManager.Prepare(projectID, commit)
+	if err == service.ErrQueueFull {
 		p.l.WithFields(logrus.Fields{
 			"projectID": projectID,
-			"error":     err,
-		}).Error("Cannot extract zip file")
-		rw.WriteHeader(http.StatusInternalServerError)
-		util.ToJSON(&GenericError{Message: "Project not found"}, rw)
+			"commit":    commit,
+			"requestId": rw.Header().Get(RequestIDHeader),
+		}).Error("Preparation queue is full")
+		writeError(rw, http.StatusServiceUnavailable, CodeQueueFull, err.Error())
 		return
 	}
-
-	// 4. checkout commit
-	err = p.repositoryManager.CheckoutCommit(commit, projectID, projectName)
 	if err != nil {
-		p.l.WithFields(
-			logrus.Fields{
-				"projectID":   projectID,
-				"commit":      commit,
-				"projectName": projectName,
-				"error":       err,
-			}).Error("Unable to checkout")
-		rw.WriteHeader(http.StatusInternalServerError)
-		util.ToJSON(&GenericError{Message: "Project not found"}, rw)
+		p.failed(rw, err, "Unable to queue preparation job", logrus.Fields{
+			"projectID": projectID,
+			"commit":    commit,
+		})
 		return
 	}
-	
-	project := p.repositoryManager.SaveToDb(projectName, projectID, commit)
-	rw.Header().Set("Content-type", "application/octet-stream")
-	rw.Header().Set("Content-Disposition", "attachment; filename=\""+project.Name+".bundle\"")
-	http.ServeFile(rw, r, project.BundlePath)
+
+	writeAccepted(rw, job)
+}
+
+// writeAccepted responds with 202 Accepted pointing to the job status
+func writeAccepted(rw http.ResponseWriter, job *domain.DownloadStatus) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Location", "/api/v1/jobs/"+job.JobID.String())
+	rw.WriteHeader(http.StatusAccepted)
+	util.ToJSON(job, rw)
 }
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/files"
+	"github.com/iantal/rm/internal/repository"
+	"github.com/iantal/rm/internal/repository/repositorytest"
+	"github.com/iantal/rm/internal/service"
+	"github.com/iantal/rm/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+const bundleContent = "# v2 git bundle\nthe objects of the commit\n"
+
+// setupBundle returns a handler serving a project whose bundle is stored by content
+func setupBundle(t *testing.T) (*Projects, *domain.Project) {
+	db := repositorytest.NewDB(t)
+	l := util.NewLogger()
+	blobs := files.NewMemory()
+	projects := repository.NewProjectDB(l, db)
+	rm := service.NewRepositoryManager(l, blobs, nil, projects, repository.NewDownloadStatusDB(l, db), nil)
+
+	sum := sha256.Sum256([]byte(bundleContent))
+	project := domain.NewProject(uuid.New(), "c1", "project", "", "sha256/"+hex.EncodeToString(sum[:]))
+	project.BundleDigest = hex.EncodeToString(sum[:])
+	project.BundleSize = int64(len(bundleContent))
+	assert.NoError(t, blobs.Put(context.Background(), project.BundlePath, bytes.NewReader([]byte(bundleContent))))
+	_, err := projects.SaveBundle(project)
+	assert.NoError(t, err)
+	return NewProjects(l, rm), project
+}
+
+func serveBundle(p *Projects, project *domain.Project, digest string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/projects/"+project.ProjectID.String()+"/c1/download", nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	rw := httptest.NewRecorder()
+	p.serveFile(rw, r, project, project.BundlePath, digest, "project.bundle")
+	return rw
+}
+
+func TestServeFileRevalidatesAgainstTheDigest(t *testing.T) {
+	p, project := setupBundle(t)
+	etag := "\"" + project.BundleDigest + "\""
+
+	for _, inm := range []string{etag, "\"other\", " + etag, "W/" + etag, "*"} {
+		rw := serveBundle(p, project, project.BundleDigest, map[string]string{"If-None-Match": inm})
+		assert.Equal(t, http.StatusNotModified, rw.Code, inm)
+		assert.Equal(t, etag, rw.Header().Get("ETag"), inm)
+		assert.Empty(t, rw.Body.String(), inm)
+	}
+
+	rw := serveBundle(p, project, project.BundleDigest, map[string]string{"If-None-Match": "\"other\""})
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, etag, rw.Header().Get("ETag"))
+	assert.Equal(t, bundleContent, rw.Body.String())
+}
+
+func TestServeFileResumesRangesOfTheSameContentOnly(t *testing.T) {
+	p, project := setupBundle(t)
+	etag := "\"" + project.BundleDigest + "\""
+
+	rw := serveBundle(p, project, project.BundleDigest, map[string]string{"Range": "bytes=5-", "If-Range": etag})
+	assert.Equal(t, http.StatusPartialContent, rw.Code)
+	assert.Equal(t, "bytes", rw.Header().Get("Accept-Ranges"))
+	assert.Equal(t, bundleContent[5:], rw.Body.String())
+
+	// the content changed since the client received the first bytes
+	rw = serveBundle(p, project, project.BundleDigest, map[string]string{"Range": "bytes=5-", "If-Range": "\"stale\""})
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, bundleContent, rw.Body.String())
+
+	// content without a digest is always sent as a whole
+	for _, headers := range []map[string]string{
+		{"Range": "bytes=5-"},
+		{"Range": "bytes=5-", "If-Range": etag},
+		{"Range": "bytes=5-", "If-Range": "Mon, 02 Jan 2006 15:04:05 GMT"},
+	} {
+		rw = serveBundle(p, project, "", headers)
+		assert.Equal(t, http.StatusOK, rw.Code, headers)
+		assert.Equal(t, "none", rw.Header().Get("Accept-Ranges"), headers)
+		assert.Empty(t, rw.Header().Get("ETag"), headers)
+		assert.Equal(t, bundleContent, rw.Body.String(), headers)
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	"github.com/iantal/rm/internal/util"
+	"github.com/sirupsen/logrus"
+)
+
+// ResolvedCommitHeader carries the full hash of the commit a ref was resolved to
+const ResolvedCommitHeader = "X-Resolved-Commit"
+
+var fullHash = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// Refs returns the branches and tags of a project with the commits they point to
+func (p *Projects) Refs(rw http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["id"]
+
+	p.withRepository(rw, projectID, func(projectName string) {
+		refs, err := p.repositoryManager.ListRefs(r.Context(), projectID, projectName)
+		if err != nil {
+			p.failed(rw, err, "Unable to list refs", logrus.Fields{"projectID": projectID})
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		util.ToJSON(refs, rw)
+	})
+}
+
+// withRepository calls fn with the name of the project once its repository is extracted.
+// Otherwise the download and extraction of the project is queued and the job is returned
+// with 202 Accepted.
+func (p *Projects) withRepository(rw http.ResponseWriter, projectID string, fn func(projectName string)) {
+	projectName, extracted, err := p.repositoryManager.Repository(projectID)
+	if err != nil {
+		p.failed(rw, err, "Could not get project name", logrus.Fields{"projectID": projectID})
+		return
+	}
+
+	if !extracted {
+		p.prepare(rw, projectID, "")
+		return
+	}
+	fn(projectName)
+}
+
+// resolveCommit calls fn with the full hash of the commit the ref points to, which is
+// also set in the ResolvedCommitHeader. Full hashes are used as they are, other refs
+// need the repository of the project to be extracted.
+func (p *Projects) resolveCommit(rw http.ResponseWriter, r *http.Request, projectID, ref string, fn func(commit string)) {
+	if fullHash.MatchString(ref) {
+		rw.Header().Set(ResolvedCommitHeader, ref)
+		fn(ref)
+		return
+	}
+
+	p.withRepository(rw, projectID, func(projectName string) {
+		p.resolveInRepository(rw, r, projectID, projectName, ref, fn)
+	})
+}
+
+// resolveInRepository is resolveCommit for callers that hold the name of the extracted
+// repository of the project already
+func (p *Projects) resolveInRepository(rw http.ResponseWriter, r *http.Request, projectID, projectName, ref string, fn func(commit string)) {
+	if fullHash.MatchString(ref) {
+		rw.Header().Set(ResolvedCommitHeader, ref)
+		fn(ref)
+		return
+	}
+
+	commit, err := p.repositoryManager.ResolveRef(r.Context(), projectID, projectName, ref)
+	if err != nil {
+		p.failed(rw, err, "Unable to resolve ref", logrus.Fields{
+			"projectID": projectID,
+			"ref":       ref,
+		})
+		return
+	}
+
+	rw.Header().Set(ResolvedCommitHeader, commit)
+	fn(commit)
+}
@@ -0,0 +1,361 @@
+package rk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iantal/rm/internal/util"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// ErrNotFound is returned for projects rk does not know
+var ErrNotFound = errors.New("Project not found in rk")
+
+// ErrUnavailable is returned when rk cannot be reached, fails to answer or answers with
+// something other than what was asked for
+var ErrUnavailable = errors.New("rk is unavailable")
+
+// Options configures the client of rk, zero values are replaced by the defaults
+type Options struct {
+	// BaseURL is the URL rk is served at, a host without a scheme is reached over http
+	BaseURL string
+	// Timeout bounds each attempt of the calls returning project metadata, and the wait
+	// for the response headers of downloads
+	Timeout time.Duration
+	// DownloadTimeout bounds a download including the transfer of the archive
+	DownloadTimeout time.Duration
+	// Retries is the number of times a failed call is attempted again, a negative number
+	// disables the retries
+	Retries int
+	// Backoff is the wait before the first retry, it doubles with every retry
+	Backoff time.Duration
+	// MaxBackoff caps the wait between two attempts
+	MaxBackoff time.Duration
+	// BreakerThreshold is the number of consecutive failures after which calls fail fast
+	BreakerThreshold int
+	// BreakerCooldown is how long calls fail fast before rk is tried again
+	BreakerCooldown time.Duration
+}
+
+// Defaults of the Options
+const (
+	DefaultTimeout          = 10 * time.Second
+	DefaultDownloadTimeout  = 30 * time.Minute
+	DefaultRetries          = 3
+	DefaultBackoff          = 200 * time.Millisecond
+	DefaultMaxBackoff       = 5 * time.Second
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// Client calls the API of rk. The calls are idempotent and retried with backoff, and
+// a circuit breaker stops them from waiting on rk while it is down.
+type Client struct {
+	l       *util.StandardLogger
+	base    *url.URL
+	http    *http.Client
+	opts    Options
+	breaker *breaker
+}
+
+// Project is the metadata rk holds for a project
+type Project struct {
+	ID   string `json:"projectId"`
+	Name string `json:"name"`
+}
+
+// Archive is the archive of the repository of a project being downloaded. Closing it
+// ends the download.
+type Archive struct {
+	io.ReadCloser
+	// Offset is the position in the archive the body starts at
+	Offset int64
+	// ContentType is the media type rk announced for the archive
+	ContentType string
+	// Size is the number of bytes announced for the whole archive, -1 when unknown
+	Size int64
+	// SHA256 is the digest announced for the archive in the Digest header, nil when unknown
+	SHA256 []byte
+	// Validator identifies the version of the archive, its ETag or else its modification
+	// time. It is empty when rk sent neither, downloads cannot be resumed then.
+	Validator string
+}
+
+// NewClient creates a client of the rk served at the base URL of the options
+func NewClient(l *util.StandardLogger, opts Options) (*Client, error) {
+	if opts.BaseURL == "" {
+		return nil, xerrors.New("rk base URL is not set")
+	}
+	if !strings.Contains(opts.BaseURL, "://") {
+		opts.BaseURL = "http://" + opts.BaseURL
+	}
+	base, err := url.Parse(opts.BaseURL)
+	if err != nil {
+		return nil, xerrors.Errorf("Invalid rk base URL: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, xerrors.Errorf("Unsupported rk URL scheme %q", base.Scheme)
+	}
+
+	setDefault(&opts.Timeout, DefaultTimeout)
+	setDefault(&opts.DownloadTimeout, DefaultDownloadTimeout)
+	setDefault(&opts.Backoff, DefaultBackoff)
+	setDefault(&opts.MaxBackoff, DefaultMaxBackoff)
+	setDefault(&opts.BreakerCooldown, DefaultBreakerCooldown)
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	} else if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.BreakerThreshold <= 0 {
+		opts.BreakerThreshold = DefaultBreakerThreshold
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = opts.Timeout
+	return &Client{
+		l:       l,
+		base:    base,
+		http:    &http.Client{Transport: transport},
+		opts:    opts,
+		breaker: newBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+	}, nil
+}
+
+func setDefault(d *time.Duration, def time.Duration) {
+	if *d <= 0 {
+		*d = def
+	}
+}
+
+// Project returns the metadata of a project
+func (c *Client) Project(ctx context.Context, projectID string) (*Project, error) {
+	var project *Project
+	err := c.retry(ctx, projectID, func() error {
+		ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+		defer cancel()
+
+		resp, err := c.get(ctx, nil, "api/v1/projects", projectID)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		project = &Project{}
+		if err := json.NewDecoder(resp.Body).Decode(project); err != nil {
+			return xerrors.Errorf("Unable to decode project: %v: %w", err, ErrUnavailable)
+		}
+		return nil
+	})
+	return project, err
+}
+
+// Download starts the download of the archive of the repository of a project, which is
+// read from the returned archive. Failures to start the download are retried, the
+// transfer of the archive is not.
+//
+// A download interrupted after offset bytes is resumed by passing offset and the validator
+// of the archive. rk then sends the rest of the archive if it still has the same version,
+// otherwise the whole archive is sent again and its Offset is 0.
+func (c *Client) Download(ctx context.Context, projectID string, offset int64, validator string) (*Archive, error) {
+	header := http.Header{}
+	if offset > 0 && validator != "" {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		header.Set("If-Range", validator)
+	}
+
+	var archive *Archive
+	err := c.retry(ctx, projectID, func() error {
+		ctx, cancel := context.WithTimeout(ctx, c.opts.DownloadTimeout)
+		resp, err := c.get(ctx, header, "api/v1/projects", projectID, "download")
+		var se *statusError
+		if xerrors.As(err, &se) && se.status == http.StatusRequestedRangeNotSatisfiable {
+			// the archive is not as large anymore, it changed
+			resp, err = c.get(ctx, nil, "api/v1/projects", projectID, "download")
+		}
+		if err == nil {
+			archive, err = newArchive(resp)
+		}
+		if err != nil {
+			cancel()
+			return err
+		}
+		archive.ReadCloser = &cancelBody{resp.Body, cancel}
+		return nil
+	})
+	return archive, err
+}
+
+// newArchive returns the archive sent in the response, whole or from the offset of its range
+func newArchive(resp *http.Response) (*Archive, error) {
+	a := &Archive{
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+		SHA256:      sha256Digest(resp.Header.Values("Digest")),
+		Validator:   resp.Header.Get("ETag"),
+	}
+	if a.Validator == "" {
+		a.Validator = resp.Header.Get("Last-Modified")
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return a, nil
+	}
+
+	// Content-Range: bytes <first>-<last>/<size or *>
+	var first, last int64
+	var size string
+	cr := resp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/%s", &first, &last, &size); err != nil || last < first {
+		resp.Body.Close()
+		return nil, xerrors.Errorf("Invalid Content-Range %q: %w", cr, ErrUnavailable)
+	}
+	a.Offset = first
+	a.Size = -1
+	if n, err := strconv.ParseInt(size, 10, 64); err == nil {
+		a.Size = n
+	}
+	return a, nil
+}
+
+// sha256Digest returns the SHA-256 digest of the instance digests of the Digest headers,
+// written as sha-256=<base64>
+func sha256Digest(headers []string) []byte {
+	for _, h := range headers {
+		for _, d := range strings.Split(h, ",") {
+			parts := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			if len(parts) != 2 || !strings.EqualFold(parts[0], "sha-256") {
+				continue
+			}
+			if sum, err := base64.StdEncoding.DecodeString(parts[1]); err == nil && len(sum) == sha256.Size {
+				return sum
+			}
+		}
+	}
+	return nil
+}
+
+// get requests the resource at the path below the base URL with the given headers. The
+// response is returned for 200 OK and 206 Partial Content only, its body is closed otherwise.
+func (c *Client) get(ctx context.Context, header http.Header, elem ...string) (*http.Response, error) {
+	u := *c.base
+	u.Path = path.Join(append([]string{"/", c.base.Path}, elem...)...)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("GET %s: %v: %w", u.Path, err, ErrUnavailable)
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, xerrors.Errorf("GET %s: %w", u.Path, ErrNotFound)
+	}
+	return nil, &statusError{path: u.Path, status: resp.StatusCode}
+}
+
+// retry calls fn until it succeeds, the retries are exhausted, or it fails with an error
+// which would not change by trying again. Calls fail fast while the breaker is open, calls
+// given up by the caller do not count as failures of rk.
+func (c *Client) retry(ctx context.Context, projectID string, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if !c.breaker.allow() {
+			return xerrors.Errorf("Circuit open after repeated failures: %w", ErrUnavailable)
+		}
+
+		err = fn()
+		if err != nil && ctx.Err() != nil {
+			c.breaker.release()
+			return ctx.Err()
+		}
+		c.breaker.record(!transient(err))
+		if err == nil || !transient(err) || attempt == c.opts.Retries {
+			break
+		}
+
+		wait := c.backoff(attempt)
+		c.l.WithFields(logrus.Fields{
+			"projectID": projectID,
+			"attempt":   attempt + 1,
+			"wait":      wait,
+			"error":     err,
+		}).Warn("Retrying call to rk")
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var se *statusError
+	if xerrors.As(err, &se) {
+		return xerrors.Errorf("%v: %w", err, ErrUnavailable)
+	}
+	return err
+}
+
+// backoff returns the wait before the retry following the given attempt, with jitter so
+// that the retries of concurrent calls spread out
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.opts.Backoff << uint(attempt)
+	if wait <= 0 || wait > c.opts.MaxBackoff {
+		wait = c.opts.MaxBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// transient reports whether a call which failed with err may succeed when attempted again
+func transient(err error) bool {
+	if err == nil || xerrors.Is(err, ErrNotFound) {
+		return false
+	}
+	var se *statusError
+	if xerrors.As(err, &se) {
+		return se.status >= 500 || se.status == http.StatusTooManyRequests || se.status == http.StatusRequestTimeout
+	}
+	return true
+}
+
+// statusError is returned for unexpected statuses of responses
+type statusError struct {
+	path   string
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("GET %s: expected status 200 got %d", e.path, e.status)
+}
+
+// cancelBody releases the context of a download once its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,144 @@
+package rk
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iantal/rm/internal/rk/rktest"
+	"github.com/iantal/rm/internal/util"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+const projectID = "0b6c3b52-4e1d-4a4b-9a5e-3c7c1d1f2a10"
+
+func setupClient(t *testing.T, opts Options) (*Client, *rktest.Server) {
+	s := rktest.NewServer()
+	s.AddProject(projectID, "project", []byte("PK\x03\x04archive"), "application/zip")
+
+	// rk is configured by host, as before clients had a scheme
+	opts.BaseURL = strings.TrimPrefix(s.URL, "http://")
+	opts.Backoff = time.Millisecond
+	c, err := NewClient(util.NewLogger(), opts)
+	assert.NoError(t, err)
+	return c, s
+}
+
+func TestClientGetsProjectsAndArchives(t *testing.T) {
+	c, s := setupClient(t, Options{})
+	defer s.Close()
+	ctx := context.Background()
+
+	p, err := c.Project(ctx, projectID)
+	assert.NoError(t, err)
+	assert.Equal(t, "project", p.Name)
+
+	a, err := c.Download(ctx, projectID, 0, "")
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(a)
+	assert.NoError(t, err)
+	assert.NoError(t, a.Close())
+	assert.Equal(t, "PK\x03\x04archive", string(b))
+	assert.Equal(t, "application/zip", a.ContentType)
+	assert.Equal(t, int64(len(b)), a.Size)
+
+	// unknown projects are not retried
+	_, err = c.Project(ctx, "unknown")
+	assert.True(t, xerrors.Is(err, ErrNotFound))
+	assert.Equal(t, 1, s.Requests("/api/v1/projects/unknown"))
+}
+
+func TestClientResumesDownloads(t *testing.T) {
+	c, s := setupClient(t, Options{})
+	defer s.Close()
+	ctx := context.Background()
+
+	a, err := c.Download(ctx, projectID, 0, "")
+	assert.NoError(t, err)
+	a.Close()
+	assert.NotEmpty(t, a.Validator)
+
+	a, err = c.Download(ctx, projectID, 4, a.Validator)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(a)
+	assert.NoError(t, err)
+	a.Close()
+	assert.Equal(t, "archive", string(b))
+	assert.Equal(t, int64(4), a.Offset)
+	assert.Equal(t, int64(len("PK\x03\x04archive")), a.Size)
+
+	// the whole archive is sent again once it changed, or when the offset is past its end
+	for _, resume := range []struct {
+		offset    int64
+		validator string
+	}{{4, `"changed"`}, {100, a.Validator}} {
+		a, err = c.Download(ctx, projectID, resume.offset, resume.validator)
+		assert.NoError(t, err)
+		b, err = ioutil.ReadAll(a)
+		assert.NoError(t, err)
+		a.Close()
+		assert.Equal(t, "PK\x03\x04archive", string(b))
+		assert.Equal(t, int64(0), a.Offset)
+	}
+	assert.Equal(t, []string{"", "bytes=4-", "bytes=4-", "bytes=100-", ""}, s.Ranges())
+}
+
+func TestClientRetriesTransientFailures(t *testing.T) {
+	c, s := setupClient(t, Options{Retries: 2})
+	defer s.Close()
+	ctx := context.Background()
+
+	s.Fail(http.StatusServiceUnavailable, 0)
+	p, err := c.Project(ctx, projectID)
+	assert.NoError(t, err)
+	assert.Equal(t, "project", p.Name)
+	assert.Equal(t, 3, s.Requests("/api/v1/projects/"+projectID))
+
+	s.Fail(http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	_, err = c.Download(ctx, projectID, 0, "")
+	assert.True(t, xerrors.Is(err, ErrUnavailable))
+	assert.Equal(t, 3, s.Requests("/api/v1/projects/"+projectID+"/download"))
+
+	// client errors do not change by trying again
+	s.Fail(http.StatusForbidden)
+	_, err = c.Project(ctx, projectID)
+	assert.True(t, xerrors.Is(err, ErrUnavailable))
+	assert.Equal(t, 4, s.Requests("/api/v1/projects/"+projectID))
+}
+
+func TestClientBreakerFailsFastWhileRkIsDown(t *testing.T) {
+	c, s := setupClient(t, Options{Retries: -1, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond})
+	defer s.Close()
+	ctx := context.Background()
+	path := "/api/v1/projects/" + projectID
+
+	s.Fail(http.StatusInternalServerError, http.StatusInternalServerError)
+	for i := 0; i < 2; i++ {
+		_, err := c.Project(ctx, projectID)
+		assert.True(t, xerrors.Is(err, ErrUnavailable))
+	}
+
+	// rk is not called while the breaker is open
+	_, err := c.Project(ctx, projectID)
+	assert.True(t, xerrors.Is(err, ErrUnavailable))
+	assert.Equal(t, 2, s.Requests(path))
+
+	// a successful trial after the cooldown closes it
+	time.Sleep(60 * time.Millisecond)
+	_, err = c.Project(ctx, projectID)
+	assert.NoError(t, err)
+	_, err = c.Project(ctx, projectID)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, s.Requests(path))
+}
+
+func TestNewClientRejectsUnsupportedSchemes(t *testing.T) {
+	_, err := NewClient(util.NewLogger(), Options{BaseURL: "ftp://rk"})
+	assert.Error(t, err)
+	_, err = NewClient(util.NewLogger(), Options{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,178 @@
+// Package rktest provides a fake of rk for tests
+package rktest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is an rk serving the projects added to it. Failures can be injected to check
+// how clients cope with rk being down.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	projects map[string]project
+	failures []int
+	drops    []int64
+	requests map[string]int
+	ranges   []string
+}
+
+type project struct {
+	name        string
+	archive     []byte
+	contentType string
+	served      []byte
+}
+
+// NewServer starts a fake rk without projects, it is closed with Close
+func NewServer() *Server {
+	s := &Server{projects: map[string]project{}, requests: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// AddProject makes rk serve a project with the given name and the archive of its repository.
+// The length and the digest of the archive are announced with it.
+func (s *Server) AddProject(id, name string, archive []byte, contentType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.projects[id] = project{name, archive, contentType, archive}
+}
+
+// Corrupt makes rk serve other bytes as the archive of a project, while announcing the
+// length and the digest of its archive. Fewer bytes end the download early.
+func (s *Server) Corrupt(id string, served []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.projects[id]
+	p.served = served
+	s.projects[id] = p
+}
+
+// Fail makes rk answer the next requests with the given statuses, one per request.
+// A status of 0 drops the connection without answering.
+func (s *Server) Fail(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+// DropAfter makes rk drop the connection of the next downloads after sending the given
+// numbers of bytes of the archive, one per download
+func (s *Server) DropAfter(n ...int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drops = append(s.drops, n...)
+}
+
+// Ranges returns the Range headers of the downloads received, empty for whole archives
+func (s *Server) Ranges() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.ranges...)
+}
+
+// Requests returns the number of requests received for the path
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func (s *Server) serve(rw http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	var failure *int
+	if len(s.failures) > 0 {
+		failure, s.failures = &s.failures[0], s.failures[1:]
+	}
+	s.mu.Unlock()
+
+	if failure != nil {
+		if *failure == 0 {
+			if hj, ok := rw.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+		http.Error(rw, http.StatusText(*failure), *failure)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/projects/"), "/")
+	s.mu.Lock()
+	p, ok := s.projects[parts[0]]
+	s.mu.Unlock()
+	if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, "/api/v1/projects/") || !ok || len(parts) > 2 {
+		http.NotFound(rw, r)
+		return
+	}
+
+	if len(parts) == 2 {
+		if parts[1] != "download" {
+			http.NotFound(rw, r)
+			return
+		}
+		s.download(rw, r, p)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]string{"projectId": parts[0], "name": p.name})
+}
+
+// download sends the archive of the project, or the range of it which is asked for. The
+// archive is tagged with its digest.
+func (s *Server) download(rw http.ResponseWriter, r *http.Request, p project) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	drop := int64(-1)
+	if len(s.drops) > 0 {
+		drop, s.drops = s.drops[0], s.drops[1:]
+	}
+	s.mu.Unlock()
+
+	sum := sha256.Sum256(p.archive)
+	rw.Header().Set("Content-Type", p.contentType)
+	rw.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum[:]))
+	rw.Header().Set("ETag", "\""+hex.EncodeToString(sum[:])+"\"")
+	if drop >= 0 {
+		rw = &droppingWriter{rw, drop}
+	}
+
+	if !bytes.Equal(p.served, p.archive) {
+		rw.Header().Set("Content-Length", strconv.Itoa(len(p.archive)))
+		rw.Write(p.served)
+		return
+	}
+	http.ServeContent(rw, r, "", time.Time{}, bytes.NewReader(p.archive))
+}
+
+// droppingWriter aborts the response once a number of bytes of the body were sent
+type droppingWriter struct {
+	http.ResponseWriter
+	left int64
+}
+
+func (w *droppingWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > w.left {
+		w.ResponseWriter.Write(b[:w.left])
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.left -= int64(len(b))
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/files"
+	"github.com/sirupsen/logrus"
+)
+
+// SourceArchive returns the snapshot of the files of the commit of a project in the given
+// format. Snapshots are built from the repository once, stored by content and recorded on
+// the project with their size and digest.
+func (r *RepositoryManager) SourceArchive(ctx context.Context, project *domain.Project, format files.Format) (*domain.Archive, error) {
+	if err := files.ValidArchiveFormat(format); err != nil {
+		return nil, err
+	}
+	if a := project.Archive(string(format)); a.Path != "" {
+		if _, err := r.blobs.Stat(ctx, a.Path); err == nil {
+			return a, nil
+		}
+	}
+
+	projectID := project.ProjectID.String()
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	a, err := r.builds.Do(files.ArchiveKey(projectID, project.CommitHash, project.Name, format), nil, func(func(domain.DownloadState)) (interface{}, error) {
+		// the archive is shared with other callers, the caller going away does not cancel it
+		ctx := context.Background()
+		p := r.db.GetProjectByIDAndCommit(projectID, project.CommitHash)
+		if p == nil {
+			p = project
+		}
+		if a := p.Archive(string(format)); a.Path != "" {
+			if _, err := r.blobs.Stat(ctx, a.Path); err == nil {
+				return *a, nil
+			}
+		}
+
+		r.l.WithFields(logrus.Fields{
+			"projectID": projectID,
+			"commit":    project.CommitHash,
+			"format":    format,
+		}).Info("Archiving commit")
+		f, err := r.workspace.Archive(ctx, projectID, project.Name, project.CommitHash, format)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		a := p.Archive(string(format))
+		err = r.storeContent(ctx, f, func(key, digest string, size int64) {
+			a.Path = key
+			a.Size = size
+			a.Digest = digest
+			if err := r.db.SaveArchive(p, string(format)); err != nil {
+				r.l.WithFields(logrus.Fields{
+					"projectID": projectID,
+					"commit":    project.CommitHash,
+					"format":    format,
+					"error":     err,
+				}).Error("Unable to record archive")
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		return *a, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	archive := a.(domain.Archive)
+	return &archive, nil
+}
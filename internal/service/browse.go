@@ -0,0 +1,59 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+
+	"github.com/iantal/rm/internal/files"
+	"golang.org/x/xerrors"
+)
+
+// blobMemoryLimit is the size up to which the contents of a file are kept in memory
+// rather than spooled to the workspace
+const blobMemoryLimit = 1 << 20
+
+// Tree lists the directory at path in the commit of the extracted repository of a project
+func (r *RepositoryManager) Tree(ctx context.Context, projectID, projectName, commit, path string) ([]files.TreeEntry, error) {
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	return r.workspace.Tree(ctx, projectID, projectName, commit, path)
+}
+
+// Blob returns the contents of the file at path in the commit of the extracted repository
+// of a project and its size. The contents are copied out of the repository while it is
+// read locked, so that slow clients do not hold the lock.
+func (r *RepositoryManager) Blob(ctx context.Context, projectID, projectName, commit, path string) (io.ReadCloser, int64, error) {
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	rc, size, err := r.workspace.Blob(ctx, projectID, projectName, commit, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rc.Close()
+
+	if size <= blobMemoryLimit {
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return nil, 0, xerrors.Errorf("Unable to read blob: %w", err)
+		}
+		return memoryFile{bytes.NewReader(data)}, size, nil
+	}
+
+	s, err := r.workspace.Spool(projectID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := io.Copy(s, rc); err != nil {
+		s.Close()
+		return nil, 0, xerrors.Errorf("Unable to spool blob: %w", err)
+	}
+	if _, err := s.Seek(0, io.SeekStart); err != nil {
+		s.Close()
+		return nil, 0, xerrors.Errorf("Unable to rewind blob: %w", err)
+	}
+	return s, size, nil
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/iantal/rm/internal/files"
+	"github.com/iantal/rm/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// blobWorkspace is a workspace whose files all have the same contents
+type blobWorkspace struct {
+	*files.Local
+	content string
+}
+
+func (w blobWorkspace) Blob(ctx context.Context, projectID, name, commit, path string) (io.ReadCloser, int64, error) {
+	return ioutil.NopCloser(strings.NewReader(w.content)), int64(len(w.content)), nil
+}
+
+func TestBlobIsReadWithoutHoldingTheLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "browse")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	local, err := files.NewLocal(util.NewLogger(), dir, 0, files.NewGoGit())
+	assert.NoError(t, err)
+
+	for _, content := range []string{"small", strings.Repeat("0", blobMemoryLimit+1)} {
+		r := &RepositoryManager{l: util.NewLogger(), workspace: blobWorkspace{local, content}, locks: newProjectLocks()}
+		rc, size, err := r.Blob(context.Background(), testProjectID, "project", "c1", "README.md")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), size)
+
+		// a writer is not blocked by a client which did not read the blob yet
+		r.locks.Lock(testProjectID)
+		r.locks.Unlock(testProjectID)
+
+		b := &bytes.Buffer{}
+		_, err = io.Copy(b, rc)
+		assert.NoError(t, err)
+		assert.NoError(t, rc.Close())
+		assert.Equal(t, content, b.String())
+	}
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// BundleConfig chooses how the bundles of commits are kept
+type BundleConfig struct {
+	// OnDemand generates bundles from the extracted repository of the project whenever they
+	// are downloaded, instead of storing a bundle per commit. Bundles are not streamed: a
+	// download waits until its bundle is complete, unless it is in the cache
+	OnDemand bool
+	// CacheSize is the number of bytes of recently generated bundles kept in memory when
+	// bundles are generated on demand, 0 disables the cache
+	CacheSize int64
+}
+
+// bundleCache keeps the most recently used bundles in memory, up to a number of bytes.
+// Bundles larger than a quarter of the cache are not kept, so that a single bundle
+// does not flush the others.
+type bundleCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type cachedBundle struct {
+	key  string
+	data []byte
+}
+
+func newBundleCache(capacity int64) *bundleCache {
+	return &bundleCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// fits reports whether a bundle of the given size would be kept
+func (c *bundleCache) fits(size int64) bool {
+	return size > 0 && size <= c.capacity/4
+}
+
+// get returns the bundle under key and marks it as recently used
+func (c *bundleCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedBundle).data, true
+}
+
+// add keeps the bundle under key, evicting the least recently used bundles to make room
+func (c *bundleCache) add(key string, data []byte) {
+	if !c.fits(int64(len(data))) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.drop(e)
+	}
+	c.entries[key] = c.order.PushFront(&cachedBundle{key, data})
+	c.size += int64(len(data))
+	for c.size > c.capacity {
+		c.drop(c.order.Back())
+	}
+}
+
+// remove drops the bundles whose keys are prefix or below it
+func (c *bundleCache) remove(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.entries {
+		if key == prefix || strings.HasPrefix(key, prefix+"/") {
+			c.drop(e)
+		}
+	}
+}
+
+func (c *bundleCache) drop(e *list.Element) {
+	b := c.order.Remove(e).(*cachedBundle)
+	delete(c.entries, b.key)
+	c.size -= int64(len(b.data))
+}
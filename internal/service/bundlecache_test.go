@@ -0,0 +1,49 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBundleCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newBundleCache(40)
+
+	c.add("p/a/project.bundle", make([]byte, 10))
+	c.add("p/b/project.bundle", make([]byte, 10))
+	c.add("p/c/project.bundle", make([]byte, 10))
+	_, ok := c.get("p/a/project.bundle")
+	assert.True(t, ok)
+
+	// b is the least recently used
+	c.add("p/d/project.bundle", make([]byte, 10))
+	c.add("p/e/project.bundle", make([]byte, 10))
+	_, ok = c.get("p/b/project.bundle")
+	assert.False(t, ok)
+	for _, k := range []string{"p/a/project.bundle", "p/c/project.bundle", "p/d/project.bundle", "p/e/project.bundle"} {
+		_, ok = c.get(k)
+		assert.True(t, ok, k)
+	}
+	assert.Equal(t, int64(40), c.size)
+
+	// too large to be kept
+	c.add("p/f/project.bundle", make([]byte, 11))
+	_, ok = c.get("p/f/project.bundle")
+	assert.False(t, ok)
+}
+
+func TestBundleCacheRemovesBelowPrefix(t *testing.T) {
+	c := newBundleCache(100)
+	c.add("p/a/project.bundle", []byte("a"))
+	c.add("p/a/thin/1/project.bundle", []byte("thin"))
+	c.add("p/ab/project.bundle", []byte("ab"))
+
+	c.remove("p/a")
+	_, ok := c.get("p/a/project.bundle")
+	assert.False(t, ok)
+	_, ok = c.get("p/a/thin/1/project.bundle")
+	assert.False(t, ok)
+	_, ok = c.get("p/ab/project.bundle")
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), c.size)
+}
@@ -1,13 +1,176 @@
 package service
 
-// CheckoutCommit checks out the commit for a given project
-func (r *RepositoryManager) CheckoutCommit(commit, projectID, projectName string) error {
-	r.l.WithField("commit", commit).Info("Checking out commit")
-	srcPath := r.store.UnzipPath(projectID)
-	destPath := r.store.CommitPath(projectID, commit)
-	err := r.store.Checkout(srcPath, destPath, commit, projectID, projectName)
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/files"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// ResolveCommit returns the full hash of the commit rev points to for a given project
+func (r *RepositoryManager) ResolveCommit(ctx context.Context, rev, projectID, projectName string) (string, error) {
+	return r.workspace.ResolveCommit(ctx, projectID, projectName, rev)
+}
+
+// BundleCommit creates the bundle of the commit for a given project and records the commit.
+// The bundle is built from the objects of the repository, its working tree is not modified.
+// It is stored by content, commits with the same bundle share it.
+func (r *RepositoryManager) BundleCommit(ctx context.Context, commit, projectID, projectName string) (*domain.Project, error) {
+	r.l.WithField("commit", commit).Info("Bundling commit")
+	f, err := r.workspace.Bundle(ctx, projectID, projectName, commit, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var project *domain.Project
+	err = r.storeContent(ctx, f, func(key, digest string, size int64) {
+		project = r.SaveToDb(projectName, projectID, commit, key, digest, size)
+	})
+	return project, err
+}
+
+// ThinBundle returns the key and the digest of the bundle of the commit of a project which
+// leaves out the history reachable from haves. Haves unknown to the repository are ignored
+// and the full bundle is returned when none of them is known. Thin bundles are built once
+// and stored by content, thin bundles with the same content share their blob.
+func (r *RepositoryManager) ThinBundle(ctx context.Context, project *domain.Project, haves []string) (string, string, error) {
+	projectID := project.ProjectID.String()
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	// a bundle stored for a commit deleted since it was looked up would never be removed
+	if r.db.GetProjectByIDAndCommit(projectID, project.CommitHash) == nil {
+		return "", "", xerrors.Errorf("%q: %w", project.CommitHash, ErrCommitNotFound)
+	}
+
+	known, err := r.knownHaves(ctx, project, haves)
+	if err != nil {
+		return "", "", err
+	}
+	if len(known) == 0 {
+		return project.BundlePath, project.BundleDigest, nil
+	}
+
+	havesKey := files.HavesKey(known)
+	v, err := r.builds.Do(files.BundleKey(projectID, project.CommitHash, project.Name, known...), nil, func(func(domain.DownloadState)) (interface{}, error) {
+		// the bundle is shared with other callers, the caller going away does not cancel it
+		ctx := context.Background()
+		if b := r.db.GetThinBundle(project, havesKey); b != nil {
+			if _, err := r.blobs.Stat(ctx, files.ContentKey(b.Digest)); err == nil {
+				return b, nil
+			}
+		}
+
+		r.l.WithFields(logrus.Fields{
+			"projectID": projectID,
+			"commit":    project.CommitHash,
+			"haves":     known,
+		}).Info("Bundling commit since haves")
+		f, err := r.workspace.Bundle(ctx, projectID, project.Name, project.CommitHash, known)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		b := &domain.ThinBundle{ProjectID: project.ProjectID, CommitHash: project.CommitHash, Haves: havesKey}
+		var saveErr error
+		err = r.storeContent(ctx, f, func(key, digest string, size int64) {
+			b.Digest = digest
+			b.Size = size
+			saveErr = r.db.SaveThinBundle(b)
+		})
+		if err == nil {
+			err = saveErr
+		}
+		return b, err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	b := v.(*domain.ThinBundle)
+	return files.ContentKey(b.Digest), b.Digest, nil
+}
+
+// OpenBundle generates the bundle of the commit of a project from its repository, leaving out
+// the history reachable from haves, or returns it from the cache of recently generated bundles.
+// Haves unknown to the repository are ignored. The bundle is written whole to a temporary file
+// of the workspace before it is returned, so the project is not locked while clients read it.
+func (r *RepositoryManager) OpenBundle(ctx context.Context, project *domain.Project, haves []string) (files.File, error) {
+	projectID := project.ProjectID.String()
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	known, err := r.knownHaves(ctx, project, haves)
+	if err != nil {
+		return nil, err
+	}
+	key := files.BundleKey(projectID, project.CommitHash, project.Name, known...)
+	if data, ok := r.hot.get(key); ok {
+		return memoryFile{bytes.NewReader(data)}, nil
+	}
+
+	r.l.WithFields(logrus.Fields{
+		"projectID": projectID,
+		"commit":    project.CommitHash,
+		"haves":     known,
+	}).Info("Generating bundle")
+	f, err := r.workspace.Bundle(ctx, projectID, project.Name, project.CommitHash, known)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// the file stays readable once the repository is unlocked
+	size, err := f.Seek(0, io.SeekEnd)
+	if err == nil && r.hot.fits(size) {
+		data := make([]byte, size)
+		if _, err = f.Seek(0, io.SeekStart); err == nil {
+			_, err = io.ReadFull(f, data)
+		}
+		if err == nil {
+			f.Close()
+			r.hot.add(key, data)
+			return memoryFile{bytes.NewReader(data)}, nil
+		}
 	}
-	return nil
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
 }
+
+// knownHaves resolves the haves known to the repository of a project to full hashes,
+// the caller holds the read lock of the project
+func (r *RepositoryManager) knownHaves(ctx context.Context, project *domain.Project, haves []string) ([]string, error) {
+	var known []string
+	seen := map[string]bool{}
+	for _, h := range haves {
+		hash, err := r.ResolveCommit(ctx, h, project.ProjectID.String(), project.Name)
+		if xerrors.Is(err, files.ErrCommitNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !seen[hash] {
+			seen[hash] = true
+			known = append(known, hash)
+		}
+	}
+	return known, nil
+}
+
+// memoryFile is a bundle of the cache opened for reading
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error { return nil }
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/files"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThinBundlesAreStoredByContent(t *testing.T) {
+	r, s, blobs, src := setupBuilds(t)
+	ctx := context.Background()
+	other := "7d1c3b52-4e1d-4a4b-9a5e-3c7c1d1f2a10"
+
+	// a fork has the same history as the project
+	first := commitFile(t, src, "one")
+	second := commitFile(t, src, "two")
+	s.AddProject(testProjectID, "project", repoZip(t, src), "application/zip")
+	s.AddProject(other, "fork", repoZip(t, src), "application/zip")
+	var keys, digests []string
+	contents := map[string]bool{}
+	for _, projectID := range []string{testProjectID, other} {
+		project, err := r.Build(ctx, projectID, second, func(domain.DownloadState) {})
+		assert.NoError(t, err)
+		key, digest, err := r.ThinBundle(ctx, project, []string{first, "unknown"})
+		assert.NoError(t, err)
+		assert.NotEqual(t, project.BundleDigest, digest)
+		assert.Equal(t, files.ContentKey(digest), key)
+		keys, digests = append(keys, key), append(digests, digest)
+		contents[project.BundleDigest], contents[digest] = true, true
+
+		// built once
+		again, _, err := r.ThinBundle(ctx, project, []string{first})
+		assert.NoError(t, err)
+		assert.Equal(t, key, again)
+	}
+	assert.Equal(t, digests[0], digests[1])
+	stored, err := blobs.List(ctx, files.ContentPrefix)
+	assert.NoError(t, err)
+	assert.Len(t, stored, len(contents))
+
+	// the thin bundle is kept as long as a commit references it
+	assert.NoError(t, r.DeleteCommit(testProjectID, second))
+	assert.True(t, exists(blobs, keys[0]))
+	assert.NoError(t, r.DeleteProject(other))
+	assert.False(t, exists(blobs, keys[0]))
+}
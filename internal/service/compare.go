@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"io"
+
+	"github.com/iantal/rm/internal/files"
+	"golang.org/x/xerrors"
+)
+
+// Comparison is the change from the merge base of two commits to the head commit
+type Comparison struct {
+	Base string `json:"base"`
+	Head string `json:"head"`
+	// MergeBase is where the changes are taken from, the base itself when the
+	// commits do not share any history
+	MergeBase string             `json:"mergeBase"`
+	Files     []files.FileChange `json:"files"`
+}
+
+// Compare returns the files changed on head since it diverged from base in the extracted
+// repository of a project, like base...head does in git
+func (r *RepositoryManager) Compare(ctx context.Context, projectID, projectName, base, head string) (*Comparison, error) {
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	c, err := r.comparison(ctx, projectID, projectName, base, head)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Files, err = r.workspace.Diff(ctx, projectID, projectName, c.MergeBase, c.Head); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ComparePatch writes the unified diff of the changes returned by Compare to w. Nothing
+// is written when the commits cannot be resolved.
+func (r *RepositoryManager) ComparePatch(ctx context.Context, projectID, projectName, base, head string, w io.Writer) error {
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	c, err := r.comparison(ctx, projectID, projectName, base, head)
+	if err != nil {
+		return err
+	}
+
+	return r.workspace.Patch(ctx, projectID, projectName, c.MergeBase, c.Head, w)
+}
+
+// comparison resolves the commits compared, the caller holds the read lock of the project
+func (r *RepositoryManager) comparison(ctx context.Context, projectID, projectName, base, head string) (*Comparison, error) {
+	c := &Comparison{}
+	var err error
+	if c.Base, err = r.ResolveCommit(ctx, base, projectID, projectName); err != nil {
+		return nil, err
+	}
+	if c.Head, err = r.ResolveCommit(ctx, head, projectID, projectName); err != nil {
+		return nil, err
+	}
+
+	c.MergeBase, err = r.workspace.MergeBase(ctx, projectID, projectName, c.Base, c.Head)
+	if xerrors.Is(err, files.ErrNoMergeBase) {
+		c.MergeBase = c.Base
+	} else if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
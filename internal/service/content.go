@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+
+	"github.com/iantal/rm/internal/files"
+	"github.com/sirupsen/logrus"
+)
+
+// contentLock is the lock keeping the blob of a content from being released while
+// a commit is recorded as referencing it
+func contentLock(digest string) string {
+	return "sha256:" + digest
+}
+
+// storeContent stores the file under the key of its content, unless the same content
+// is stored already, and runs record with the key and the digest of the content. The
+// blob is not released before record, which is to reference it, returns.
+func (r *RepositoryManager) storeContent(ctx context.Context, f files.File, record func(key, digest string, size int64)) error {
+	digest, size, err := files.ContentDigest(f)
+	if err != nil {
+		return err
+	}
+	key := files.ContentKey(digest)
+
+	r.locks.Lock(contentLock(digest))
+	defer r.locks.Unlock(contentLock(digest))
+
+	if info, err := r.blobs.Stat(ctx, key); err == nil && info.Size == size {
+		r.l.WithFields(logrus.Fields{
+			"digest": digest,
+			"size":   size,
+		}).Info("Content stored already")
+	} else if err := r.blobs.Put(ctx, key, f); err != nil {
+		return err
+	}
+	record(key, digest, size)
+	return nil
+}
+
+// release deletes the blobs of the contents which no commit references any more
+func (r *RepositoryManager) release(ctx context.Context, digests []string) error {
+	for _, digest := range digests {
+		if err := r.releaseContent(ctx, digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RepositoryManager) releaseContent(ctx context.Context, digest string) error {
+	r.locks.Lock(contentLock(digest))
+	defer r.locks.Unlock(contentLock(digest))
+
+	n, err := r.db.CountDigestReferences(digest)
+	if err != nil || n > 0 {
+		return err
+	}
+	r.l.WithField("digest", digest).Info("Deleting unreferenced content")
+	return r.blobs.Delete(ctx, files.ContentKey(digest))
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/files"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// DeleteCommit removes the thin bundles of the commit of a project and soft deletes it.
+// Its bundle and archives are removed unless other commits have the same content. It waits
+// for the work in progress on the project, which then cannot start again until the commit
+// is gone.
+func (r *RepositoryManager) DeleteCommit(projectID, commit string) error {
+	r.locks.Lock(projectID)
+	defer r.locks.Unlock(projectID)
+
+	project := r.db.GetProjectByIDAndCommit(projectID, commit)
+	if project == nil {
+		return xerrors.Errorf("%q: %w", commit, files.ErrCommitNotFound)
+	}
+
+	r.l.WithFields(logrus.Fields{
+		"projectID": projectID,
+		"commit":    commit,
+	}).Info("Deleting commit")
+	thin, err := r.db.GetThinBundles(projectID, commit)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err := r.blobs.Delete(ctx, files.CommitKey(projectID, commit)); err != nil {
+		return err
+	}
+	r.hot.remove(files.CommitKey(projectID, commit))
+	if err := r.db.DeleteProjectCommit(projectID, commit); err != nil {
+		return err
+	}
+	return r.release(ctx, append(project.Digests(), thinDigests(thin)...))
+}
+
+// DeleteProject removes everything held for a project: the archive downloaded from rk,
+// the extracted repository and the files of every commit, and soft deletes its commits.
+// Contents shared with commits of other projects are kept. It waits for the work in
+// progress on the project.
+func (r *RepositoryManager) DeleteProject(projectID string) error {
+	r.locks.Lock(projectID)
+	defer r.locks.Unlock(projectID)
+
+	commits, err := r.db.GetProjectCommits(projectID)
+	if err != nil {
+		return err
+	}
+	thin, err := r.db.GetThinBundles(projectID, "")
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	blobs, err := r.blobs.List(ctx, files.ProjectKey(projectID))
+	if err != nil {
+		return err
+	}
+	if len(blobs) == 0 && len(commits) == 0 && !r.inWorkspace(projectID) {
+		return ErrProjectNotFound
+	}
+
+	r.l.WithField("projectID", projectID).Info("Deleting project")
+	if err := r.blobs.Delete(ctx, files.ProjectKey(projectID)); err != nil {
+		return err
+	}
+	if err := r.workspace.Remove(projectID); err != nil {
+		return err
+	}
+	r.names.Delete(projectID)
+	r.hot.remove(files.ProjectKey(projectID))
+	if err := r.db.DeleteProject(projectID); err != nil {
+		return err
+	}
+
+	digests := thinDigests(thin)
+	for _, c := range commits {
+		digests = append(digests, c.Digests()...)
+	}
+	return r.release(ctx, digests)
+}
+
+// thinDigests returns the digests of the contents of thin bundles
+func thinDigests(bundles []*domain.ThinBundle) []string {
+	digests := make([]string, 0, len(bundles))
+	for _, b := range bundles {
+		digests = append(digests, b.Digest)
+	}
+	return digests
+}
+
+// inWorkspace reports whether the workspace holds files of the project
+func (r *RepositoryManager) inWorkspace(projectID string) bool {
+	size, err := r.workspace.Usage(projectID)
+	return err != nil || size > 0
+}
+
+// OpenFile opens a blob of a project, such as a bundle or an archive, for serving it.
+// Once open the blob stays readable even if the project is deleted meanwhile.
+func (r *RepositoryManager) OpenFile(ctx context.Context, projectID, key string) (files.File, files.BlobInfo, error) {
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	return r.blobs.Get(ctx, key)
+}
+
+// PresignedURL returns a URL the blob of a project can be downloaded from without going
+// through rm, or an empty string when the blob store cannot provide one
+func (r *RepositoryManager) PresignedURL(ctx context.Context, projectID, key, filename string) string {
+	p, ok := r.blobs.(files.Presigner)
+	if !ok {
+		return ""
+	}
+
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	if _, err := r.blobs.Stat(ctx, key); err != nil {
+		return ""
+	}
+	u, err := p.PresignedURL(ctx, key, filename)
+	if err != nil {
+		r.l.WithFields(logrus.Fields{
+			"projectID": projectID,
+			"key":       key,
+			"error":     err,
+		}).Error("Unable to presign download")
+		return ""
+	}
+	return u
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iantal/rm/internal/files"
+	"github.com/iantal/rm/internal/repository"
+	"github.com/iantal/rm/internal/repository/repositorytest"
+	"github.com/iantal/rm/internal/util"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func setupInventory(t *testing.T) (*RepositoryManager, *files.Memory) {
+	dir, err := ioutil.TempDir("", "inventory")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	workspace, err := files.NewLocal(util.NewLogger(), dir, 0, files.NewGoGit())
+	assert.NoError(t, err)
+
+	db := repositorytest.NewDB(t)
+	l := util.NewLogger()
+	blobs := files.NewMemory()
+	r := NewRepositoryManager(l, blobs, workspace, repository.NewProjectDB(l, db), repository.NewDownloadStatusDB(l, db), nil)
+	return r, blobs
+}
+
+// addCommit records a commit of a project whose bundle has the given content
+func addCommit(t *testing.T, r *RepositoryManager, projectID, commit, content string) {
+	err := r.storeContent(context.Background(), memoryFile{bytes.NewReader([]byte(content))}, func(key, digest string, size int64) {
+		r.SaveToDb("project", projectID, commit, key, digest, size)
+	})
+	assert.NoError(t, err)
+}
+
+func exists(blobs *files.Memory, key string) bool {
+	_, err := blobs.Stat(context.Background(), key)
+	return err == nil
+}
+
+func TestDeleteCommitKeepsSharedContent(t *testing.T) {
+	r, blobs := setupInventory(t)
+	ctx := context.Background()
+	addCommit(t, r, testProjectID, "c1", "bundle")
+	addCommit(t, r, testProjectID, "c2", "bundle")
+	c1 := r.db.GetProjectByIDAndCommit(testProjectID, "c1")
+	thin := files.BundleKey(testProjectID, "c1", "project", "c0")
+	assert.NoError(t, blobs.Put(ctx, thin, strings.NewReader("thin")))
+
+	assert.NoError(t, r.DeleteCommit(testProjectID, "c1"))
+	assert.Nil(t, r.db.GetProjectByIDAndCommit(testProjectID, "c1"))
+	assert.False(t, exists(blobs, thin))
+	assert.True(t, exists(blobs, c1.BundlePath))
+
+	assert.NoError(t, r.DeleteCommit(testProjectID, "c2"))
+	assert.False(t, exists(blobs, c1.BundlePath))
+
+	err := r.DeleteCommit(testProjectID, "c2")
+	assert.True(t, xerrors.Is(err, ErrCommitNotFound))
+}
+
+func TestDeleteProjectRemovesEverythingButSharedContent(t *testing.T) {
+	r, blobs := setupInventory(t)
+	ctx := context.Background()
+	other := "7d1c3b52-4e1d-4a4b-9a5e-3c7c1d1f2a10"
+	addCommit(t, r, testProjectID, "c1", "bundle")
+	addCommit(t, r, testProjectID, "c2", "other bundle")
+	addCommit(t, r, other, "c1", "bundle")
+	shared := r.db.GetProjectByIDAndCommit(testProjectID, "c1").BundlePath
+	own := r.db.GetProjectByIDAndCommit(testProjectID, "c2").BundlePath
+	zipKey := files.ZipKey(testProjectID, "project")
+	assert.NoError(t, blobs.Put(ctx, zipKey, bytes.NewReader(testZip(t, "content"))))
+
+	assert.NoError(t, r.DeleteProject(testProjectID))
+	assert.False(t, exists(blobs, zipKey))
+	assert.False(t, exists(blobs, own))
+	assert.True(t, exists(blobs, shared))
+	commits, err := r.db.GetProjectCommits(testProjectID)
+	assert.NoError(t, err)
+	assert.Empty(t, commits)
+	assert.NotNil(t, r.db.GetProjectByIDAndCommit(other, "c1"))
+
+	assert.True(t, xerrors.Is(r.DeleteProject(testProjectID), ErrProjectNotFound))
+}
+
+func TestDeleteCommitWaitsForDownloads(t *testing.T) {
+	r, blobs := setupInventory(t)
+	ctx := context.Background()
+	addCommit(t, r, testProjectID, "c1", "bundle")
+	project := r.db.GetProjectByIDAndCommit(testProjectID, "c1")
+
+	// a download in progress keeps reading the bundle it opened
+	f, _, err := r.OpenFile(ctx, testProjectID, project.BundlePath)
+	assert.NoError(t, err)
+	r.locks.RLock(testProjectID)
+	deleted := make(chan error)
+	go func() { deleted <- r.DeleteCommit(testProjectID, "c1") }()
+	select {
+	case <-deleted:
+		t.Fatal("Commit deleted while it is being downloaded")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.locks.RUnlock(testProjectID)
+	assert.NoError(t, <-deleted)
+	b, err := ioutil.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "bundle", string(b))
+
+	// later downloads find the commit gone, and do not store bundles for it again
+	_, _, err = r.OpenFile(ctx, testProjectID, project.BundlePath)
+	assert.True(t, xerrors.Is(err, os.ErrNotExist))
+	_, _, err = r.ThinBundle(ctx, project, []string{"c0"})
+	assert.True(t, xerrors.Is(err, ErrCommitNotFound))
+	blobsLeft, err := blobs.List(ctx, files.CommitKey(testProjectID, "c1"))
+	assert.NoError(t, err)
+	assert.Empty(t, blobsLeft)
+}
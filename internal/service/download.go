@@ -1,23 +1,26 @@
 package service
 
 import (
-	"encoding/json"
-	"fmt"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"io"
-	"io/ioutil"
-	"net/http"
 	"os"
+	"time"
 
-	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/files"
+	"github.com/iantal/rm/internal/rk"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
 )
 
 func (r *RepositoryManager) IsDownloaded(projectID, projectName string) bool {
-	zipPath := r.store.ZipFilePath(projectID, projectName)
-	if _, err := os.Stat(zipPath); os.IsNotExist(err) {
+	zipKey := files.ZipKey(projectID, projectName)
+	if _, err := r.blobs.Stat(context.Background(), zipKey); xerrors.Is(err, os.ErrNotExist) {
 		r.l.WithFields(logrus.Fields{
 			"projectID": projectID,
-			"zipFile": zipPath,	
+			"zipFile":   zipKey,
 		}).Info("Zip not found")
 		return false
 	}
@@ -26,56 +29,210 @@ func (r *RepositoryManager) IsDownloaded(projectID, projectName string) bool {
 
 func (r *RepositoryManager) DownloadZip(projectID, projectName string) (string, error) {
 	if !r.IsDownloaded(projectID, projectName) {
-		r.l.WithField("projectId", projectID).Info("Getting project name from rk")
-		resp, err := http.DefaultClient.Get("http://" + r.rkHost + "/api/v1/projects/" + projectID + "/download")
-		if err != nil {
+		if err := r.fetchZip(context.Background(), projectID, projectName); err != nil {
 			return "", err
 		}
+	}
+	return files.ZipKey(projectID, projectName), nil
+}
 
-		if resp.StatusCode != http.StatusOK {
-			return "", fmt.Errorf("Expected error code 200 got %d", resp.StatusCode)
-		}
+// maxResumes bounds the number of times an interrupted download is resumed
+const maxResumes = 10
 
-		r.saveZip(projectID, projectName, resp.Body)
-		resp.Body.Close()
+// fetchZip downloads the archive of the project from rk, replacing the one stored before.
+// A failed download leaves the archive stored before in place.
+func (r *RepositoryManager) fetchZip(ctx context.Context, projectID, projectName string) error {
+	f, err := r.downloadZip(ctx, projectID)
+	if err != nil {
+		return err
 	}
-	return r.store.ZipFilePath(projectID, projectName), nil
+	defer f.Close()
+	return r.storeZip(projectID, projectName, f)
 }
 
-func (r *RepositoryManager) GetProjectName(projectID string) (string, error) {
-	resp, err := http.DefaultClient.Get("http://" + r.rkHost + "/api/v1/projects/" + projectID)
+// downloadZip downloads the archive of the project from rk into a file of the workspace,
+// which the caller closes. An interrupted download is resumed from the bytes received as
+// long as it makes progress. The archive is returned once it is complete, matches the
+// digest rk announced, and reads through.
+func (r *RepositoryManager) downloadZip(ctx context.Context, projectID string) (_ files.TempFile, err error) {
+	// the download is spooled next to the blobs so that storing it moves it in place
+	f, err := r.workspace.Spool(projectID)
 	if err != nil {
-		return "", err
+		return nil, classify(err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+
+	d := r.downloads.start(projectID)
+	defer r.downloads.finish(projectID, d)
+
+	var archive *rk.Archive
+	var written int64
+	for resumes := 0; ; resumes++ {
+		validator := ""
+		if archive != nil {
+			validator = archive.Validator
+		}
+		archive, err = r.rk.Download(ctx, projectID, written, validator)
+		if err != nil {
+			return nil, classify(err)
+		}
+
+		before := written
+		written, err = r.receive(projectID, f, d, archive, written, resumes > 0)
+		archive.Close()
+		if err == nil {
+			break
+		}
+		if !xerrors.Is(err, ErrUpstreamUnavailable) || ctx.Err() != nil {
+			return nil, classify(err)
+		}
+		if written <= before || archive.Validator == "" || resumes == maxResumes {
+			r.l.WithFields(logrus.Fields{
+				"projectID": projectID,
+				"bytes":     written,
+				"resumes":   resumes,
+				"error":     err,
+			}).Error("Download from rk interrupted")
+			return nil, withKind(ErrUpstreamUnavailable, xerrors.Errorf("Download interrupted after %d bytes: %w", written, err))
+		}
+		r.l.WithFields(logrus.Fields{
+			"projectID": projectID,
+			"offset":    written,
+			"total":     archive.Size,
+			"error":     err,
+		}).Warn("Resuming download from rk")
+	}
+
+	if err := verifyDownload(f, written, archive); err != nil {
+		r.l.WithFields(logrus.Fields{
+			"projectID": projectID,
+			"error":     err,
+		}).Error("Rejecting download from rk")
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, xerrors.Errorf("Unable to rewind download: %w", err)
 	}
+	return f, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("Expected error code 200 got %d", resp.StatusCode)
+// storeZip stores the archive downloaded for the project and records when it was fetched
+func (r *RepositoryManager) storeZip(projectID, projectName string, f files.TempFile) error {
+	if err := r.saveZip(projectID, projectName, f); err != nil {
+		return err
 	}
-	defer resp.Body.Close()
+	r.refreshed.Store(projectID, time.Now())
+	return nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+// receive appends the body of the archive to f, which holds the first written bytes of
+// the archive, and returns the number of bytes f holds then. The bytes held are dropped
+// when rk sends the archive from its start again.
+func (r *RepositoryManager) receive(projectID string, f files.TempFile, d *download, archive *rk.Archive, written int64, resumed bool) (int64, error) {
+	if archive.Offset != written {
+		if archive.Offset != 0 {
+			return written, withKind(ErrUpstreamUnavailable, xerrors.Errorf("rk resumed the download at %d instead of %d", archive.Offset, written))
+		}
+		if err := f.Truncate(0); err != nil {
+			return written, xerrors.Errorf("Unable to truncate download: %w", err)
+		}
+		written = 0
+	}
+	if _, err := f.Seek(written, io.SeekStart); err != nil {
+		return written, xerrors.Errorf("Unable to seek download: %w", err)
+	}
+	d.begin(written, archive.Size, resumed)
+
+	body := io.Reader(rkReader{archive})
+	if written == 0 {
+		// reject archives none of the extractors can handle before downloading them
+		br := bufio.NewReaderSize(body, files.HeaderSize)
+		header, _ := br.Peek(files.HeaderSize)
+		format, err := files.DetectFormat(header, archive.ContentType)
+		if err != nil {
+			return written, err
+		}
+		r.l.WithFields(logrus.Fields{
+			"projectID": projectID,
+			"format":    format,
+			"size":      archive.Size,
+		}).Info("Downloading archive from rk")
+		body = br
+	}
+
+	n, err := io.Copy(io.MultiWriter(f, d), body)
+	return written + n, err
+}
+
+// rkReader marks the errors reading the body of an archive as failures of rk, unlike
+// the errors writing it
+type rkReader struct {
+	io.Reader
+}
+
+func (r rkReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err != nil && err != io.EOF {
+		err = withKind(ErrUpstreamUnavailable, err)
+	}
+	return n, err
+}
+
+// verifyDownload checks the length and digest of the archive in f against the ones rk
+// announced, then that the archive reads through
+func verifyDownload(f files.TempFile, written int64, archive *rk.Archive) error {
+	if archive.Size >= 0 && written != archive.Size {
+		return withKind(ErrUpstreamUnavailable, xerrors.Errorf("Downloaded %d bytes, rk announced %d", written, archive.Size))
+	}
+	if archive.SHA256 != nil {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return xerrors.Errorf("Unable to rewind download: %w", err)
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return xerrors.Errorf("Unable to read download: %w", err)
+		}
+		if !bytes.Equal(h.Sum(nil), archive.SHA256) {
+			return withKind(ErrUpstreamUnavailable, xerrors.New("Downloaded archive does not match the digest rk announced"))
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return classify(xerrors.Errorf("Unable to write download: %w", err))
+	}
+	return classify(files.VerifyArchive(f.Name()))
+}
+
+// GetProjectName returns the name of the project from rk. Names are cached since the
+// keys of the blobs depend on them.
+func (r *RepositoryManager) GetProjectName(projectID string) (string, error) {
+	if name, ok := r.names.Load(projectID); ok {
+		return name.(string), nil
 	}
 
-	project := &domain.Project{}
-	err = json.Unmarshal(body, project)
+	project, err := r.rk.Project(context.Background(), projectID)
 	if err != nil {
-		return "", err
+		return "", classify(err)
 	}
+	r.names.Store(projectID, project.Name)
 	return project.Name, nil
 }
 
-func (r *RepositoryManager) saveZip(projectID, projectName string, content io.ReadCloser) {
+// saveZip stores the archive of the project, the archive stored before is replaced once
+// the new one is complete
+func (r *RepositoryManager) saveZip(projectID, projectName string, content io.Reader) error {
 	r.l.WithField("projectID", projectID).Info("Saving project to storage")
-	zipFile := r.store.ZipFilePath(projectID, projectName)
-	err := r.store.Save(zipFile, content)
+	err := r.blobs.Put(context.Background(), files.ZipKey(projectID, projectName), content)
 	if err != nil {
 		r.l.WithFields(logrus.Fields{
 			"projectID":   projectID,
 			"projectName": projectName,
 			"error":       err,
 		}).Error("Unable to save zip")
-		return
+		return classify(err)
 	}
+	return nil
 }
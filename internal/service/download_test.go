@@ -0,0 +1,155 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/iantal/rm/internal/files"
+	"github.com/iantal/rm/internal/rk"
+	"github.com/iantal/rm/internal/rk/rktest"
+	"github.com/iantal/rm/internal/util"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+const testProjectID = "0b6c3b52-4e1d-4a4b-9a5e-3c7c1d1f2a10"
+
+func testZip(t *testing.T, content string) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	w, err := zw.Create("README.md")
+	assert.NoError(t, err)
+	w.Write([]byte(content))
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func setupDownloads(t *testing.T) (*RepositoryManager, *rktest.Server, *files.Memory) {
+	s := rktest.NewServer()
+	client, err := rk.NewClient(util.NewLogger(), rk.Options{BaseURL: s.URL, Retries: -1})
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "downloads")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	workspace, err := files.NewLocal(util.NewLogger(), dir, 0, files.NewGoGit())
+	assert.NoError(t, err)
+	blobs := files.NewMemory()
+	return &RepositoryManager{l: util.NewLogger(), blobs: blobs, workspace: workspace, rk: client, locks: newProjectLocks(), downloads: newDownloads(util.NewLogger())}, s, blobs
+}
+
+func TestFetchZipSpoolsToTheWorkspace(t *testing.T) {
+	r, s, _ := setupDownloads(t)
+	defer s.Close()
+	ctx := context.Background()
+	local := r.workspace.(*files.Local)
+	r.blobs = local
+
+	archive := testZip(t, "content")
+	s.AddProject(testProjectID, "project", archive, "application/zip")
+	assert.NoError(t, r.fetchZip(ctx, testProjectID, "project"))
+	f, _, err := local.Get(ctx, files.ZipKey(testProjectID, "project"))
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(f)
+	f.Close()
+	assert.Equal(t, archive, b)
+
+	// nothing is left in the workspace, whether the download is stored or rejected
+	s.Corrupt(testProjectID, archive[:len(archive)-10])
+	assert.Error(t, r.fetchZip(ctx, testProjectID, "project"))
+	entries, err := ioutil.ReadDir(local.FullPath(testProjectID + "/unzip"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestFetchZipStoresVerifiedArchivesOnly(t *testing.T) {
+	r, s, blobs := setupDownloads(t)
+	defer s.Close()
+	ctx := context.Background()
+	key := files.ZipKey(testProjectID, "project")
+
+	archive := testZip(t, "first")
+	s.AddProject(testProjectID, "project", archive, "application/zip")
+	assert.NoError(t, r.fetchZip(ctx, testProjectID, "project"))
+
+	// a truncated download or one not matching the digest leaves the archive in place
+	next := testZip(t, "second")
+	s.AddProject(testProjectID, "project", next, "application/zip")
+	s.Corrupt(testProjectID, next[:len(next)-10])
+	err := r.fetchZip(ctx, testProjectID, "project")
+	assert.True(t, xerrors.Is(err, ErrUpstreamUnavailable))
+
+	tampered := append([]byte{}, next...)
+	tampered[len(tampered)-30] ^= 0xff
+	s.Corrupt(testProjectID, tampered)
+	err = r.fetchZip(ctx, testProjectID, "project")
+	assert.True(t, xerrors.Is(err, ErrUpstreamUnavailable))
+
+	f, _, err := blobs.Get(ctx, key)
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(f)
+	assert.Equal(t, archive, b)
+
+	// an archive rk serves as announced which does not read through is rejected
+	s.AddProject(testProjectID, "project", next[:len(next)-10], "application/zip")
+	err = r.fetchZip(ctx, testProjectID, "project")
+	assert.True(t, xerrors.Is(err, ErrArchiveInvalid))
+}
+
+func TestVerifyDownloadsQuarantinesCorruptArchives(t *testing.T) {
+	r, s, blobs := setupDownloads(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	other := "7d1c3b52-4e1d-4a4b-9a5e-3c7c1d1f2a10"
+	archive := testZip(t, "content")
+	assert.NoError(t, blobs.Put(ctx, files.ZipKey(testProjectID, "project"), bytes.NewReader(archive)))
+	assert.NoError(t, blobs.Put(ctx, files.ZipKey(other, "other"), bytes.NewReader(archive[:len(archive)-10])))
+	assert.NoError(t, blobs.Put(ctx, files.BundleKey(other, "c1", "other"), bytes.NewReader([]byte("not an archive"))))
+	assert.NoError(t, r.workspace.Extract(ctx, testProjectID, "project", bytes.NewReader(archive)))
+	assert.NoError(t, r.workspace.Extract(ctx, other, "other", bytes.NewReader(archive)))
+
+	n, err := r.VerifyDownloads(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = blobs.Stat(ctx, files.ZipKey(testProjectID, "project"))
+	assert.NoError(t, err)
+	_, err = blobs.Stat(ctx, files.ZipKey(other, "other"))
+	assert.True(t, xerrors.Is(err, os.ErrNotExist))
+	_, err = blobs.Stat(ctx, "quarantine/"+files.ZipKey(other, "other"))
+	assert.NoError(t, err)
+	_, err = blobs.Stat(ctx, files.BundleKey(other, "c1", "other"))
+	assert.NoError(t, err)
+	assert.True(t, r.workspace.Extracted(testProjectID, "project"))
+	assert.False(t, r.workspace.Extracted(other, "other"))
+}
+
+func TestFetchZipResumesInterruptedDownloads(t *testing.T) {
+	r, s, blobs := setupDownloads(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	archive := testZip(t, "content")
+	s.AddProject(testProjectID, "project", archive, "application/zip")
+	resumes := downloadResumes.Value()
+	s.DropAfter(10, 20)
+	assert.NoError(t, r.fetchZip(ctx, testProjectID, "project"))
+	assert.Equal(t, []string{"", "bytes=10-", "bytes=30-"}, s.Ranges())
+	assert.Equal(t, resumes+2, downloadResumes.Value())
+	assert.Nil(t, r.downloads.progress(testProjectID))
+
+	f, _, err := blobs.Get(ctx, files.ZipKey(testProjectID, "project"))
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(f)
+	assert.Equal(t, archive, b)
+
+	// a resumed download receiving nothing is given up
+	s.DropAfter(10, 0)
+	err = r.fetchZip(ctx, testProjectID, "project")
+	assert.True(t, xerrors.Is(err, ErrUpstreamUnavailable))
+	assert.Len(t, s.Ranges(), 5)
+}
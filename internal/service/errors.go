@@ -0,0 +1,110 @@
+package service
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/iantal/rm/internal/files"
+	"github.com/iantal/rm/internal/rk"
+	"golang.org/x/xerrors"
+)
+
+// Kinds of failures of the RepositoryManager, errors of a kind satisfy xerrors.Is with it
+var (
+	// ErrProjectNotFound is returned when rm holds nothing for a project or rk does not know it
+	ErrProjectNotFound = errors.New("Project not found")
+	// ErrCommitNotFound is returned when a revision does not resolve to a commit of the project
+	ErrCommitNotFound = files.ErrCommitNotFound
+	// ErrUpstreamUnavailable is returned when rk cannot be reached or fails to answer
+	ErrUpstreamUnavailable = errors.New("rk is unavailable")
+	// ErrArchiveInvalid is returned when the archive downloaded from rk is rejected
+	ErrArchiveInvalid = errors.New("Archive of the project is invalid")
+	// ErrStorageFull is returned when there is no space left to store the files of a project
+	ErrStorageFull = errors.New("Storage is full")
+)
+
+// Codes identifying the kinds of failures to clients, they are recorded on failed jobs and
+// do not change between versions
+const (
+	CodeProjectNotFound     = "project_not_found"
+	CodeCommitNotFound      = "commit_not_found"
+	CodeUpstreamUnavailable = "upstream_unavailable"
+	CodeArchiveInvalid      = "archive_invalid"
+	CodeStorageFull         = "storage_full"
+)
+
+var codes = []struct {
+	kind error
+	code string
+}{
+	{ErrProjectNotFound, CodeProjectNotFound},
+	{ErrCommitNotFound, CodeCommitNotFound},
+	{ErrUpstreamUnavailable, CodeUpstreamUnavailable},
+	{ErrArchiveInvalid, CodeArchiveInvalid},
+	{ErrStorageFull, CodeStorageFull},
+}
+
+// ErrorCode returns the code of the kind of err, or an empty string for unexpected errors
+func ErrorCode(err error) string {
+	_, code := kindOf(err)
+	return code
+}
+
+// KindOf returns the kind of err, one of the errors above, or nil for unexpected errors
+func KindOf(err error) error {
+	kind, _ := kindOf(err)
+	return kind
+}
+
+func kindOf(err error) (error, string) {
+	err = classify(err)
+	for _, c := range codes {
+		if xerrors.Is(err, c.kind) {
+			return c.kind, c.code
+		}
+	}
+	return nil, ""
+}
+
+// kindError marks an error as being of a kind of failure while keeping its cause
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// withKind marks err as being of the given kind
+func withKind(kind, err error) error {
+	if err == nil || xerrors.Is(err, kind) {
+		return err
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// classify gives their kind to the errors of the storage, the extractors and rk
+func classify(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case files.IsArchiveError(err):
+		return withKind(ErrArchiveInvalid, err)
+	case xerrors.Is(err, syscall.ENOSPC):
+		return withKind(ErrStorageFull, err)
+	case xerrors.Is(err, rk.ErrNotFound):
+		return withKind(ErrProjectNotFound, err)
+	case xerrors.Is(err, rk.ErrUnavailable):
+		return withKind(ErrUpstreamUnavailable, err)
+	}
+	return err
+}
@@ -0,0 +1,29 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/iantal/rm/internal/files"
+	"github.com/iantal/rm/internal/rk"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestErrorCodeClassifiesFailures(t *testing.T) {
+	assert.Equal(t, CodeCommitNotFound, ErrorCode(xerrors.Errorf("%q: %w", "main", files.ErrCommitNotFound)))
+	assert.Equal(t, CodeUpstreamUnavailable, ErrorCode(withKind(ErrUpstreamUnavailable, errors.New("connection refused"))))
+	assert.Equal(t, CodeArchiveInvalid, ErrorCode(&files.ArchiveError{Err: files.ErrInvalidArchive}))
+	assert.Equal(t, CodeStorageFull, ErrorCode(&os.PathError{Op: "write", Path: "p.zip", Err: syscall.ENOSPC}))
+	assert.Equal(t, CodeProjectNotFound, ErrorCode(xerrors.Errorf("GET /api/v1/projects/p: %w", rk.ErrNotFound)))
+	assert.Equal(t, CodeUpstreamUnavailable, ErrorCode(xerrors.Errorf("Circuit open: %w", rk.ErrUnavailable)))
+	assert.Equal(t, "", ErrorCode(errors.New("unexpected")))
+
+	// the kind is kept along with the cause
+	err := classify(&files.ArchiveError{Err: files.ErrInvalidArchive})
+	assert.True(t, xerrors.Is(err, ErrArchiveInvalid))
+	assert.True(t, files.IsArchiveError(err))
+	assert.Equal(t, ErrStorageFull, KindOf(xerrors.Errorf("Unable to save: %w", withKind(ErrStorageFull, syscall.ENOSPC))))
+}
@@ -0,0 +1,370 @@
+package service
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/files"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// GCConfig bounds the space used by the blobs and the workspace. Once the usage
+// crosses HighWater of Quota, files are evicted until it falls below LowWater of Quota.
+type GCConfig struct {
+	// Quota is the number of bytes rm may use, 0 disables the collector
+	Quota     int64
+	HighWater float64
+	LowWater  float64
+	// Interval is the time between two checks of the usage
+	Interval time.Duration
+}
+
+const defaultGCInterval = 5 * time.Minute
+
+// StartCollector checks the usage of the storage periodically and evicts the least
+// recently used files of unpinned projects when it is too high. It stops with ctx.
+func (r *RepositoryManager) StartCollector(ctx context.Context, cfg GCConfig) {
+	if cfg.Quota <= 0 {
+		r.l.Info("Storage quota not set, garbage collection disabled")
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultGCInterval
+	}
+
+	go func() {
+		t := time.NewTicker(cfg.Interval)
+		defer t.Stop()
+		for {
+			if _, err := r.Collect(ctx, cfg); err != nil {
+				r.l.WithField("error", err).Error("Garbage collection failed")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// Collect evicts files when the usage is above the high-water mark. Contents no commit
+// references and the archives quarantined for longer than quarantineRetention go first,
+// then bundles, snapshots, extracted repositories and finally the archives downloaded
+// from rk, least recently used first. Pinned projects are left untouched. Blobs kept out
+// of the local storage, in a bucket, neither count toward the quota nor are evicted. It
+// returns the number of bytes freed.
+func (r *RepositoryManager) Collect(ctx context.Context, cfg GCConfig) (int64, error) {
+	_, local := r.blobs.(*files.Local)
+	var blobs []files.BlobInfo
+	if local {
+		var err error
+		if blobs, err = r.blobs.List(ctx, ""); err != nil {
+			return 0, err
+		}
+	}
+	usage, err := r.workspace.Usage("")
+	if err != nil {
+		return 0, err
+	}
+	for _, b := range blobs {
+		usage += b.Size
+	}
+	high := int64(float64(cfg.Quota) * cfg.HighWater)
+	low := int64(float64(cfg.Quota) * cfg.LowWater)
+	r.l.WithFields(logrus.Fields{
+		"usage": usage,
+		"quota": cfg.Quota,
+	}).Debug("Storage usage")
+	if usage < high {
+		return 0, nil
+	}
+
+	r.l.WithFields(logrus.Fields{
+		"usage":     usage,
+		"highWater": high,
+		"lowWater":  low,
+	}).Warn("Storage usage above high-water mark, evicting")
+
+	pinned, err := r.db.GetPinnedProjects()
+	if err != nil {
+		return 0, err
+	}
+
+	var freed int64
+	evict := func(projectID, key string, size int64, remove func() error) (bool, error) {
+		if err := remove(); err != nil {
+			return false, err
+		}
+		freed += size
+		r.l.WithFields(logrus.Fields{
+			"projectID": projectID,
+			"key":       key,
+			"size":      size,
+		}).Info("Evicted")
+		return usage-freed <= low || ctx.Err() != nil, nil
+	}
+
+	expired := time.Now().Add(-quarantineRetention)
+	for _, b := range blobs {
+		var remove func() error
+		switch {
+		case strings.HasPrefix(b.Key, files.ContentPrefix+"/"):
+			digest := path.Base(b.Key)
+			if n, err := r.db.CountDigestReferences(digest); err != nil || n > 0 {
+				continue
+			}
+			remove = func() error { return r.releaseContent(ctx, digest) }
+		case strings.HasPrefix(b.Key, quarantinePrefix+"/") && b.ModTime.Before(expired):
+			key := b.Key
+			remove = func() error { return r.blobs.Delete(ctx, key) }
+		default:
+			continue
+		}
+		done, err := evict("", b.Key, b.Size, remove)
+		if err != nil || done {
+			return freed, err
+		}
+	}
+
+	commits, err := r.db.GetEvictableCommits()
+	if err != nil {
+		return freed, err
+	}
+	for _, c := range commits {
+		projectID := c.ProjectID.String()
+		size := r.bundleSize(blobs, c)
+		if pinned[projectID] || size == 0 {
+			continue
+		}
+		key := files.CommitKey(projectID, c.CommitHash)
+		done, err := evict(projectID, key, size, func() error {
+			return r.evictBundles(ctx, projectID, c.CommitHash)
+		})
+		if xerrors.Is(err, files.ErrCommitNotFound) {
+			// deleted meanwhile
+			continue
+		}
+		if err != nil || done {
+			return freed, err
+		}
+	}
+	for _, c := range commits {
+		projectID := c.ProjectID.String()
+		if pinned[projectID] {
+			continue
+		}
+		for _, format := range []files.Format{files.FormatZip, files.FormatTarGz} {
+			size := r.contentSize(blobs, c.Archive(string(format)).Path, c.Archive(string(format)).Digest)
+			if size == 0 {
+				continue
+			}
+			done, err := evict(projectID, c.Archive(string(format)).Path, size, func() error {
+				return r.evictArchive(ctx, projectID, c.CommitHash, format)
+			})
+			if xerrors.Is(err, files.ErrCommitNotFound) {
+				break
+			}
+			if err != nil || done {
+				return freed, err
+			}
+		}
+	}
+
+	projects, err := r.projectsByLastAccess(blobs, pinned)
+	if err != nil {
+		return freed, err
+	}
+	for _, projectID := range projects {
+		size, err := r.workspace.Usage(projectID)
+		if err != nil {
+			return freed, err
+		}
+		done, err := evict(projectID, "workspace", size, func() error {
+			r.locks.Lock(projectID)
+			defer r.locks.Unlock(projectID)
+			return r.workspace.Remove(projectID)
+		})
+		if err != nil || done {
+			return freed, err
+		}
+	}
+	for _, projectID := range projects {
+		if !local {
+			break
+		}
+		// the archive, whatever the name of the project
+		key := files.ZipPrefix(projectID)
+		done, err := evict(projectID, key, sizeBelow(blobs, key), func() error {
+			r.locks.Lock(projectID)
+			defer r.locks.Unlock(projectID)
+			return r.blobs.Delete(ctx, key)
+		})
+		if err != nil || done {
+			return freed, err
+		}
+	}
+	return freed, nil
+}
+
+// evictBundles removes the bundles of the commit of a project: its thin bundles and its
+// bundle unless other commits have the same content. The commit and its archives are
+// kept, its bundle is built again when the commit is prepared.
+func (r *RepositoryManager) evictBundles(ctx context.Context, projectID, commit string) error {
+	r.locks.Lock(projectID)
+	defer r.locks.Unlock(projectID)
+
+	project := r.db.GetProjectByIDAndCommit(projectID, commit)
+	if project == nil {
+		return xerrors.Errorf("%q: %w", commit, files.ErrCommitNotFound)
+	}
+	thin, err := r.db.GetThinBundles(projectID, commit)
+	if err != nil {
+		return err
+	}
+	if err := r.db.DeleteThinBundles(project); err != nil {
+		return err
+	}
+	// thin bundles stored before they were stored by content
+	if err := r.blobs.Delete(ctx, files.ThinBundlesKey(projectID, commit)); err != nil {
+		return err
+	}
+	digests := thinDigests(thin)
+	if project.BundlePath != "" {
+		if err := r.db.ClearBundle(project); err != nil {
+			return err
+		}
+		if project.BundleDigest == "" {
+			// stored before bundles were stored by content
+			if err := r.blobs.Delete(ctx, project.BundlePath); err != nil {
+				return err
+			}
+		} else {
+			digests = append(digests, project.BundleDigest)
+		}
+	}
+	return r.release(ctx, digests)
+}
+
+// evictArchive removes the snapshot of the commit of a project in the given format unless
+// other commits have the same content. It is built again when it is asked for.
+func (r *RepositoryManager) evictArchive(ctx context.Context, projectID, commit string, format files.Format) error {
+	r.locks.Lock(projectID)
+	defer r.locks.Unlock(projectID)
+
+	project := r.db.GetProjectByIDAndCommit(projectID, commit)
+	if project == nil {
+		return xerrors.Errorf("%q: %w", commit, files.ErrCommitNotFound)
+	}
+	a := *project.Archive(string(format))
+	if a.Path == "" {
+		return nil
+	}
+	*project.Archive(string(format)) = domain.Archive{}
+	if err := r.db.SaveArchive(project, string(format)); err != nil {
+		return err
+	}
+	if a.Digest == "" {
+		return r.blobs.Delete(ctx, a.Path)
+	}
+	return r.release(ctx, []string{a.Digest})
+}
+
+// bundleSize returns the number of bytes freed by evicting the bundles of the commit,
+// contents shared with other commits are kept
+func (r *RepositoryManager) bundleSize(blobs []files.BlobInfo, c *domain.Project) int64 {
+	size := sizeBelow(blobs, files.ThinBundlesKey(c.ProjectID.String(), c.CommitHash))
+	if thin, err := r.db.GetThinBundles(c.ProjectID.String(), c.CommitHash); err == nil {
+		for _, b := range thin {
+			size += r.contentSize(blobs, files.ContentKey(b.Digest), b.Digest)
+		}
+	}
+	return size + r.contentSize(blobs, c.BundlePath, c.BundleDigest)
+}
+
+// contentSize returns the number of bytes freed by removing the blob under key from the
+// commit which references it, nothing when the blob is shared with other commits
+func (r *RepositoryManager) contentSize(blobs []files.BlobInfo, key, digest string) int64 {
+	if key == "" {
+		return 0
+	}
+	if digest == "" {
+		return sizeBelow(blobs, key)
+	}
+	if n, err := r.db.CountDigestReferences(digest); err == nil && n <= 1 {
+		return sizeBelow(blobs, files.ContentKey(digest))
+	}
+	return 0
+}
+
+// sizeBelow returns the number of bytes of the blobs below the key
+func sizeBelow(blobs []files.BlobInfo, key string) int64 {
+	var size int64
+	for _, b := range blobs {
+		if b.Key == key || strings.HasPrefix(b.Key, key+"/") {
+			size += b.Size
+		}
+	}
+	return size
+}
+
+// projectsByLastAccess returns the unpinned projects with blobs or files in the workspace,
+// least recently used first. Projects without any access recorded are ordered by the time
+// their blobs were last written.
+func (r *RepositoryManager) projectsByLastAccess(blobs []files.BlobInfo, pinned map[string]bool) ([]string, error) {
+	written := map[string]time.Time{}
+	for _, b := range blobs {
+		projectID := strings.SplitN(b.Key, "/", 2)[0]
+		if b.ModTime.After(written[projectID]) || written[projectID].IsZero() {
+			written[projectID] = b.ModTime
+		}
+	}
+	inWorkspace, err := r.workspace.Projects()
+	if err != nil {
+		return nil, err
+	}
+	for _, projectID := range inWorkspace {
+		if _, ok := written[projectID]; !ok {
+			written[projectID] = time.Time{}
+		}
+	}
+
+	type candidate struct {
+		projectID string
+		used      time.Time
+	}
+	var candidates []candidate
+	for projectID, t := range written {
+		if _, err := uuid.Parse(projectID); err != nil || pinned[projectID] {
+			continue
+		}
+		c := candidate{projectID: projectID, used: t}
+		if s, err := r.db.GetProjectSummary(projectID); err == nil && s != nil && s.LastAccessedAt != nil {
+			c.used = *s.LastAccessedAt
+		}
+		candidates = append(candidates, c)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].used.Before(candidates[j].used) })
+	projects := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		projects = append(projects, c.projectID)
+	}
+	return projects, nil
+}
+
+// Pin protects the files of a project from eviction
+func (r *RepositoryManager) Pin(projectID string) error {
+	return r.db.Pin(projectID)
+}
+
+// Unpin lets the files of a project be evicted again
+func (r *RepositoryManager) Unpin(projectID string) error {
+	return r.db.Unpin(projectID)
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/files"
+	"github.com/iantal/rm/internal/repository"
+	"github.com/iantal/rm/internal/repository/repositorytest"
+	"github.com/iantal/rm/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+var gcProjects = []string{
+	"11111111-4e1d-4a4b-9a5e-3c7c1d1f2a10",
+	"22222222-4e1d-4a4b-9a5e-3c7c1d1f2a10",
+	"33333333-4e1d-4a4b-9a5e-3c7c1d1f2a10",
+	"44444444-4e1d-4a4b-9a5e-3c7c1d1f2a10",
+}
+
+// setupCollector creates a RepositoryManager whose workspace is on local storage, as are
+// the blobs unless others are given
+func setupCollector(t *testing.T, blobs files.BlobStore) (*RepositoryManager, *files.Local) {
+	dir, err := ioutil.TempDir("", "gc")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	local, err := files.NewLocal(util.NewLogger(), dir, 0, files.NewGoGit())
+	assert.NoError(t, err)
+	if blobs == nil {
+		blobs = local
+	}
+
+	db := repositorytest.NewDB(t)
+	l := util.NewLogger()
+	return NewRepositoryManager(l, blobs, local, repository.NewProjectDB(l, db), repository.NewDownloadStatusDB(l, db), nil), local
+}
+
+// addBundle records a commit of a project with a bundle of size bytes last accessed at t
+func addBundle(t *testing.T, r *RepositoryManager, projectID string, size int, accessed time.Time) *domain.Project {
+	addCommit(t, r, projectID, "c1", projectID+strings.Repeat("0", size-len(projectID)))
+	p := r.db.GetProjectByIDAndCommit(projectID, "c1")
+	assert.NoError(t, r.db.SetLastAccessed(p, accessed))
+	return p
+}
+
+func TestCollectEvictsLeastRecentlyUsedBundlesDownToTheLowWaterMark(t *testing.T) {
+	r, _ := setupCollector(t, nil)
+	ctx := context.Background()
+	start := time.Now().Add(-time.Hour)
+	var bundles []*domain.Project
+	for i, projectID := range gcProjects {
+		bundles = append(bundles, addBundle(t, r, projectID, 100, start.Add(time.Duration(i)*time.Minute)))
+	}
+	assert.NoError(t, r.Pin(gcProjects[0]))
+
+	// the archive prepared for an evicted commit is kept
+	p := r.db.GetProjectByIDAndCommit(gcProjects[1], "c1")
+	err := r.storeContent(ctx, memoryFile{bytes.NewReader(make([]byte, 50))}, func(key, digest string, size int64) {
+		p.ZipArchive = domain.Archive{Path: key, Size: size, Digest: digest}
+		assert.NoError(t, r.db.SaveArchive(p, "zip"))
+	})
+	assert.NoError(t, err)
+
+	// 450 bytes are used, the collector runs from 420 down to 300
+	cfg := GCConfig{Quota: 600, HighWater: 0.7, LowWater: 0.5}
+	freed, err := r.Collect(ctx, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), freed)
+
+	for i, kept := range []bool{true, false, false, true} {
+		_, err := r.blobs.Stat(ctx, bundles[i].BundlePath)
+		assert.Equal(t, kept, err == nil, gcProjects[i])
+		commit := r.db.GetProjectByIDAndCommit(gcProjects[i], "c1")
+		assert.NotNil(t, commit, gcProjects[i])
+		assert.Equal(t, kept, commit.BundlePath != "", gcProjects[i])
+	}
+	commit := r.db.GetProjectByIDAndCommit(gcProjects[1], "c1")
+	assert.Equal(t, p.ZipArchive, commit.ZipArchive)
+	_, err = r.blobs.Stat(ctx, p.ZipArchive.Path)
+	assert.NoError(t, err)
+
+	// below the high-water mark nothing is evicted
+	freed, err = r.Collect(ctx, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), freed)
+}
+
+func TestCollectCountsOnlyLocalFiles(t *testing.T) {
+	blobs := files.NewMemory()
+	r, workspace := setupCollector(t, blobs)
+	ctx := context.Background()
+	bundle := addBundle(t, r, gcProjects[0], 1000, time.Now())
+
+	s, err := workspace.Spool(gcProjects[0])
+	assert.NoError(t, err)
+	defer s.Close()
+	_, err = s.Write(make([]byte, 300))
+	assert.NoError(t, err)
+
+	// the bundle in the bucket neither counts nor is evicted, the workspace is
+	freed, err := r.Collect(ctx, GCConfig{Quota: 400, HighWater: 0.5, LowWater: 0.25})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(300), freed)
+	_, err = blobs.Stat(ctx, bundle.BundlePath)
+	assert.NoError(t, err)
+	size, err := workspace.Usage(gcProjects[0])
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+}
+
+// addArchive records a commit of a project without bundle whose zip snapshot has size bytes
+func addArchive(t *testing.T, r *RepositoryManager, projectID string, size int) *domain.Project {
+	p, err := r.db.SaveBundle(domain.NewProject(uuid.MustParse(projectID), "c1", "project", "", ""))
+	assert.NoError(t, err)
+	content := bytes.NewReader([]byte(projectID + strings.Repeat("1", size-len(projectID))))
+	err = r.storeContent(context.Background(), memoryFile{content}, func(key, digest string, size int64) {
+		p.ZipArchive = domain.Archive{Path: key, Size: size, Digest: digest}
+		assert.NoError(t, r.db.SaveArchive(p, "zip"))
+	})
+	assert.NoError(t, err)
+	return p
+}
+
+func TestCollectEvictsContentsOtherThanBundles(t *testing.T) {
+	r, local := setupCollector(t, nil)
+	ctx := context.Background()
+
+	orphan := files.ContentKey(strings.Repeat("ab", 32))
+	assert.NoError(t, local.Put(ctx, orphan, bytes.NewReader(make([]byte, 200))))
+	old, fresh := quarantinePrefix+"/old.zip", quarantinePrefix+"/fresh.zip"
+	assert.NoError(t, local.Put(ctx, old, bytes.NewReader(make([]byte, 100))))
+	longAgo := time.Now().Add(-2 * quarantineRetention)
+	assert.NoError(t, os.Chtimes(local.FullPath(old), longAgo, longAgo))
+	assert.NoError(t, local.Put(ctx, fresh, bytes.NewReader(make([]byte, 50))))
+	evicted := addArchive(t, r, gcProjects[0], 150)
+	pinned := addArchive(t, r, gcProjects[1], 100)
+	assert.NoError(t, r.Pin(gcProjects[1]))
+
+	// 600 bytes are used, none by bundles, the collector runs from 500 down to 150
+	cfg := GCConfig{Quota: 1000, HighWater: 0.5, LowWater: 0.15}
+	freed, err := r.Collect(ctx, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(450), freed)
+
+	for key, kept := range map[string]bool{
+		orphan:                  false,
+		old:                     false,
+		fresh:                   true,
+		evicted.ZipArchive.Path: false,
+		pinned.ZipArchive.Path:  true,
+	} {
+		_, err := local.Stat(ctx, key)
+		assert.Equal(t, kept, err == nil, key)
+	}
+	commit := r.db.GetProjectByIDAndCommit(gcProjects[0], "c1")
+	if assert.NotNil(t, commit) {
+		assert.Equal(t, domain.Archive{}, commit.ZipArchive)
+	}
+
+	// what is left is below the high-water mark, nothing more is evicted
+	freed, err = r.Collect(ctx, cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), freed)
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/files"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// jobQueueSize is the number of preparation jobs that can wait for a worker
+const jobQueueSize = 256
+
+// ErrQueueFull is returned when no more preparation jobs can be accepted
+var ErrQueueFull = errors.New("Preparation queue is full")
+
+// errInterrupted is recorded on jobs which were running when rm stopped
+var errInterrupted = errors.New("Interrupted by a restart")
+
+// Start launches the workers preparing bundles in the background until ctx is done.
+// Jobs left unfinished by a previous run are marked as failed so that they can be requeued.
+func (r *RepositoryManager) Start(ctx context.Context, workers int) {
+	unfinished, err := r.statusDB.GetUnfinishedDownloadStatuses()
+	if err != nil {
+		r.l.WithField("error", err).Error("Unable to get unfinished jobs")
+	}
+	for _, s := range unfinished {
+		r.setState(s, domain.StateFailed, errInterrupted)
+	}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case s := <-r.queue:
+					r.runJob(ctx, s)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Prepare enqueues the preparation of the bundle for the given project and commit, or
+// only the download and extraction of the project if commit is empty.
+// If a job for the same commit is already in progress it is returned instead.
+func (r *RepositoryManager) Prepare(projectID, commit string) (*domain.DownloadStatus, error) {
+	r.jobsMu.Lock()
+	defer r.jobsMu.Unlock()
+
+	if s := r.statusDB.GetActiveDownloadStatus(projectID, commit); s != nil {
+		return s, nil
+	}
+
+	s := domain.NewDownloadStatus(uuid.MustParse(projectID), commit)
+	if err := r.statusDB.AddDownloadStatus(s); err != nil {
+		return nil, err
+	}
+
+	// the worker owns the queued job, callers get a snapshot
+	job := *s
+	select {
+	case r.queue <- s:
+	default:
+		r.setState(s, domain.StateFailed, ErrQueueFull)
+		return nil, ErrQueueFull
+	}
+
+	r.l.WithFields(logrus.Fields{
+		"projectID": projectID,
+		"commit":    commit,
+		"jobID":     s.JobID,
+	}).Info("Preparation job queued")
+	return &job, nil
+}
+
+// GetLatestJob returns the most recent job for the given project and commit or nil if there is none
+func (r *RepositoryManager) GetLatestJob(projectID, commit string) *domain.DownloadStatus {
+	return r.withProgress(r.statusDB.GetLatestDownloadStatus(projectID, commit))
+}
+
+// GetJob returns the job with the given id or nil if not found
+func (r *RepositoryManager) GetJob(jobID string) *domain.DownloadStatus {
+	return r.withProgress(r.statusDB.GetDownloadStatus(jobID))
+}
+
+// withProgress sets the progress of the download on jobs downloading their project
+func (r *RepositoryManager) withProgress(s *domain.DownloadStatus) *domain.DownloadStatus {
+	if s != nil && s.State == domain.StateDownloading {
+		s.Progress = r.downloads.progress(s.ProjectID.String())
+	}
+	return s
+}
+
+func (r *RepositoryManager) runJob(ctx context.Context, s *domain.DownloadStatus) {
+	_, err := r.Build(ctx, s.ProjectID.String(), s.CommitHash, func(state domain.DownloadState) {
+		r.setState(s, state, nil)
+	})
+	if err != nil {
+		r.l.WithFields(logrus.Fields{
+			"projectID": s.ProjectID,
+			"commit":    s.CommitHash,
+			"jobID":     s.JobID,
+			"state":     s.State,
+			"error":     err,
+		}).Error("Preparation job failed")
+		s.ErrorCode = ErrorCode(err)
+		r.setState(s, domain.StateFailed, err)
+		return
+	}
+	r.setState(s, domain.StateReady, nil)
+}
+
+// Build prepares the bundle for the given project and commit and reports the steps
+// it goes through to progress. A commit missing from the repository of a project
+// downloaded before has the project fetched again from rk, as the refresh policy
+// allows. Concurrent builds of the same commit are collapsed into one whose result is
+// shared. Downloading and extracting a project excludes any other work on it, while
+// bundles of different commits are built concurrently.
+func (r *RepositoryManager) Build(ctx context.Context, projectID, commit string, progress func(domain.DownloadState)) (*domain.Project, error) {
+	v, err := r.builds.Do(projectID+"@"+commit, progress, func(progress func(domain.DownloadState)) (interface{}, error) {
+		return r.build(ctx, projectID, commit, progress)
+	})
+	if err != nil {
+		return nil, classify(err)
+	}
+	return v.(*domain.Project), nil
+}
+
+// build runs the download, extraction and bundling of a commit. Without a commit
+// the project is only downloaded and extracted, and no project is returned.
+func (r *RepositoryManager) build(ctx context.Context, projectID, commit string, progress func(domain.DownloadState)) (*domain.Project, error) {
+	// a previous build may have finished in the meantime
+	if project := r.GetProjectForCommit(projectID, commit); project != nil {
+		return project, nil
+	}
+
+	projectName, err := r.GetProjectName(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.ensureExtracted(projectID, projectName, progress); err != nil {
+		return nil, err
+	}
+	if commit == "" {
+		return nil, nil
+	}
+
+	progress(domain.StateCheckingOut)
+	_, err = r.ResolveRef(ctx, projectID, projectName, commit)
+	if xerrors.Is(err, files.ErrCommitNotFound) && r.canRefresh(projectID) {
+		// the commit may have been pushed after the project was downloaded
+		var refreshed bool
+		refreshed, err = r.Refresh(ctx, projectID, projectName, progress)
+		if err != nil {
+			return nil, err
+		}
+		if refreshed {
+			progress(domain.StateCheckingOut)
+		}
+		_, err = r.ResolveRef(ctx, projectID, projectName, commit)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	if r.bundles.OnDemand {
+		// the bundle is generated when downloaded, a bundle stored before is kept
+		if project := r.db.GetProjectByIDAndCommit(projectID, commit); project != nil {
+			return project, nil
+		}
+		return r.SaveToDb(projectName, projectID, commit, "", "", 0), nil
+	}
+
+	progress(domain.StateBundling)
+	return r.BundleCommit(ctx, commit, projectID, projectName)
+}
+
+// ensureExtracted downloads and extracts the project unless this was done before
+func (r *RepositoryManager) ensureExtracted(projectID, projectName string, progress func(domain.DownloadState)) error {
+	r.locks.Lock(projectID)
+	defer r.locks.Unlock(projectID)
+
+	if r.IsExtracted(projectID, projectName) {
+		return nil
+	}
+
+	zipKey := files.ZipKey(projectID, projectName)
+	if !r.IsDownloaded(projectID, projectName) {
+		progress(domain.StateDownloading)
+		var err error
+		zipKey, err = r.DownloadZip(projectID, projectName)
+		if err != nil {
+			return err
+		}
+	}
+
+	progress(domain.StateExtracting)
+	return r.ExtractZip(zipKey, projectID, projectName)
+}
+
+func (r *RepositoryManager) setState(s *domain.DownloadStatus, state domain.DownloadState, cause error) error {
+	err := r.statusDB.SetState(s, state, cause)
+	if err != nil {
+		r.l.WithFields(logrus.Fields{
+			"jobID": s.JobID,
+			"state": state,
+			"error": err,
+		}).Error("Unable to update job state")
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/repository"
+	"github.com/iantal/rm/internal/repository/repositorytest"
+	"github.com/iantal/rm/internal/util"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestPrepareDeduplicatesActiveJobs(t *testing.T) {
+	db := repositorytest.NewDB(t)
+	r := &RepositoryManager{
+		l:        util.NewLogger(),
+		statusDB: repository.NewDownloadStatusDB(util.NewLogger(), db),
+		queue:    make(chan *domain.DownloadStatus, 1),
+	}
+	other := "7d1c3b52-4e1d-4a4b-9a5e-3c7c1d1f2a10"
+
+	job, err := r.Prepare(testProjectID, "c1")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.StateQueued, job.State)
+
+	again, err := r.Prepare(testProjectID, "c1")
+	assert.NoError(t, err)
+	assert.Equal(t, job.JobID, again.JobID)
+	assert.Len(t, r.queue, 1)
+
+	// without a worker the queue fills up, the job which did not fit is failed
+	_, err = r.Prepare(other, "c1")
+	assert.True(t, xerrors.Is(err, ErrQueueFull))
+	failed := r.GetLatestJob(other, "c1")
+	assert.Equal(t, domain.StateFailed, failed.State)
+	assert.Equal(t, ErrQueueFull.Error(), failed.Error)
+
+	// a finished job is not reused
+	queued := <-r.queue
+	assert.NoError(t, r.setState(queued, domain.StateReady, nil))
+	next, err := r.Prepare(testProjectID, "c1")
+	assert.NoError(t, err)
+	assert.NotEqual(t, job.JobID, next.JobID)
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/iantal/rm/internal/domain"
+)
+
+// projectLocks coordinates the work done on the repository of a project. Work which
+// modifies the repository takes the lock, work which only reads it takes the read lock.
+// Locks are created on demand and dropped once nobody holds or waits for them.
+type projectLocks struct {
+	mu    sync.Mutex
+	locks map[string]*projectLock
+}
+
+type projectLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newProjectLocks() *projectLocks {
+	return &projectLocks{locks: map[string]*projectLock{}}
+}
+
+// Lock blocks until the lock of the given project is acquired
+func (p *projectLocks) Lock(projectID string) {
+	p.acquire(projectID).Lock()
+}
+
+// Unlock releases the lock of the given project
+func (p *projectLocks) Unlock(projectID string) {
+	p.release(projectID).Unlock()
+}
+
+// RLock blocks until the read lock of the given project is acquired
+func (p *projectLocks) RLock(projectID string) {
+	p.acquire(projectID).RLock()
+}
+
+// RUnlock releases the read lock of the given project
+func (p *projectLocks) RUnlock(projectID string) {
+	p.release(projectID).RUnlock()
+}
+
+func (p *projectLocks) acquire(projectID string) *projectLock {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l, ok := p.locks[projectID]
+	if !ok {
+		l = &projectLock{}
+		p.locks[projectID] = l
+	}
+	l.refs++
+	return l
+}
+
+func (p *projectLocks) release(projectID string) *projectLock {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l := p.locks[projectID]
+	l.refs--
+	if l.refs == 0 {
+		delete(p.locks, projectID)
+	}
+	return l
+}
+
+// flight is a call in progress or completed for a key of a flightGroup
+type flight struct {
+	done      chan struct{}
+	val       interface{}
+	err       error
+	states    []domain.DownloadState
+	listeners []func(domain.DownloadState)
+}
+
+// flightGroup collapses concurrent calls for the same key into a single execution
+// whose result is shared by all callers. The progress reported by the execution is
+// replayed to callers joining late, so each of them observes every state in order.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: map[string]*flight{}}
+}
+
+// Do executes fn unless a call for the same key is in flight, in which case it waits
+// for that call and returns its result. listener may be nil.
+func (g *flightGroup) Do(key string, listener func(domain.DownloadState), fn func(progress func(domain.DownloadState)) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		if listener != nil {
+			for _, s := range f.states {
+				listener(s)
+			}
+			f.listeners = append(f.listeners, listener)
+		}
+		g.mu.Unlock()
+
+		<-f.done
+		return f.val, f.err
+	}
+
+	f := &flight{done: make(chan struct{})}
+	if listener != nil {
+		f.listeners = append(f.listeners, listener)
+	}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.val, f.err = fn(func(s domain.DownloadState) {
+		g.mu.Lock()
+		f.states = append(f.states, s)
+		listeners := append([]func(domain.DownloadState){}, f.listeners...)
+		g.mu.Unlock()
+
+		for _, l := range listeners {
+			l(s)
+		}
+	})
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+
+	return f.val, f.err
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/iantal/rm/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlightGroupSharesResultAndReplaysProgress(t *testing.T) {
+	g := newFlightGroup()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	calls := 0
+
+	build := func(progress func(domain.DownloadState)) (interface{}, error) {
+		calls++
+		progress(domain.StateDownloading)
+		close(started)
+		<-release
+		progress(domain.StateBundling)
+		return "bundle", nil
+	}
+
+	var wg sync.WaitGroup
+	var leaderStates, waiterStates []domain.DownloadState
+	var leaderVal, waiterVal interface{}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		leaderVal, _ = g.Do("p@c", func(s domain.DownloadState) { leaderStates = append(leaderStates, s) }, build)
+	}()
+	<-started
+
+	wg.Add(1)
+	joined := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		waiterVal, _ = g.Do("p@c", func(s domain.DownloadState) {
+			waiterStates = append(waiterStates, s)
+			if s == domain.StateDownloading {
+				close(joined)
+			}
+		}, build)
+	}()
+	<-joined
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "bundle", leaderVal)
+	assert.Equal(t, "bundle", waiterVal)
+	expected := []domain.DownloadState{domain.StateDownloading, domain.StateBundling}
+	assert.Equal(t, expected, leaderStates)
+	assert.Equal(t, expected, waiterStates)
+}
+
+func TestProjectLocksAreDroppedWhenReleased(t *testing.T) {
+	p := newProjectLocks()
+	p.Lock("a")
+	p.Lock("b")
+	p.Unlock("a")
+	assert.Len(t, p.locks, 1)
+	p.Unlock("b")
+	assert.Len(t, p.locks, 0)
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iantal/rm/internal/files"
+)
+
+// ErrInvalidCursor is returned for a cursor which was not returned by Log
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// Bounds of the number of commits in a page of the log
+const (
+	DefaultLogLimit = 30
+	MaxLogLimit     = 100
+)
+
+// LogQuery selects a page of the history of a project
+type LogQuery struct {
+	// Ref is where the history starts, HEAD when empty
+	Ref   string
+	Path  string
+	Since time.Time
+	Until time.Time
+	Limit int
+	// Cursor is the Next of the previous page, the other fields must not change between pages
+	Cursor string
+}
+
+// LogPage is a page of the history of a project
+type LogPage struct {
+	Commits []files.Commit `json:"commits"`
+	// Next is the cursor of the following page, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// Log returns a page of the history of the extracted repository of a project. The
+// cursor pins the commit the history starts from, so moving refs do not shift the pages.
+func (r *RepositoryManager) Log(ctx context.Context, projectID, projectName string, q LogQuery) (*LogPage, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultLogLimit
+	}
+	if q.Limit > MaxLogLimit {
+		q.Limit = MaxLogLimit
+	}
+
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	var head string
+	var skip int
+	if q.Cursor != "" {
+		var err error
+		if head, skip, err = decodeCursor(q.Cursor); err != nil {
+			return nil, err
+		}
+	} else {
+		ref := q.Ref
+		if ref == "" {
+			ref = "HEAD"
+		}
+		var err error
+		if head, err = r.ResolveCommit(ctx, ref, projectID, projectName); err != nil {
+			return nil, err
+		}
+	}
+
+	commits, err := r.workspace.Log(ctx, projectID, projectName, files.LogOptions{
+		Rev:   head,
+		Path:  q.Path,
+		Since: q.Since,
+		Until: q.Until,
+		Skip:  skip,
+		Limit: q.Limit + 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page := &LogPage{Commits: commits}
+	if len(commits) > q.Limit {
+		page.Commits = commits[:q.Limit]
+		page.Next = encodeCursor(head, skip+q.Limit)
+	}
+	return page, nil
+}
+
+// Commit returns the metadata of a commit of the extracted repository of a project
+func (r *RepositoryManager) Commit(ctx context.Context, projectID, projectName, rev string) (*files.Commit, error) {
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	return r.workspace.Commit(ctx, projectID, projectName, rev)
+}
+
+func encodeCursor(head string, skip int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(head + ":" + strconv.Itoa(skip)))
+}
+
+func decodeCursor(cursor string) (string, int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 || len(parts[0]) != 40 {
+		return "", 0, ErrInvalidCursor
+	}
+	skip, err := strconv.Atoi(parts[1])
+	if err != nil || skip < 0 {
+		return "", 0, ErrInvalidCursor
+	}
+	return parts[0], skip, nil
+}
@@ -0,0 +1,20 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogCursors(t *testing.T) {
+	head := "0123456789012345678901234567890123456789"
+	h, skip, err := decodeCursor(encodeCursor(head, 60))
+	assert.NoError(t, err)
+	assert.Equal(t, head, h)
+	assert.Equal(t, 60, skip)
+
+	for _, c := range []string{"not base64!", encodeCursor("short", 1), encodeCursor(head, -1)} {
+		_, _, err := decodeCursor(c)
+		assert.Equal(t, ErrInvalidCursor, err, c)
+	}
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/util"
+	"github.com/sirupsen/logrus"
+)
+
+// progressInterval is how often the progress of the downloads from rk is logged
+const progressInterval = 10 * time.Second
+
+// Metrics of the downloads from rk, served on /debug/vars
+var (
+	downloadedBytes = expvar.NewInt("rk_download_bytes")
+	downloadResumes = expvar.NewInt("rk_download_resumes")
+	activeDownloads = expvar.NewMap("rk_downloads")
+)
+
+// downloads tracks the archives being downloaded from rk by project. A project is
+// downloaded by one job at a time, which holds its lock.
+type downloads struct {
+	l  *util.StandardLogger
+	mu sync.Mutex
+	m  map[string]*download
+}
+
+func newDownloads(l *util.StandardLogger) *downloads {
+	return &downloads{l: l, m: map[string]*download{}}
+}
+
+// download is the progress of a download, bytes written to it are counted as received
+type download struct {
+	mu   sync.Mutex
+	p    domain.DownloadProgress
+	done chan struct{}
+}
+
+// start tracks the download of the archive of a project until finish is called, and logs
+// its progress meanwhile
+func (ds *downloads) start(projectID string) *download {
+	now := time.Now()
+	d := &download{
+		p:    domain.DownloadProgress{Total: -1, StartedAt: now, UpdatedAt: now},
+		done: make(chan struct{}),
+	}
+	ds.mu.Lock()
+	ds.m[projectID] = d
+	ds.mu.Unlock()
+	activeDownloads.Set(projectID, expvar.Func(func() interface{} {
+		return d.progress()
+	}))
+
+	go ds.report(projectID, d)
+	return d
+}
+
+// finish stops tracking the download of the archive of a project
+func (ds *downloads) finish(projectID string, d *download) {
+	close(d.done)
+	ds.mu.Lock()
+	if ds.m[projectID] == d {
+		delete(ds.m, projectID)
+	}
+	ds.mu.Unlock()
+	activeDownloads.Delete(projectID)
+}
+
+// progress returns the progress of the download of the archive of a project, or nil when
+// it is not being downloaded
+func (ds *downloads) progress(projectID string) *domain.DownloadProgress {
+	ds.mu.Lock()
+	d, ok := ds.m[projectID]
+	ds.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	p := d.progress()
+	return &p
+}
+
+// report logs the progress of a download until it finishes. Downloads which received
+// nothing since the last report are logged as stalled.
+func (ds *downloads) report(projectID string, d *download) {
+	t := time.NewTicker(progressInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case now := <-t.C:
+			p := d.progress()
+			fields := logrus.Fields{
+				"projectID": projectID,
+				"bytes":     p.Bytes,
+				"total":     p.Total,
+				"resumes":   p.Resumes,
+				"elapsed":   now.Sub(p.StartedAt).Round(time.Second),
+			}
+			if p.Total > 0 {
+				fields["percent"] = p.Bytes * 100 / p.Total
+			}
+			if idle := now.Sub(p.UpdatedAt); idle >= progressInterval {
+				fields["stalledFor"] = idle.Round(time.Second)
+				ds.l.WithFields(fields).Warn("Download from rk stalled")
+				continue
+			}
+			ds.l.WithFields(fields).Info("Downloading archive from rk")
+		}
+	}
+}
+
+func (d *download) progress() domain.DownloadProgress {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.p
+}
+
+// begin records an attempt at the download which receives the archive from offset on.
+// The bytes received before the offset are dropped when rk sends the archive again.
+func (d *download) begin(offset, total int64, resumed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.p.Bytes = offset
+	d.p.Total = total
+	d.p.UpdatedAt = time.Now()
+	if resumed {
+		d.p.Resumes++
+		downloadResumes.Add(1)
+	}
+}
+
+func (d *download) Write(b []byte) (int, error) {
+	d.mu.Lock()
+	d.p.Bytes += int64(len(b))
+	d.p.UpdatedAt = time.Now()
+	d.mu.Unlock()
+	downloadedBytes.Add(int64(len(b)))
+	return len(b), nil
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/iantal/rm/internal/domain"
+	"github.com/sirupsen/logrus"
+)
+
+// Bounds of the number of projects in a page of ListProjects
+const (
+	DefaultProjectsLimit = 50
+	MaxProjectsLimit     = 500
+)
+
+// ProjectsPage is a page of the projects held by rm
+type ProjectsPage struct {
+	Projects []*domain.ProjectSummary `json:"projects"`
+	Total    int                      `json:"total"`
+	Offset   int                      `json:"offset"`
+	Limit    int                      `json:"limit"`
+}
+
+// CachedCommit is a commit of a project whose bundle is stored
+type CachedCommit struct {
+	Commit         string     `json:"commit"`
+	Path           string     `json:"path"`
+	Size           int64      `json:"size"`
+	Digest         string     `json:"digest,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	LastAccessedAt *time.Time `json:"lastAccessedAt,omitempty"`
+}
+
+// ListProjects returns a page of the projects whose name contains the given text
+func (r *RepositoryManager) ListProjects(name string, offset, limit int) (*ProjectsPage, error) {
+	if limit <= 0 {
+		limit = DefaultProjectsLimit
+	}
+	if limit > MaxProjectsLimit {
+		limit = MaxProjectsLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	projects, total, err := r.db.ListProjects(name, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	pinned, err := r.db.GetPinnedProjects()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range projects {
+		p.Pinned = pinned[p.ProjectID.String()]
+	}
+	return &ProjectsPage{Projects: projects, Total: total, Offset: offset, Limit: limit}, nil
+}
+
+// GetProject returns the project with the given id or nil if no commit of it is cached
+func (r *RepositoryManager) GetProject(projectID string) (*domain.ProjectSummary, error) {
+	project, err := r.db.GetProjectSummary(projectID)
+	if err != nil || project == nil {
+		return nil, err
+	}
+	pinned, err := r.db.GetPinnedProjects()
+	if err != nil {
+		return nil, err
+	}
+	project.Pinned = pinned[projectID]
+	return project, nil
+}
+
+// CachedCommits returns the commits of a project whose bundle is stored, most recent first
+func (r *RepositoryManager) CachedCommits(projectID string) ([]CachedCommit, error) {
+	projects, err := r.db.GetProjectCommits(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []CachedCommit{}
+	for _, p := range projects {
+		if p.BundlePath == "" {
+			continue
+		}
+		info, err := r.blobs.Stat(context.Background(), p.BundlePath)
+		if err != nil {
+			continue
+		}
+		commits = append(commits, CachedCommit{
+			Commit:         p.CommitHash,
+			Path:           p.BundlePath,
+			Size:           info.Size,
+			Digest:         p.BundleDigest,
+			CreatedAt:      p.CreatedAt,
+			LastAccessedAt: p.LastAccessedAt,
+		})
+	}
+	return commits, nil
+}
+
+// MarkAccessed records that the bundle or an archive of the commit of a project was served
+func (r *RepositoryManager) MarkAccessed(project *domain.Project) {
+	if err := r.db.SetLastAccessed(project, time.Now()); err != nil {
+		r.l.WithFields(logrus.Fields{
+			"projectID": project.ProjectID,
+			"commit":    project.CommitHash,
+			"error":     err,
+		}).Error("Unable to record access")
+	}
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/files"
+	"github.com/sirupsen/logrus"
+)
+
+// RefreshPolicy chooses when the archive of a project downloaded before is fetched again
+// from rk to pick up the commits pushed since. Only commits requested by their full hash
+// trigger a fetch: branches and tags are resolved against the repository as downloaded,
+// so a ref created upstream since is not found and a ref moved since resolves to the
+// commit it pointed to, until a missing commit has the project fetched again.
+type RefreshPolicy struct {
+	// OnUnknownCommit fetches the project again when a commit is not in its repository
+	OnUnknownCommit bool
+	// MinInterval is the least time between two fetches of the same project, so that
+	// commits which do not exist do not hit rk on every request
+	MinInterval time.Duration
+}
+
+// allows reports whether a project last fetched at last can be fetched again at now
+func (p RefreshPolicy) allows(last, now time.Time) bool {
+	return p.OnUnknownCommit && (last.IsZero() || now.Sub(last) >= p.MinInterval)
+}
+
+// ConfigureRefresh chooses when projects are fetched again, it is called before the workers start
+func (r *RepositoryManager) ConfigureRefresh(policy RefreshPolicy) {
+	r.refreshPolicy = policy
+	r.l.WithFields(logrus.Fields{
+		"onUnknownCommit": policy.OnUnknownCommit,
+		"minInterval":     policy.MinInterval,
+	}).Info("Refresh policy")
+}
+
+// canRefresh reports whether the policy allows fetching the project again now, the first
+// download of the project counts as a fetch
+func (r *RepositoryManager) canRefresh(projectID string) bool {
+	var last time.Time
+	if v, ok := r.refreshed.Load(projectID); ok {
+		last = v.(time.Time)
+	}
+	return r.refreshPolicy.allows(last, time.Now())
+}
+
+// CommitUnknown reports whether the job failed because its commit is not in the repository
+// of the project and the project cannot be fetched again yet
+func (r *RepositoryManager) CommitUnknown(job *domain.DownloadStatus) bool {
+	return job.ErrorCode == CodeCommitNotFound && !r.canRefresh(job.ProjectID.String())
+}
+
+// Refresh downloads the archive of the project from rk again and merges its refs and objects
+// into the extracted repository, which keeps the commits it had. rk only serves whole
+// archives, the repository is not extracted again. Concurrent refreshes of a project are
+// collapsed into one. It reports whether the project was fetched, which it is not when a
+// refresh within the interval of the policy fetched it already.
+func (r *RepositoryManager) Refresh(ctx context.Context, projectID, projectName string, progress func(domain.DownloadState)) (bool, error) {
+	v, err := r.builds.Do("refresh/"+projectID, progress, func(progress func(domain.DownloadState)) (interface{}, error) {
+		return r.refresh(ctx, projectID, projectName, progress)
+	})
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+func (r *RepositoryManager) refresh(ctx context.Context, projectID, projectName string, progress func(domain.DownloadState)) (bool, error) {
+	if !r.canRefresh(projectID) {
+		return false, nil
+	}
+
+	// the archive is downloaded without the lock, the commits of the project are bundled
+	// and served meanwhile
+	r.l.WithField("projectID", projectID).Info("Refreshing project from rk")
+	progress(domain.StateDownloading)
+	download, err := r.downloadZip(ctx, projectID)
+	if err != nil {
+		return false, err
+	}
+	defer download.Close()
+
+	r.locks.Lock(projectID)
+	defer r.locks.Unlock(projectID)
+
+	if !r.IsExtracted(projectID, projectName) {
+		// the project was deleted during the download, it is not restored
+		return true, ErrProjectNotFound
+	}
+
+	progress(domain.StateExtracting)
+	if err := r.storeZip(projectID, projectName, download); err != nil {
+		return true, err
+	}
+	f, _, err := r.blobs.Get(ctx, files.ZipKey(projectID, projectName))
+	if err != nil {
+		return true, err
+	}
+	defer f.Close()
+	return true, r.workspace.Refresh(ctx, projectID, projectName, f)
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/iantal/rm/internal/domain"
+	"github.com/iantal/rm/internal/files"
+	"github.com/iantal/rm/internal/repository"
+	"github.com/iantal/rm/internal/repository/repositorytest"
+	"github.com/iantal/rm/internal/rk"
+	"github.com/iantal/rm/internal/rk/rktest"
+	"github.com/iantal/rm/internal/util"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func TestRefreshPolicyAllowsOneFetchPerInterval(t *testing.T) {
+	now := time.Now()
+	p := RefreshPolicy{OnUnknownCommit: true, MinInterval: time.Minute}
+
+	assert.True(t, p.allows(time.Time{}, now))
+	assert.False(t, p.allows(now.Add(-30*time.Second), now))
+	assert.True(t, p.allows(now.Add(-time.Minute), now))
+
+	p.OnUnknownCommit = false
+	assert.False(t, p.allows(time.Time{}, now))
+}
+
+func TestRefreshDownloadsWithoutTheLock(t *testing.T) {
+	r, s, blobs := setupDownloads(t)
+	defer s.Close()
+	r.builds = newFlightGroup()
+	r.refreshPolicy = RefreshPolicy{OnUnknownCommit: true}
+	s.AddProject(testProjectID, "project", testZip(t, "content"), "application/zip")
+
+	var states []domain.DownloadState
+	type result struct {
+		refreshed bool
+		err       error
+	}
+	done := make(chan result)
+	r.locks.Lock(testProjectID)
+	go func() {
+		refreshed, err := r.Refresh(context.Background(), testProjectID, "project", func(s domain.DownloadState) {
+			states = append(states, s)
+		})
+		done <- result{refreshed, err}
+	}()
+
+	// the archive is downloaded while the project is locked, and merged once it is not
+	assert.Eventually(t, func() bool {
+		return s.Requests("/api/v1/projects/"+testProjectID+"/download") == 1 && r.downloads.progress(testProjectID) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("Refresh did not wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.locks.Unlock(testProjectID)
+
+	// the project was deleted meanwhile, it is not restored
+	res := <-done
+	assert.True(t, xerrors.Is(res.err, ErrProjectNotFound))
+	assert.Equal(t, []domain.DownloadState{domain.StateDownloading}, states)
+	_, err := blobs.Stat(context.Background(), files.ZipKey(testProjectID, "project"))
+	assert.True(t, xerrors.Is(err, os.ErrNotExist))
+
+	// a refresh the policy does not allow leaves the job where it is
+	r.refreshPolicy = RefreshPolicy{}
+	refreshed, err := r.Refresh(context.Background(), testProjectID, "project", func(s domain.DownloadState) {
+		t.Errorf("Unexpected state %s", s)
+	})
+	assert.NoError(t, err)
+	assert.False(t, refreshed)
+}
+
+// commitFile commits content to file.txt of the repository in dir and returns the commit
+func commitFile(t *testing.T, dir, content string) string {
+	repo, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		repo, err = git.PlainInit(dir, false)
+	}
+	assert.NoError(t, err)
+	w, err := repo.Worktree()
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte(content), 0644))
+	_, err = w.Add("file.txt")
+	assert.NoError(t, err)
+	h, err := w.Commit(content, &git.CommitOptions{Author: &object.Signature{Name: "rm", Email: "test@rm.com", When: time.Now()}})
+	assert.NoError(t, err)
+	return h.String()
+}
+
+// repoZip returns the zip archive of the repository in dir, as rk serves it
+func repoZip(t *testing.T, dir string) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		w, err := zw.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+// setupBuilds creates a RepositoryManager building the projects rk serves, and the
+// directory of a repository to serve
+func setupBuilds(t *testing.T) (*RepositoryManager, *rktest.Server, *files.Memory, string) {
+	s := rktest.NewServer()
+	t.Cleanup(s.Close)
+	client, err := rk.NewClient(util.NewLogger(), rk.Options{BaseURL: s.URL, Retries: -1})
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "builds")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	workspace, err := files.NewLocal(util.NewLogger(), filepath.Join(dir, "rm"), 0, files.NewGoGit())
+	assert.NoError(t, err)
+	db := repositorytest.NewDB(t)
+	l := util.NewLogger()
+	blobs := files.NewMemory()
+	r := NewRepositoryManager(l, blobs, workspace, repository.NewProjectDB(l, db), repository.NewDownloadStatusDB(l, db), client)
+	return r, s, blobs, filepath.Join(dir, "src")
+}
+
+func TestBuildFetchesCommitsPushedSinceTheDownload(t *testing.T) {
+	r, s, _, src := setupBuilds(t)
+	r.ConfigureRefresh(RefreshPolicy{OnUnknownCommit: true, MinInterval: time.Minute})
+	ctx := context.Background()
+
+	first := commitFile(t, src, "one")
+	s.AddProject(testProjectID, "project", repoZip(t, src), "application/zip")
+	_, err := r.Build(ctx, testProjectID, first, func(domain.DownloadState) {})
+	assert.NoError(t, err)
+
+	// the commit is pushed a while after the project was downloaded
+	r.refreshed.Store(testProjectID, time.Now().Add(-time.Hour))
+	second := commitFile(t, src, "two")
+	s.AddProject(testProjectID, "project", repoZip(t, src), "application/zip")
+	var states []domain.DownloadState
+	project, err := r.Build(ctx, testProjectID, second, func(s domain.DownloadState) {
+		states = append(states, s)
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, second, project.CommitHash)
+		assert.NotEmpty(t, project.BundleDigest)
+	}
+	assert.Equal(t, []domain.DownloadState{
+		domain.StateCheckingOut, domain.StateDownloading, domain.StateExtracting,
+		domain.StateCheckingOut, domain.StateBundling,
+	}, states)
+
+	// the project is not fetched again within the interval
+	_, err = r.Build(ctx, testProjectID, "0123456789012345678901234567890123456789", func(domain.DownloadState) {})
+	assert.True(t, xerrors.Is(err, ErrCommitNotFound))
+	assert.Equal(t, 2, s.Requests("/api/v1/projects/"+testProjectID+"/download"))
+}
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"context"
+
+	"github.com/iantal/rm/internal/files"
+)
+
+// Repository returns the name of the project and whether its repository was extracted
+func (r *RepositoryManager) Repository(projectID string) (string, bool, error) {
+	projectName, err := r.GetProjectName(projectID)
+	if err != nil {
+		return "", false, err
+	}
+	return projectName, r.IsExtracted(projectID, projectName), nil
+}
+
+// ResolveRef returns the full hash of the commit a branch, tag or abbreviated hash points to
+// in the extracted repository of a project
+func (r *RepositoryManager) ResolveRef(ctx context.Context, projectID, projectName, ref string) (string, error) {
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	return r.ResolveCommit(ctx, ref, projectID, projectName)
+}
+
+// ListRefs returns the branches and tags of the extracted repository of a project
+func (r *RepositoryManager) ListRefs(ctx context.Context, projectID, projectName string) ([]files.Ref, error) {
+	r.locks.RLock(projectID)
+	defer r.locks.RUnlock(projectID)
+
+	return r.workspace.ListRefs(ctx, projectID, projectName)
+}
@@ -1,35 +1,85 @@
 package service
 
 import (
+	"sync"
+
 	"github.com/google/uuid"
 	"github.com/iantal/rm/internal/domain"
 	"github.com/iantal/rm/internal/files"
 	"github.com/iantal/rm/internal/repository"
+	"github.com/iantal/rm/internal/rk"
 	"github.com/iantal/rm/internal/util"
 	"github.com/sirupsen/logrus"
 )
 
 type RepositoryManager struct {
-	l      *util.StandardLogger
-	store  files.Storage
-	db     *repository.ProjectDB
-	rkHost string
+	l         *util.StandardLogger
+	blobs     files.BlobStore
+	workspace files.Workspace
+	db        *repository.ProjectDB
+	statusDB  *repository.DownloadStatusDB
+	rk        *rk.Client
+	names     sync.Map
+
+	jobsMu sync.Mutex
+	queue  chan *domain.DownloadStatus
+	locks  *projectLocks
+	builds *flightGroup
+
+	bundles BundleConfig
+	hot     *bundleCache
+
+	refreshPolicy RefreshPolicy
+	refreshed     sync.Map
+	downloads     *downloads
 }
 
-func NewRepositoryManager(log *util.StandardLogger, store files.Storage, db *repository.ProjectDB, rkHost string) *RepositoryManager {
+// NewRepositoryManager creates a RepositoryManager keeping the files it serves in blobs
+// and working on the repositories of the projects in workspace
+func NewRepositoryManager(log *util.StandardLogger, blobs files.BlobStore, workspace files.Workspace, db *repository.ProjectDB, statusDB *repository.DownloadStatusDB, rkClient *rk.Client) *RepositoryManager {
 	return &RepositoryManager{
-		l:      log,
-		store:  store,
-		db:     db,
-		rkHost: rkHost,
+		l:         log,
+		blobs:     blobs,
+		workspace: workspace,
+		db:        db,
+		statusDB:  statusDB,
+		rk:        rkClient,
+		queue:     make(chan *domain.DownloadStatus, jobQueueSize),
+		locks:     newProjectLocks(),
+		builds:    newFlightGroup(),
+		hot:       newBundleCache(0),
+		downloads: newDownloads(log),
 	}
 }
 
-// Gets the project from db for a given commit and projectId or nil if not found
+// ConfigureBundles chooses how bundles are kept, it is called before the workers start
+func (r *RepositoryManager) ConfigureBundles(cfg BundleConfig) {
+	r.bundles = cfg
+	r.hot = newBundleCache(cfg.CacheSize)
+	r.l.WithFields(logrus.Fields{
+		"onDemand":  cfg.OnDemand,
+		"cacheSize": cfg.CacheSize,
+	}).Info("Bundle mode")
+}
+
+// BundlesOnDemand reports whether bundles are generated when downloaded rather than stored
+func (r *RepositoryManager) BundlesOnDemand() bool {
+	return r.bundles.OnDemand
+}
+
+// Gets the project from db for a given commit and projectId or nil if not found.
+// With bundles generated on demand the repository of the project must be extracted.
 func (r *RepositoryManager) GetProjectForCommit(projectID, commit string) *domain.Project {
 	existingProject := r.db.GetProjectByIDAndCommit(projectID, commit)
 	r.l.WithField("existingProject", existingProject).Info("Existing project")
-	if existingProject != nil && existingProject.BundlePath != "" {
+	if existingProject == nil {
+		return nil
+	}
+	ready := existingProject.BundlePath != ""
+	if r.bundles.OnDemand {
+		ready = r.IsExtracted(projectID, existingProject.Name)
+	}
+	if ready {
 		r.l.WithFields(
 			logrus.Fields{
 				"projectID":   existingProject.ProjectID,
@@ -42,10 +92,19 @@ func (r *RepositoryManager) GetProjectForCommit(projectID, commit string) *domai
 	return nil
 }
 
-func (r *RepositoryManager) SaveToDb(projectName, projectID, commit string) *domain.Project {
-	up := r.store.UnzipPath(projectID)
-	bp := r.store.BundleFilePath(projectID, commit, projectName)
-	project := domain.NewProject(uuid.MustParse(projectID), commit, projectName, up, bp)
-	r.db.AddProject(project)
-	return project
+// SaveToDb records the commit of a project with the key, the digest and the size of its bundle
+func (r *RepositoryManager) SaveToDb(projectName, projectID, commit, bundleKey, digest string, size int64) *domain.Project {
+	project := domain.NewProject(uuid.MustParse(projectID), commit, projectName, "", bundleKey)
+	project.BundleDigest = digest
+	project.BundleSize = size
+	saved, err := r.db.SaveBundle(project)
+	if err != nil {
+		r.l.WithFields(logrus.Fields{
+			"projectID": projectID,
+			"commit":    commit,
+			"error":     err,
+		}).Error("Unable to record bundle")
+		return project
+	}
+	return saved
 }
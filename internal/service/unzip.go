@@ -1,18 +1,42 @@
 package service
 
 import (
+	"context"
+
+	"github.com/iantal/rm/internal/files"
 	"github.com/sirupsen/logrus"
 )
 
-func (r *RepositoryManager) ExtractZip(zipFile, projectID, projectName string) error {
+// IsExtracted reports whether the repository of the project was extracted
+func (r *RepositoryManager) IsExtracted(projectID, projectName string) bool {
+	return r.workspace.Extracted(projectID, projectName)
+}
+
+func (r *RepositoryManager) ExtractZip(zipKey, projectID, projectName string) error {
 	r.l.WithFields(logrus.Fields{
 		"projectID": projectID,
-		"ZipFile":   zipFile,
+		"ZipFile":   zipKey,
 	}).Info("Unzipping")
 
-	unzipPath := r.store.UnzipPath(projectID)
-	err := r.store.Unzip(zipFile, unzipPath, projectName)
+	ctx := context.Background()
+	f, _, err := r.blobs.Get(ctx, zipKey)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = r.workspace.Extract(ctx, projectID, projectName, f)
 	if err != nil {
+		if files.IsArchiveError(err) {
+			// drop the rejected archive so that the next attempt downloads it again
+			r.l.WithFields(logrus.Fields{
+				"projectID": projectID,
+				"zipFile":   zipKey,
+				"error":     err,
+			}).Warn("Removing rejected archive")
+			r.blobs.Delete(ctx, zipKey)
+			r.workspace.Remove(projectID)
+		}
 		return err
 	}
 
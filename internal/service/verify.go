@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/iantal/rm/internal/files"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/xerrors"
+)
+
+// quarantinePrefix is the key below which the archives found corrupt are kept for
+// inspection. They are out of the projects, so they are neither extracted nor evicted.
+const quarantinePrefix = "quarantine"
+
+// quarantineRetention is how long the archives found corrupt are kept before the collector
+// evicts them
+const quarantineRetention = 7 * 24 * time.Hour
+
+// VerifyDownloads checks that the archives downloaded from rk read through, and moves the
+// corrupt ones below quarantinePrefix so that they are downloaded again. It runs on startup
+// and returns the number of archives quarantined.
+func (r *RepositoryManager) VerifyDownloads(ctx context.Context) (int, error) {
+	blobs, err := r.blobs.List(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+
+	quarantined := 0
+	for _, b := range blobs {
+		projectID := strings.SplitN(b.Key, "/", 2)[0]
+		if _, err := uuid.Parse(projectID); err != nil || path.Dir(b.Key) != files.ZipPrefix(projectID) {
+			continue
+		}
+
+		corrupt, err := r.verifyZip(ctx, projectID, b.Key)
+		if err != nil {
+			return quarantined, err
+		}
+		if corrupt {
+			quarantined++
+		}
+	}
+	return quarantined, nil
+}
+
+// verifyZip checks the archive under key and quarantines it when it is corrupt, removing
+// the repositories extracted from it so that they are extracted again
+func (r *RepositoryManager) verifyZip(ctx context.Context, projectID, key string) (bool, error) {
+	r.locks.Lock(projectID)
+	defer r.locks.Unlock(projectID)
+
+	f, _, err := r.blobs.Get(ctx, key)
+	if xerrors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = r.withFile(projectID, f, func(name string) error {
+		return files.VerifyArchive(name)
+	})
+	f.Close()
+	if !files.IsArchiveError(err) {
+		return false, err
+	}
+
+	r.l.WithFields(logrus.Fields{
+		"projectID": projectID,
+		"zipFile":   key,
+		"error":     err,
+	}).Warn("Quarantining corrupt archive")
+	if err := r.quarantine(ctx, key); err != nil {
+		return true, err
+	}
+	return true, r.workspace.Remove(projectID)
+}
+
+// quarantine moves the blob under key below quarantinePrefix
+func (r *RepositoryManager) quarantine(ctx context.Context, key string) error {
+	f, _, err := r.blobs.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := r.blobs.Put(ctx, path.Join(quarantinePrefix, key), f); err != nil {
+		return err
+	}
+	return r.blobs.Delete(ctx, key)
+}
+
+// withFile calls fn with the name of a file holding the contents of the blob, which is
+// copied to a temporary file of the workspace of the project unless it is a file already
+func (r *RepositoryManager) withFile(projectID string, f files.File, fn func(name string) error) error {
+	if file, ok := f.(*os.File); ok {
+		return fn(file.Name())
+	}
+
+	tmp, err := r.workspace.Spool(projectID)
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, f); err != nil {
+		return xerrors.Errorf("Unable to copy blob: %w", err)
+	}
+	return fn(tmp.Name())
+}
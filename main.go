@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"fmt"
 	"net/http"
 	"os"
@@ -9,12 +10,14 @@ import (
 	"time"
 
 	"github.com/iantal/rm/internal/repository"
+	"github.com/iantal/rm/internal/rk"
 	"github.com/iantal/rm/internal/util"
 
 	gohandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/iantal/rm/internal/files"
 	"github.com/iantal/rm/internal/rest/handlers"
+	"github.com/iantal/rm/internal/service"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres" // postgres
 	"github.com/spf13/viper"
@@ -25,16 +28,47 @@ func main() {
 	logger := util.NewLogger()
 
 	bp := fmt.Sprintf("%v", viper.Get("BASE_PATH"))
-	rkHost := fmt.Sprintf("%v", viper.Get("RK_HOST"))
 
-	// create the storage class, use local storage
+	// run git through the command line tool unless the pure Go backend is requested
+	var git files.GitBackend = files.NewCLIGit()
+	if viper.GetString("GIT_BACKEND") == "go" {
+		git = files.NewGoGit()
+	}
+
+	// create the storage class, use local storage for the workspace and the blobs
 	// max filesize 5GB
-	stor, err := files.NewLocal(logger, bp, 1024*1000*1000*5)
+	local, err := files.NewLocal(logger, bp, 1024*1000*1000*5, git)
 	if err != nil {
 		logger.WithField("error", err).Error("Unable to create storage")
 		os.Exit(1)
 	}
 
+	// files left by writes interrupted by a crash are incomplete
+	if n, err := local.RemovePartial(); err != nil {
+		logger.WithField("error", err).Error("Unable to remove partial files")
+	} else if n > 0 {
+		logger.WithField("files", n).Warn("Removed partial files")
+	}
+
+	// with STORAGE=s3 the blobs are kept in a bucket, the base path only holds the workspace
+	var blobs files.BlobStore = local
+	if viper.GetString("STORAGE") == "s3" {
+		blobs, err = files.NewS3(logger, files.S3Options{
+			Endpoint:      viper.GetString("S3_ENDPOINT"),
+			AccessKey:     viper.GetString("S3_ACCESS_KEY"),
+			SecretKey:     viper.GetString("S3_SECRET_KEY"),
+			Region:        viper.GetString("S3_REGION"),
+			Secure:        viper.GetBool("S3_SECURE"),
+			Bucket:        viper.GetString("S3_BUCKET"),
+			Prefix:        viper.GetString("S3_PREFIX"),
+			PresignExpiry: viper.GetDuration("S3_PRESIGN_EXPIRY"),
+		})
+		if err != nil {
+			logger.WithField("error", err).Error("Unable to create storage")
+			os.Exit(1)
+		}
+	}
+
 	user := viper.Get("POSTGRES_USER")
 	password := viper.Get("POSTGRES_PASSWORD")
 	database := viper.Get("POSTGRES_DB")
@@ -53,25 +87,87 @@ func main() {
 		panic("Ping failed!")
 	}
 
+	// RK_HOST is a host or a URL, calls are retried RK_RETRIES times and fail fast for
+	// RK_BREAKER_COOLDOWN after RK_BREAKER_THRESHOLD consecutive failures
+	rkClient, err := rk.NewClient(logger, rk.Options{
+		BaseURL:          viper.GetString("RK_HOST"),
+		Timeout:          viper.GetDuration("RK_TIMEOUT"),
+		DownloadTimeout:  viper.GetDuration("RK_DOWNLOAD_TIMEOUT"),
+		Retries:          viper.GetInt("RK_RETRIES"),
+		Backoff:          viper.GetDuration("RK_BACKOFF"),
+		MaxBackoff:       viper.GetDuration("RK_MAX_BACKOFF"),
+		BreakerThreshold: viper.GetInt("RK_BREAKER_THRESHOLD"),
+		BreakerCooldown:  viper.GetDuration("RK_BREAKER_COOLDOWN"),
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("Unable to create rk client")
+		os.Exit(1)
+	}
+
 	projectDB := repository.NewProjectDB(logger, db)
-	projH := handlers.NewProjects(logger, stor, projectDB, rkHost)
+	statusDB := repository.NewDownloadStatusDB(logger, db)
+
+	// prepare bundles in the background
+	// the workers stop, and the git commands they run are killed, on shutdown
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	rm := service.NewRepositoryManager(logger, blobs, local, projectDB, statusDB, rkClient)
+	// BUNDLE_MODE=ondemand generates bundles from the repository of the project when they
+	// are downloaded instead of storing one per commit, trading CPU and the latency of the
+	// first download of a bundle for storage
+	viper.SetDefault("BUNDLE_CACHE_SIZE", 256*1024*1024)
+	rm.ConfigureBundles(service.BundleConfig{
+		OnDemand:  viper.GetString("BUNDLE_MODE") == "ondemand",
+		CacheSize: viper.GetInt64("BUNDLE_CACHE_SIZE"),
+	})
+	// a commit hash missing from a project downloaded before has the project fetched
+	// again from rk, at most once per REFRESH_MIN_INTERVAL. Branches and tags resolve
+	// against the repository as downloaded.
+	viper.SetDefault("REFRESH_ON_UNKNOWN_COMMIT", true)
+	viper.SetDefault("REFRESH_MIN_INTERVAL", "5m")
+	rm.ConfigureRefresh(service.RefreshPolicy{
+		OnUnknownCommit: viper.GetBool("REFRESH_ON_UNKNOWN_COMMIT"),
+		MinInterval:     viper.GetDuration("REFRESH_MIN_INTERVAL"),
+	})
+	rm.Start(workerCtx, 2)
+
+	// archives downloaded before which are corrupt are quarantined and downloaded again
+	go func() {
+		n, err := rm.VerifyDownloads(workerCtx)
+		if err != nil {
+			logger.WithField("error", err).Error("Unable to verify downloads")
+		}
+		if n > 0 {
+			logger.WithField("archives", n).Warn("Quarantined corrupt archives")
+		}
+	}()
+
+	// evict the least recently used files once the storage fills up
+	viper.SetDefault("STORAGE_HIGH_WATER", 0.9)
+	viper.SetDefault("STORAGE_LOW_WATER", 0.8)
+	viper.SetDefault("GC_INTERVAL", "5m")
+	rm.StartCollector(workerCtx, service.GCConfig{
+		Quota:     viper.GetInt64("STORAGE_QUOTA"),
+		HighWater: viper.GetFloat64("STORAGE_HIGH_WATER"),
+		LowWater:  viper.GetFloat64("STORAGE_LOW_WATER"),
+		Interval:  viper.GetDuration("GC_INTERVAL"),
+	})
+
+	projH := handlers.NewProjects(logger, rm)
+	jobH := handlers.NewJobs(logger, rm)
 	// mw := handlers.GzipHandler{}
 
 	// create a new serve mux and register the handlers
-	sm := mux.NewRouter()
+	sm := newRouter(projH, jobH)
 
 	ch := gohandlers.CORS(gohandlers.AllowedOrigins([]string{"*"}))
 
-	gh := sm.Methods(http.MethodGet).Subrouter()
-	gh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/{commit:[0-9a-f]{40}}/download", projH.Download)
-
 	// create a new server
 	s := http.Server{
-		Addr:         ":8005",            // configure the bind address
-		Handler:      ch(sm),             // set the default handler
-		ReadTimeout:  50 * time.Second,    // max time to read request from the client
-		WriteTimeout: 10000 * time.Second, // max time to write response to the client
-		IdleTimeout:  12 * time.Second, // max time for connections using TCP Keep-Alive
+		Addr:         ":8005",                    // configure the bind address
+		Handler:      ch(handlers.RequestID(sm)), // set the default handler
+		ReadTimeout:  50 * time.Second,           // max time to read request from the client
+		WriteTimeout: 10000 * time.Second,        // max time to write response to the client
+		IdleTimeout:  12 * time.Second,           // max time for connections using TCP Keep-Alive
 	}
 
 	// start the server
@@ -94,6 +190,47 @@ func main() {
 	logger.WithField("signal", sig).Info("Shutting down server with signal")
 
 	// gracefully shutdown the server, waiting max 30 seconds for current operations to complete
-	ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 	s.Shutdown(ctx)
+	stopWorkers()
+}
+
+// newRouter registers the handlers of the API
+func newRouter(projH *handlers.Projects, jobH *handlers.Jobs) *mux.Router {
+	sm := mux.NewRouter()
+
+	gh := sm.Methods(http.MethodGet).Subrouter()
+	gh.HandleFunc("/api/v1/projects", projH.List)
+	gh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}", projH.Get)
+	gh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/refs", projH.Refs)
+	gh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/commits", projH.Commits)
+	gh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/commits/cached", projH.CachedCommits)
+	gh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/compare/{range:.+}", projH.Compare)
+	gh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/commits/{commit:.+}", projH.Commit)
+	// downloads come first so that refs may contain /tree/ or /blob/, directories named
+	// download or archive are listed with a trailing slash, files named so are not served
+	gh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/{commit:.+}/download", projH.Download)
+	gh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/{commit:.+}/archive", projH.Archive)
+	// the commit is matched lazily so that paths may contain /tree/ or /blob/
+	gh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/{commit:.+?}/tree", projH.Tree)
+	gh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/{commit:.+?}/tree/{path:.*}", projH.Tree)
+	gh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/{commit:.+?}/blob/{path:.+}", projH.Blob)
+	gh.HandleFunc("/api/v1/jobs/{id:[0-9a-f-]{36}}", jobH.Get)
+	// metrics, including the progress of the downloads from rk
+	gh.Handle("/debug/vars", expvar.Handler())
+
+	ph := sm.Methods(http.MethodPost).Subrouter()
+	ph.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/prepare", projH.Prepare)
+	ph.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/{commit:.+}/prepare", projH.Prepare)
+
+	uh := sm.Methods(http.MethodPut).Subrouter()
+	uh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/pin", projH.Pin)
+
+	dh := sm.Methods(http.MethodDelete).Subrouter()
+	dh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}", projH.Delete)
+	dh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/pin", projH.Unpin)
+	dh.HandleFunc("/api/v1/projects/{id:[0-9a-f-]{36}}/{commit:[0-9a-f]{40}}", projH.DeleteCommit)
+
+	return sm
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/iantal/rm/internal/rest/handlers"
+	"github.com/iantal/rm/internal/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutesTellRefsFromPaths(t *testing.T) {
+	l := util.NewLogger()
+	sm := newRouter(handlers.NewProjects(l, nil), handlers.NewJobs(l, nil))
+
+	base := "/api/v1/projects/7d1c3b52-4e1d-4a4b-9a5e-3c7c1d1f2a10/"
+	for path, want := range map[string]struct{ route, commit, path string }{
+		"feature/tree/download":         {"/download", "feature/tree", ""},
+		"feature/tree/download/archive": {"/archive", "feature/tree/download", ""},
+		"feature/blob/x/download":       {"/download", "feature/blob/x", ""},
+		"main/tree":                     {"/tree", "main", ""},
+		"main/tree/docs/tree/a":         {"/tree/{path:.*}", "main", "docs/tree/a"},
+		"main/tree/docs/archive/":       {"/tree/{path:.*}", "main", "docs/archive/"},
+		"main/blob/src/blob/b.go":       {"/blob/{path:.+}", "main", "src/blob/b.go"},
+	} {
+		var m mux.RouteMatch
+		if !assert.True(t, sm.Match(httptest.NewRequest(http.MethodGet, base+path, nil), &m), path) {
+			continue
+		}
+		tpl, err := m.Route.GetPathTemplate()
+		assert.NoError(t, err)
+		assert.True(t, strings.HasSuffix(tpl, want.route), "%s matched %s", path, tpl)
+		assert.Equal(t, want.commit, m.Vars["commit"], path)
+		assert.Equal(t, want.path, m.Vars["path"], path)
+	}
+}